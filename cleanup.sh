@@ -13,6 +13,7 @@ rm -f *.exe
 # Remove runtime data
 rm -rf stag-data/
 rm -rf stag-data
+rm -rf relay-data/
 rm -rf test-data/
 rm -rf *-data/
 rm -f *.db
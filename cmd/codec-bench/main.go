@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// codec-bench compares the size and encode/decode time of stored mesh
+// versions in the JSON and binary record formats.
+func main() {
+	var (
+		sizes = flag.String("vertices", "500,5000,20000", "Comma-separated vertex counts of the meshes to benchmark")
+		seed  = flag.Int64("seed", 1, "Random seed for the generated meshes")
+	)
+	flag.Parse()
+
+	rng := rand.New(rand.NewSource(*seed))
+
+	fmt.Printf("%-9s %12s %12s %6s %12s %12s %12s %12s\n",
+		"vertices", "json bytes", "binary bytes", "ratio", "json decode", "bin decode", "json encode", "bin encode")
+
+	for _, field := range strings.Split(*sizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 3 {
+			log.Fatalf("❌ Invalid vertex count %q", field)
+		}
+
+		version := meshVersion(rng, n)
+		jsonData, err := json.Marshal(version)
+		if err != nil {
+			log.Fatal("JSON encode error:", err)
+		}
+		binData, err := storage.MarshalVersion(version)
+		if err != nil {
+			log.Fatal("Binary encode error:", err)
+		}
+
+		// Both formats must decode to the same version
+		var fromJSON, fromBin storage.AnchorVersion
+		if err := storage.UnmarshalVersion(jsonData, &fromJSON); err != nil {
+			log.Fatal("JSON decode error:", err)
+		}
+		if err := storage.UnmarshalVersion(binData, &fromBin); err != nil {
+			log.Fatal("Binary decode error:", err)
+		}
+		a, _ := json.Marshal(&fromJSON)
+		b, _ := json.Marshal(&fromBin)
+		if string(a) != string(b) {
+			log.Fatalf("❌ Binary round trip of %d vertices differs from JSON", n)
+		}
+
+		jsonDecode := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var v storage.AnchorVersion
+				if err := storage.UnmarshalVersion(jsonData, &v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		binDecode := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var v storage.AnchorVersion
+				if err := storage.UnmarshalVersion(binData, &v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		jsonEncode := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := json.Marshal(version); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		binEncode := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := storage.MarshalVersion(version); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		fmt.Printf("%-9d %12d %12d %5.1fx %12s %12s %12s %12s\n",
+			n, len(jsonData), len(binData), float64(len(jsonData))/float64(len(binData)),
+			perOp(jsonDecode), perOp(binDecode), perOp(jsonEncode), perOp(binEncode))
+	}
+}
+
+func perOp(r testing.BenchmarkResult) string {
+	return time.Duration(r.NsPerOp()).String()
+}
+
+// meshVersion builds a scanned-surface mesh the way ARKit reports one:
+// float32 positions and normals widened to float64, and a triangle list.
+func meshVersion(rng *rand.Rand, vertices int) *storage.AnchorVersion {
+	mesh := &storage.MeshData{
+		AnchorID:       "mesh_bench",
+		Vertices:       make([]float64, 3*vertices),
+		Normals:        make([]float64, 3*vertices),
+		Faces:          make([]uint32, 0, 6*vertices),
+		Classification: "wall",
+		Confidence:     0.92,
+	}
+
+	for i := 0; i < vertices; i++ {
+		x, z := rng.Float64()*4-2, rng.Float64()*4-2
+		y := 0.05*math.Sin(3*x) + 0.002*rng.NormFloat64()
+		mesh.Vertices[3*i] = float64(float32(x))
+		mesh.Vertices[3*i+1] = float64(float32(y))
+		mesh.Vertices[3*i+2] = float64(float32(z))
+
+		nx, ny, nz := -0.15*math.Cos(3*x), 1.0, 0.01*rng.NormFloat64()
+		l := math.Sqrt(nx*nx + ny*ny + nz*nz)
+		mesh.Normals[3*i] = float64(float32(nx / l))
+		mesh.Normals[3*i+1] = float64(float32(ny / l))
+		mesh.Normals[3*i+2] = float64(float32(nz / l))
+	}
+	for len(mesh.Faces) < cap(mesh.Faces) {
+		a := rng.Intn(vertices - 2)
+		mesh.Faces = append(mesh.Faces, uint32(a), uint32(a+1), uint32(a+2))
+	}
+
+	return &storage.AnchorVersion{
+		VersionID:  "v12",
+		Hash:       "5d41402abc4b2a76b9719d911017c592",
+		Timestamp:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		ChangeType: "update",
+		Transform: &storage.Transform{
+			Translation: [3]float64{0.42, 0, -1.3},
+			Rotation:    [4]float64{0, 0.3826834, 0, 0.9238795},
+			Scale:       [3]float64{1, 1, 1},
+		},
+		MeshData:    mesh,
+		EventID:     "evt_bench",
+		SessionID:   "session-123",
+		ClientID:    "client-1",
+		DeviceID:    "device-1",
+		FrameNumber: 1842,
+		Metadata:    map[string]interface{}{"trace_id": "1792132227383937233"},
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/tabular/local-pipeline/internal/relay"
+	"github.com/tabular/local-pipeline/internal/certs"
 	"github.com/tabular/local-pipeline/internal/config"
 	"github.com/tabular/local-pipeline/internal/logging"
 )
@@ -27,6 +30,19 @@ func main() {
 		configPath   = flag.String("config", "", "Path to configuration file")
 		port         = flag.Int("port", 8080, "WebSocket server port")
 		stagEndpoint = flag.String("stag-endpoint", "http://localhost:9000/ingest", "Stag service endpoint")
+		outboxPath   = flag.String("outbox", "./relay-data/outbox.db", "Outbox database path for undelivered batches")
+		devicesPath  = flag.String("devices", "./relay-data/devices.db", "Device registry path")
+		requireAuth  = flag.Bool("require-auth", false, "Reject devices without a valid device key")
+		addDevice    = flag.String("add-device", "", "Register a device (or rotate its key) and print its key")
+		deviceName   = flag.String("device-name", "", "Display name for -add-device")
+		revokeDevice = flag.String("revoke-device", "", "Revoke a device's key")
+		listDevices  = flag.Bool("list-devices", false, "List registered devices")
+		useTLS       = flag.Bool("tls", false, "Serve wss:// with the certificate in -cert-dir")
+		genCert      = flag.Bool("gen-cert", false, "Generate a local CA and a certificate for the LAN IP, then exit")
+		certDir      = flag.String("cert-dir", "./certs", "Directory for generated certificates")
+		noMDNS       = flag.Bool("no-mdns", false, "Do not advertise the relay on the LAN via mDNS")
+		discover     = flag.Bool("discover", false, "Browse the LAN for relays and exit")
+		noSync       = flag.Bool("no-sync", false, "Do not push Stag anchor updates to devices in the same session")
 		logLevel     = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
 		showVersion  = flag.Bool("version", false, "Show version information")
 		showIP       = flag.Bool("ip", false, "Show LAN IP address")
@@ -42,7 +58,7 @@ func main() {
 	}
 
 	if *showIP {
-		ip, err := getLANIP()
+		ip, err := certs.LANIP()
 		if err != nil {
 			fmt.Printf("Error getting LAN IP: %v\n", err)
 			os.Exit(1)
@@ -51,6 +67,22 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *discover {
+		if err := discoverRelays(); err != nil {
+			fmt.Printf("Error discovering relays: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *genCert {
+		if err := generateCert(*certDir); err != nil {
+			fmt.Printf("Error generating certificate: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize logger
 	logger := logging.NewLogger(*logLevel, "relay")
 	logger.Info("🚀 Starting Tabular Local Relay Service",
@@ -72,19 +104,72 @@ func main() {
 	if *stagEndpoint != "http://localhost:9000/ingest" {
 		cfg.RelayEndpoint = *stagEndpoint
 	}
+	if *outboxPath != "./relay-data/outbox.db" {
+		cfg.OutboxPath = *outboxPath
+	}
+	if *devicesPath != "./relay-data/devices.db" {
+		cfg.RelayDevicesPath = *devicesPath
+	}
+	if *requireAuth {
+		cfg.RelayAuthRequired = true
+	}
 	if *logLevel != "info" {
 		cfg.LogLevel = *logLevel
 	}
+	if *noMDNS {
+		cfg.RelayMDNS = false
+	}
+	if *noSync {
+		cfg.RelaySync = false
+	}
+	if *useTLS {
+		paths := certs.PathsIn(*certDir)
+		cfg.TLSCertFile = paths.ServerCert
+		cfg.TLSKeyFile = paths.ServerKey
+		if cfg.TLSCAFile == "" {
+			cfg.TLSCAFile = paths.CACert
+		}
+	}
 
 	// Get LAN IP for display
-	lanIP, err := getLANIP()
+	lanIP, err := certs.LANIP()
 	if err != nil {
 		logger.Warn("Failed to get LAN IP", "error", err)
 		lanIP = "localhost"
 	}
 
+	// Open device registry
+	devices, err := relay.OpenDeviceRegistry(cfg.RelayDevicesPath)
+	if err != nil {
+		logger.Error("Failed to open device registry", "error", err)
+		os.Exit(1)
+	}
+	defer devices.Close()
+
+	// Handle device management commands
+	if *addDevice != "" || *revokeDevice != "" || *listDevices {
+		if err := manageDevices(devices, *addDevice, *deviceName, *revokeDevice, *listDevices); err != nil {
+			logger.Error("Device management failed", "error", err)
+			devices.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Open outbox for batches Stag cannot take
+	outbox, err := relay.OpenOutbox(cfg.OutboxPath)
+	if err != nil {
+		logger.Error("Failed to open outbox", "error", err)
+		os.Exit(1)
+	}
+	defer outbox.Close()
+
+	if depth := outbox.Depth(); depth > 0 {
+		logger.Info("📦 Resuming delivery of queued batches", "queued", depth, "outbox", cfg.OutboxPath)
+	}
+
 	// Create relay service
-	relayService := relay.NewService(cfg, logger)
+	relayService := relay.NewService(cfg, logger, outbox, devices)
 
 	// Setup HTTP server
 	server := &http.Server{
@@ -95,21 +180,52 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	scheme := "ws"
+	if cfg.TLSEnabled() {
+		tlsConfig, err := certs.ServerConfig(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			logger.Error("Failed to load TLS certificate (run with -gen-cert first)", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+		scheme = "wss"
+	}
+
 	// Start server in goroutine
 	go func() {
 		logger.Info("🌍 Relay service started",
 			"port", cfg.Port,
-			"websocket_url", fmt.Sprintf("ws://%s:%d/ws/streamkit", lanIP, cfg.Port),
-			"local_url", fmt.Sprintf("ws://localhost:%d/ws/streamkit", cfg.Port),
+			"websocket_url", fmt.Sprintf("%s://%s:%d/ws/streamkit", scheme, lanIP, cfg.Port),
+			"local_url", fmt.Sprintf("%s://localhost:%d/ws/streamkit", scheme, cfg.Port),
 			"stag_endpoint", cfg.RelayEndpoint,
+			"auth_required", cfg.RelayAuthRequired,
+			"tls", cfg.TLSEnabled(),
 		)
 		
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if cfg.TLSEnabled() {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Server failed to start", "error", err)
 			os.Exit(1)
 		}
 	}()
 
+	// Advertise on the LAN so devices can find the relay
+	if cfg.RelayMDNS {
+		if ip := net.ParseIP(lanIP); ip == nil {
+			logger.Warn("Not advertising via mDNS without a LAN IP")
+		} else if advertiser, err := relay.Advertise(version, cfg.Port, ip, cfg.TLSEnabled(), cfg.RelayAuthRequired); err != nil {
+			logger.Warn("Failed to advertise via mDNS", "error", err)
+		} else {
+			defer advertiser.Shutdown()
+			logger.Info("📡 Advertising relay via mDNS", "service", relay.DiscoveryService)
+		}
+	}
+
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -125,17 +241,80 @@ func main() {
 		logger.Error("Server forced to shutdown", "error", err)
 		os.Exit(1)
 	}
+	relayService.Stop()
 
 	logger.Info("✅ Server stopped successfully")
 }
 
-func getLANIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+func manageDevices(devices *relay.DeviceRegistry, add, name, revoke string, list bool) error {
+	if add != "" {
+		key, device, err := devices.Issue(add, name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("🔑 Device %s registered\n", device.DeviceID)
+		fmt.Printf("API key (shown once): %s\n", key)
+	}
+
+	if revoke != "" {
+		if err := devices.Revoke(revoke); err != nil {
+			return fmt.Errorf("failed to revoke %s: %w", revoke, err)
+		}
+		fmt.Printf("🔒 Device %s revoked\n", revoke)
+	}
+
+	if list {
+		registered, err := devices.List()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("📱 Registered devices (%d):\n", len(registered))
+		for _, device := range registered {
+			status := "active"
+			if device.Revoked() {
+				status = "revoked"
+			}
+			fmt.Printf("  - %s (%s) key %s... %s, created %s\n",
+				device.DeviceID, device.Name, device.KeyHint, status, device.CreatedAt.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+func discoverRelays() error {
+	fmt.Printf("🔍 Browsing for %s relays...\n", relay.DiscoveryService)
+
+	// The mDNS client logs every malformed packet on the LAN
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	relays, err := relay.Discover(3 * time.Second)
+	log.SetOutput(prev)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("📡 Found %d relay(s):\n", len(relays))
+	for _, r := range relays {
+		fmt.Printf("  - %s (%s) version %s, tls %t, auth required %t\n", r.Instance, r.Host, r.Version, r.TLS, r.AuthRequired)
+		fmt.Printf("    %s\n", r.URL())
+	}
+	return nil
+}
+
+// generateCert writes a certificate for this machine's LAN IP, signed by
+// the local CA in dir, creating the CA on first use.
+func generateCert(dir string) error {
+	hosts := certs.DefaultHosts()
+	paths, err := certs.Generate(dir, hosts)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
+	fmt.Printf("🔐 Certificate generated for %v\n", hosts)
+	fmt.Printf("   CA certificate: %s (install and trust this on devices once)\n", paths.CACert)
+	fmt.Printf("   Server certificate: %s\n", paths.ServerCert)
+	fmt.Printf("   Server key: %s\n", paths.ServerKey)
+	fmt.Printf("Start the relay with -tls to serve wss://\n")
+	return nil
 }
\ No newline at end of file
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/tabular/local-pipeline/internal/certs"
 	"github.com/tabular/local-pipeline/internal/stag"
 	"github.com/tabular/local-pipeline/internal/storage"
 	"github.com/tabular/local-pipeline/internal/config"
@@ -34,6 +35,9 @@ func main() {
 		listStags    = flag.Bool("list", false, "List all stags")
 		showStats    = flag.Bool("stats", false, "Show system statistics")
 		cleanDB      = flag.Bool("clean", false, "Clean database (remove all data)")
+		useTLS       = flag.Bool("tls", false, "Serve https:// with the certificate in -cert-dir")
+		genCert      = flag.Bool("gen-cert", false, "Generate a local CA and a certificate for the LAN IP, then exit")
+		certDir      = flag.String("cert-dir", "./certs", "Directory for generated certificates")
 	)
 	flag.Parse()
 
@@ -45,6 +49,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *genCert {
+		if err := generateCert(*certDir); err != nil {
+			fmt.Printf("Error generating certificate: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Initialize logger
 	logger := logging.NewLogger(*logLevel, "stag")
 	logger.Info("🚀 Starting Tabular Local Stag Service",
@@ -71,9 +83,14 @@ func main() {
 	if *logLevel != "info" {
 		cfg.LogLevel = *logLevel
 	}
+	if *useTLS {
+		paths := certs.PathsIn(*certDir)
+		cfg.TLSCertFile = paths.ServerCert
+		cfg.TLSKeyFile = paths.ServerKey
+	}
 
 	// Initialize storage
-	store, err := storage.NewBoltStorage(cfg.DatabasePath)
+	store, err := storage.NewBoltStorage(cfg.DatabasePath, cfg.SnapshotThreshold)
 	if err != nil {
 		logger.Error("Failed to initialize storage", "error", err)
 		os.Exit(1)
@@ -123,7 +140,7 @@ func main() {
 
 func startServer(cfg *config.Config, store storage.Storage, logger *logging.Logger) {
 	// Initialize service
-	service := stag.NewService(store, logger)
+	service := stag.NewService(cfg, store, logger)
 
 	// Setup HTTP routes
 	router := mux.NewRouter()
@@ -145,13 +162,16 @@ func startServer(cfg *config.Config, store storage.Storage, logger *logging.Logg
 	
 	// Ingest endpoint
 	apiRouter.HandleFunc("/ingest", service.HandleIngest).Methods("POST")
+	apiRouter.HandleFunc("/batches/{batch_id}", service.HandleGetBatch).Methods("GET")
 	
 	// Query endpoints
 	apiRouter.HandleFunc("/stags", service.HandleListStags).Methods("GET")
 	apiRouter.HandleFunc("/stags/{stag_id}", service.HandleGetStag).Methods("GET")
 	apiRouter.HandleFunc("/stags/{stag_id}/anchors", service.HandleListAnchors).Methods("GET")
 	apiRouter.HandleFunc("/stags/{stag_id}/anchors/{anchor_id}", service.HandleGetAnchor).Methods("GET")
+	apiRouter.HandleFunc("/stags/{stag_id}/anchors/{anchor_id}", service.HandleDeleteAnchor).Methods("DELETE")
 	apiRouter.HandleFunc("/stags/{stag_id}/anchors/{anchor_id}/history", service.HandleGetAnchorHistory).Methods("GET")
+	apiRouter.HandleFunc("/stags/{stag_id}/subscribe", service.HandleSubscribe).Methods("GET")
 	apiRouter.HandleFunc("/stats", service.HandleGetStats).Methods("GET")
 	apiRouter.HandleFunc("/stats/{stag_id}", service.HandleGetStagStats).Methods("GET")
 
@@ -191,15 +211,34 @@ func startServer(cfg *config.Config, store storage.Storage, logger *logging.Logg
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	server.RegisterOnShutdown(service.Stop)
+
+	scheme := "http"
+	if cfg.TLSEnabled() {
+		tlsConfig, err := certs.ServerConfig(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			logger.Error("Failed to load TLS certificate (run with -gen-cert first)", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+		scheme = "https"
+	}
 
 	// Start server in goroutine
 	go func() {
 		logger.Info("🌍 Stag service started", 
 			"port", cfg.Port,
-			"endpoint", fmt.Sprintf("http://localhost:%d", cfg.Port),
+			"endpoint", fmt.Sprintf("%s://localhost:%d", scheme, cfg.Port),
 			"db_path", cfg.DatabasePath,
+			"tls", cfg.TLSEnabled(),
 		)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if cfg.TLSEnabled() {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Server failed to start", "error", err)
 			os.Exit(1)
 		}
@@ -224,6 +263,23 @@ func startServer(cfg *config.Config, store storage.Storage, logger *logging.Logg
 	logger.Info("Server stopped successfully")
 }
 
+// generateCert writes a certificate for this machine's LAN IP, signed by
+// the local CA in dir, creating the CA on first use.
+func generateCert(dir string) error {
+	hosts := certs.DefaultHosts()
+	paths, err := certs.Generate(dir, hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("🔐 Certificate generated for %v\n", hosts)
+	fmt.Printf("   CA certificate: %s (install and trust this on devices once)\n", paths.CACert)
+	fmt.Printf("   Server certificate: %s\n", paths.ServerCert)
+	fmt.Printf("   Server key: %s\n", paths.ServerKey)
+	fmt.Printf("Start Stag with -tls to serve https://\n")
+	return nil
+}
+
 func initializeDatabase(store storage.Storage, logger *logging.Logger) error {
 	// Initialize system stats
 	stats := &storage.SystemStats{
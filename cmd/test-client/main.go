@@ -1,15 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"net/url"
-	"os"
-	"os/signal"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tabular/local-pipeline/internal/certs"
+	"github.com/tabular/local-pipeline/internal/relay"
+	"github.com/tabular/local-pipeline/internal/storage"
 )
 
 func main() {
@@ -18,9 +24,32 @@ func main() {
 		session = flag.String("session", "test-session", "Session ID")
 		device  = flag.String("device", "test-device", "Device ID")
 		count   = flag.Int("count", 10, "Number of test messages to send")
+		codec   = flag.String("compression", "zstd", "Stream compression to request (zstd, lz4, deflate, none)")
+		sdk     = flag.String("sdk-version", "test-1.0.0", "SDK version announced in the handshake")
+		fps     = flag.Int("fps", 30, "Target FPS announced in the handshake")
+		resume  = flag.String("resume-token", "", "Resume token from an earlier session")
+		apiKey  = flag.String("api-key", "", "Device API key issued by the relay")
+		caCert  = flag.String("ca-cert", "", "CA certificate to trust for wss:// (e.g. certs/ca.pem)")
+		find    = flag.Bool("discover", false, "Find the relay on the LAN via mDNS instead of using -url")
 	)
 	flag.Parse()
 
+	if *find {
+		// The mDNS client logs every malformed packet on the LAN
+		prev := log.Writer()
+		log.SetOutput(io.Discard)
+		relays, err := relay.Discover(3 * time.Second)
+		log.SetOutput(prev)
+		if err != nil {
+			log.Fatal("Discovery error:", err)
+		}
+		if len(relays) == 0 {
+			log.Fatal("❌ No relay found on the LAN (is it running without -no-mdns?)")
+		}
+		*urlFlag = relays[0].URL()
+		fmt.Printf("📡 Discovered relay %s (version %s)\n", relays[0].Instance, relays[0].Version)
+	}
+
 	u, err := url.Parse(*urlFlag)
 	if err != nil {
 		log.Fatal("Invalid URL:", err)
@@ -29,44 +58,287 @@ func main() {
 	q := u.Query()
 	q.Set("session_id", *session)
 	q.Set("device_id", *device)
+	if *resume != "" {
+		q.Set("resume_token", *resume)
+	}
 	u.RawQuery = q.Encode()
 
 	fmt.Printf("🧪 Test Client connecting to %s\n", u.String())
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	if *apiKey != "" {
+		header.Set("Authorization", "Bearer "+*apiKey)
+	}
+
+	dialer := *websocket.DefaultDialer
+	if *caCert != "" {
+		pool, err := certs.CertPool(*caCert)
+		if err != nil {
+			log.Fatal("Invalid CA certificate:", err)
+		}
+		dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	c, resp, err := dialer.Dial(u.String(), header)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			log.Fatal("❌ Relay rejected the device key (use -api-key)")
+		}
 		log.Fatal("Dial error:", err)
 	}
 	defer c.Close()
 
 	fmt.Printf("✅ Connected successfully\n")
 
+	streamCodec, firstFrame, resumed := relay.CodecNone, uint64(1), false
+	if *resume != "" {
+		_, reply, err := c.ReadMessage()
+		if err != nil {
+			log.Fatal("Read error:", err)
+		}
+		var msg relay.SessionResumed
+		if err := json.Unmarshal(reply, &msg); err == nil && msg.Type == "session_resumed" {
+			for _, stream := range msg.Streams {
+				if stream.Type == "mesh" {
+					streamCodec, _ = relay.CodecByName(stream.Compression)
+				}
+			}
+			firstFrame = msg.LastFrameNumber + 1
+			resumed = true
+			fmt.Printf("🔁 Resumed as %s at frame %d (%d pending acks)\n", msg.ClientID, firstFrame, msg.PendingAcks)
+		} else {
+			fmt.Printf("⚠️  Resume failed, starting a new session: %s\n", reply)
+		}
+	}
+	if !resumed {
+		streamCodec = handshake(c, *session, *codec, *sdk, *fps)
+	}
+
+	// Read acks and other server messages in the background
+	acked := make(chan uint64, *count)
+	go readServerMessages(c, acked)
+
+	// Send test packets
+	for i := 0; i < *count; i++ {
+		packet, err := buildTestPacket(firstFrame+uint64(i), *device, streamCodec)
+		if err != nil {
+			log.Fatal("Packet error:", err)
+		}
+
+		if err := c.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+			log.Fatal("Write error:", err)
+		}
+
+		fmt.Printf("📦 Sent test packet %d/%d (%d bytes)\n", i+1, *count, len(packet))
+		time.Sleep(1 * time.Second)
+	}
+
+	// Wait for outstanding acks
+	timeout := time.After(5 * time.Second)
+	for received := 0; received < *count; {
+		select {
+		case <-acked:
+			received++
+		case <-timeout:
+			log.Fatalf("❌ Timed out waiting for acks (%d/%d received)", received, *count)
+		}
+	}
+
+	fmt.Printf("✅ Test completed successfully\n")
+}
+
+// handshake sends session_info and returns the codec the relay accepted.
+func handshake(c *websocket.Conn, session, codec, sdk string, fps int) uint8 {
 	// Send session info
+	streams := []map[string]interface{}{}
+	for _, streamType := range []string{"mesh", "pose", "camera", "depth", "pointCloud", "lighting"} {
+		streams = append(streams, map[string]interface{}{"type": streamType, "compression": codec})
+	}
 	sessionInfo := map[string]interface{}{
 		"type":       "session_info",
-		"sessionID":  *session,
-		"streams":    []map[string]interface{}{{"type": "mesh", "compression": "none"}},
-		"targetFPS":  30,
-		"sdkVersion": "test-1.0.0",
+		"sessionID":  session,
+		"streams":    streams,
+		"targetFPS":  fps,
+		"sdkVersion": sdk,
 	}
 
 	if err := c.WriteJSON(sessionInfo); err != nil {
 		log.Fatal("Write error:", err)
 	}
 
-	// Send test packets
-	for i := 0; i < *count; i++ {
-		// Create a mock binary packet
-		testData := make([]byte, 100)
-		copy(testData[:4], []byte("TEST"))
-		
-		if err := c.WriteMessage(websocket.BinaryMessage, testData); err != nil {
-			log.Fatal("Write error:", err)
+	_, reply, err := c.ReadMessage()
+	if err != nil {
+		log.Fatal("Read error:", err)
+	}
+
+	var rejected relay.SessionRejected
+	if err := json.Unmarshal(reply, &rejected); err == nil && rejected.Type == "session_rejected" {
+		log.Fatalf("❌ Session rejected: %s (%s)", rejected.Error.Message, rejected.Error.Code)
+	}
+
+	var accepted relay.SessionAccepted
+	if err := json.Unmarshal(reply, &accepted); err != nil {
+		log.Fatal("Invalid handshake reply:", err)
+	}
+
+	// All streams share one codec in the test client; use what the relay accepted for mesh
+	streamCodec := relay.CodecNone
+	for _, stream := range accepted.Streams {
+		if stream.Type == "mesh" {
+			streamCodec, _ = relay.CodecByName(stream.Compression)
 		}
-		
-		fmt.Printf("📦 Sent test packet %d/%d\n", i+1, *count)
-		time.Sleep(1 * time.Second)
 	}
+	fmt.Printf("🤝 Session accepted as %s (compression: %s, max message: %d bytes, resume token: %s)\n",
+		accepted.ClientID, relay.CodecName(streamCodec), accepted.MaxMessageSize, accepted.ResumeToken)
 
-	fmt.Printf("✅ Test completed successfully\n")
-}
\ No newline at end of file
+	return streamCodec
+}
+
+// readServerMessages prints acks, nacks and other messages from the relay and
+// reports every acknowledged or rejected frame on done.
+func readServerMessages(c *websocket.Conn, done chan<- uint64) {
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case "frame_ack":
+			var ack relay.FrameAck
+			json.Unmarshal(data, &ack)
+			if ack.Status == relay.AckStatusQueued {
+				fmt.Printf("📦 Frame %d queued by relay (batch %s, %d events)\n", ack.FrameNumber, ack.BatchID, ack.Events)
+			} else {
+				fmt.Printf("✅ Frame %d synced (batch %s, trace %s, %d events)\n", ack.FrameNumber, ack.BatchID, ack.TraceID, ack.Events)
+			}
+			done <- ack.FrameNumber
+		case "frame_nack":
+			var nack relay.FrameNack
+			json.Unmarshal(data, &nack)
+			fmt.Printf("⚠️  Frame %d not delivered: %s (retryable: %v)\n", nack.FrameNumber, nack.Error.Message, nack.Retryable)
+			done <- nack.FrameNumber
+		case "flow_control":
+			var fc relay.FlowControl
+			json.Unmarshal(data, &fc)
+			fmt.Printf("🚦 Relay asked to %s (queue %d/%d)\n", fc.Action, fc.QueueDepth, fc.QueueCapacity)
+		case "anchor_update":
+			var update relay.AnchorUpdate
+			json.Unmarshal(data, &update)
+			fmt.Printf("🔄 Anchor %s %s by %s (seq %d)\n", update.AnchorID, update.Change, update.SourceDeviceID, update.Seq)
+		case "sync_reset":
+			fmt.Println("🔄 Relay missed anchor updates, refetch the session from Stag")
+		default:
+			fmt.Printf("📨 %s\n", data)
+		}
+	}
+}
+
+// buildTestPacket creates a frame carrying every stream type: a slowly growing
+// mesh, a moving pose, a small fake camera image, a depth map, a point cloud
+// and a lighting estimate.
+func buildTestPacket(frame uint64, device string, codec uint8) ([]byte, error) {
+	now := time.Now()
+	w := relay.NewPacketWriter(frame, now)
+	w.SetCompression(codec)
+	identity := &storage.Transform{Rotation: [4]float64{0, 0, 0, 1}, Scale: [3]float64{1, 1, 1}}
+
+	// Grid mesh that gains a row every frame so Stag records a new version
+	rows, cols := int(frame)+1, 4
+	vertices := make([]float64, 0, rows*cols*3)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			vertices = append(vertices, float64(c)*0.1, 0, float64(r)*0.1)
+		}
+	}
+	faces := make([]uint32, 0, (rows-1)*(cols-1)*6)
+	for r := 0; r < rows-1; r++ {
+		for c := 0; c < cols-1; c++ {
+			i := uint32(r*cols + c)
+			faces = append(faces, i, i+1, i+uint32(cols), i+1, i+uint32(cols)+1, i+uint32(cols))
+		}
+	}
+	w.AddMesh(&storage.MeshData{
+		AnchorID:       fmt.Sprintf("test_floor_%s", device),
+		Vertices:       vertices,
+		Faces:          faces,
+		Classification: "floor",
+		Confidence:     0.9,
+		Transform:      identity,
+	})
+
+	angle := float64(frame) * 0.1
+	cameraPose := &storage.Transform{
+		Translation: [3]float64{math.Cos(angle), 1.5, math.Sin(angle)},
+		Rotation:    [4]float64{0, math.Sin(angle / 2), 0, math.Cos(angle / 2)},
+		Scale:       [3]float64{1, 1, 1},
+	}
+	w.AddPose(&storage.PoseData{
+		Transform:  cameraPose,
+		Velocity:   [3]float64{-math.Sin(angle), 0, math.Cos(angle)},
+		Confidence: 1,
+	})
+
+	image := make([]byte, 64*48)
+	for i := range image {
+		image[i] = byte(int(frame) + i)
+	}
+	w.AddCamera(&storage.CameraData{
+		ImageData:   image,
+		Width:       64,
+		Height:      48,
+		Format:      "gray8",
+		Intrinsics:  [9]float64{50, 0, 32, 0, 50, 24, 0, 0, 1},
+		Exposure:    0.01,
+		ISO:         100,
+		FocalLength: 4.2,
+		Transform:   cameraPose,
+		Timestamp:   now.Add(-5 * time.Millisecond),
+	})
+
+	depthW, depthH := 16, 12
+	depth := make([]float64, depthW*depthH)
+	confidence := make([]float64, depthW*depthH)
+	for i := range depth {
+		depth[i] = 1 + float64(i%depthW)*0.05 + float64(frame)*0.01
+		confidence[i] = 2
+	}
+	w.AddDepth(&storage.DepthData{
+		Data:       depth,
+		Width:      depthW,
+		Height:     depthH,
+		Confidence: confidence,
+		MinRange:   0.1,
+		MaxRange:   5,
+		Transform:  cameraPose,
+		Timestamp:  now.Add(-5 * time.Millisecond),
+	})
+
+	points := make([]float64, 0, 32*3)
+	colors := make([]float64, 0, 32*3)
+	for i := 0; i < 32; i++ {
+		t := float64(i) / 32 * 2 * math.Pi
+		points = append(points, math.Cos(t), float64(frame)*0.01, math.Sin(t))
+		colors = append(colors, 0.5, 0.5, float64(i)/32)
+	}
+	w.AddPointCloud(&storage.PointCloudData{
+		Points:    points,
+		Colors:    colors,
+		Transform: identity,
+	})
+
+	w.AddLighting(&storage.LightingData{
+		AmbientIntensity: 1000,
+		DirectionalLight: [3]float64{0, -1, 0},
+		ColorTemperature: 6500 - float64(frame),
+	})
+
+	return w.Bytes()
+}
@@ -0,0 +1,265 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names written by Generate inside the certificate directory.
+const (
+	CACertFile     = "ca.pem"
+	CAKeyFile      = "ca-key.pem"
+	ServerCertFile = "server.pem"
+	ServerKeyFile  = "server-key.pem"
+)
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// iOS rejects server certificates valid for more than 825 days
+	serverValidity = 825 * 24 * time.Hour
+)
+
+// Paths locates the files of a generated certificate set.
+type Paths struct {
+	CACert     string
+	CAKey      string
+	ServerCert string
+	ServerKey  string
+}
+
+// PathsIn returns where Generate puts its files in dir.
+func PathsIn(dir string) Paths {
+	return Paths{
+		CACert:     filepath.Join(dir, CACertFile),
+		CAKey:      filepath.Join(dir, CAKeyFile),
+		ServerCert: filepath.Join(dir, ServerCertFile),
+		ServerKey:  filepath.Join(dir, ServerKeyFile),
+	}
+}
+
+// Generate writes a server certificate for hosts (IP addresses or DNS
+// names) into dir, signed by a local CA. The CA is created on first use and
+// reused afterwards, so devices only have to trust ca.pem once even when
+// the LAN IP changes and the server certificate is regenerated.
+func Generate(dir string, hosts []string) (Paths, error) {
+	paths := PathsIn(dir)
+	if len(hosts) == 0 {
+		return paths, fmt.Errorf("at least one host is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return paths, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+
+	caCert, caKey, err := loadCA(paths)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(paths)
+	}
+	if err != nil {
+		return paths, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return paths, fmt.Errorf("failed to generate server key: %w", err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return paths, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Tabular Local Pipeline"},
+			CommonName:   hosts[0],
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(serverValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return paths, fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	if err := writeCertAndKey(paths.ServerCert, paths.ServerKey, der, key); err != nil {
+		return paths, err
+	}
+
+	return paths, nil
+}
+
+// DefaultHosts returns the hosts a certificate for this machine should
+// cover: its LAN IP when it has one, loopback, and its hostname with and
+// without .local for mDNS.
+func DefaultHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if ip, err := LANIP(); err == nil {
+		hosts = append([]string{ip}, hosts...)
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname, hostname+".local")
+	}
+	return hosts
+}
+
+// LANIP returns the address this machine uses to reach the network. The UDP
+// dial only picks a route, no packets are sent.
+func LANIP() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	return localAddr.IP.String(), nil
+}
+
+// ServerConfig loads a certificate and key for serving HTTPS and WSS.
+func ServerConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// CertPool returns the system roots plus the CA in caFile, for clients
+// talking to a service that uses a generated certificate.
+func CertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func createCA(paths Paths) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Tabular Local Pipeline"},
+			CommonName:   "Tabular Local CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	if err := writeCertAndKey(paths.CACert, paths.CAKey, der, key); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	return cert, key, nil
+}
+
+func loadCA(paths Paths) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(paths.CACert)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(paths.CAKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("invalid CA certificate in %s", paths.CACert)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("invalid CA key in %s", paths.CAKey)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+func writeCertAndKey(certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", certFile, err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", keyFile, err)
+	}
+	return nil
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
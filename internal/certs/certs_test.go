@@ -0,0 +1,135 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"testing"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("no certificate in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	return cert
+}
+
+func TestGenerateServerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"192.168.1.50", "localhost", "::1", "relay.local"}
+
+	paths, err := Generate(dir, hosts)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if paths != PathsIn(dir) {
+		t.Fatalf("Generate wrote %+v, want %+v", paths, PathsIn(dir))
+	}
+
+	ca := readCert(t, paths.CACert)
+	server := readCert(t, paths.ServerCert)
+	if !ca.IsCA || server.IsCA {
+		t.Fatalf("CA IsCA=%v, server IsCA=%v", ca.IsCA, server.IsCA)
+	}
+
+	if server.Subject.CommonName != "192.168.1.50" {
+		t.Errorf("common name = %q, want the first host", server.Subject.CommonName)
+	}
+	wantIPs := []net.IP{net.ParseIP("192.168.1.50"), net.ParseIP("::1")}
+	if len(server.IPAddresses) != len(wantIPs) {
+		t.Fatalf("IP SANs = %v, want %v", server.IPAddresses, wantIPs)
+	}
+	for i, ip := range wantIPs {
+		if !server.IPAddresses[i].Equal(ip) {
+			t.Fatalf("IP SANs = %v, want %v", server.IPAddresses, wantIPs)
+		}
+	}
+	if len(server.DNSNames) != 2 || server.DNSNames[0] != "localhost" || server.DNSNames[1] != "relay.local" {
+		t.Fatalf("DNS SANs = %v, want [localhost relay.local]", server.DNSNames)
+	}
+
+	// The server certificate chains to the CA for every host
+	pool, err := CertPool(paths.CACert)
+	if err != nil {
+		t.Fatalf("CertPool: %v", err)
+	}
+	for _, host := range hosts {
+		_, err := server.Verify(x509.VerifyOptions{
+			DNSName:   host,
+			Roots:     pool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			t.Errorf("verify for %s: %v", host, err)
+		}
+	}
+	if _, err := server.Verify(x509.VerifyOptions{DNSName: "other.local", Roots: pool}); err == nil {
+		t.Errorf("certificate verified for a host it was not issued for")
+	}
+
+	if _, err := ServerConfig(paths.ServerCert, paths.ServerKey); err != nil {
+		t.Fatalf("ServerConfig: %v", err)
+	}
+}
+
+func TestGenerateReusesCA(t *testing.T) {
+	dir := t.TempDir()
+	paths, err := Generate(dir, []string{"192.168.1.50"})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	caBefore, err := os.ReadFile(paths.CACert)
+	if err != nil {
+		t.Fatalf("failed to read CA: %v", err)
+	}
+
+	// A new LAN IP only needs a new server certificate
+	if _, err := Generate(dir, []string{"192.168.1.60"}); err != nil {
+		t.Fatalf("Generate again: %v", err)
+	}
+	caAfter, err := os.ReadFile(paths.CACert)
+	if err != nil {
+		t.Fatalf("failed to read CA: %v", err)
+	}
+	if !bytes.Equal(caBefore, caAfter) {
+		t.Fatalf("regenerating the server certificate replaced the CA")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(readCert(t, paths.CACert))
+	if _, err := readCert(t, paths.ServerCert).Verify(x509.VerifyOptions{DNSName: "192.168.1.60", Roots: roots}); err != nil {
+		t.Fatalf("new server certificate does not chain to the existing CA: %v", err)
+	}
+}
+
+func TestGenerateRequiresHost(t *testing.T) {
+	if _, err := Generate(t.TempDir(), nil); err == nil {
+		t.Fatalf("generated a certificate without hosts")
+	}
+}
+
+func TestDefaultHostsIncludeLoopback(t *testing.T) {
+	hosts := DefaultHosts()
+	for _, want := range []string{"localhost", "127.0.0.1", "::1"} {
+		found := false
+		for _, host := range hosts {
+			found = found || host == want
+		}
+		if !found {
+			t.Errorf("default hosts %v do not include %s", hosts, want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -18,6 +19,31 @@ type Config struct {
 	BatchSize    int    `mapstructure:"batch_size"`
 	SnapshotThreshold float64 `mapstructure:"snapshot_threshold"`
 	RelayEndpoint string `mapstructure:"relay_endpoint"`
+	MaxMessageSize int  `mapstructure:"max_message_size"`
+	OutboxPath   string `mapstructure:"outbox_path"`
+	RelayBatchMaxFrames int           `mapstructure:"relay_batch_max_frames"`
+	RelayBatchMaxBytes  int           `mapstructure:"relay_batch_max_bytes"`
+	RelayBatchInterval  time.Duration `mapstructure:"relay_batch_interval"`
+	RelayClientQueueSize  int               `mapstructure:"relay_client_queue_size"`
+	RelayDropPolicy       string            `mapstructure:"relay_drop_policy"`
+	RelayStreamPriorities map[string]string `mapstructure:"relay_stream_priorities"`
+	RelayPingInterval     time.Duration     `mapstructure:"relay_ping_interval"`
+	RelayPongWait         time.Duration     `mapstructure:"relay_pong_wait"`
+	RelayWriteWait        time.Duration     `mapstructure:"relay_write_wait"`
+	RelayIdleTimeout      time.Duration     `mapstructure:"relay_idle_timeout"`
+	RelayResumeGrace      time.Duration     `mapstructure:"relay_resume_grace"`
+	RelayDevicesPath      string            `mapstructure:"relay_devices_path"`
+	RelayAuthRequired     bool              `mapstructure:"relay_auth_required"`
+	RelayAdminToken       string            `mapstructure:"relay_admin_token"`
+	RelayMDNS             bool              `mapstructure:"relay_mdns"`
+	RelaySync             bool              `mapstructure:"relay_sync"`
+	RelaySyncTypes        []string          `mapstructure:"relay_sync_types"`
+	BatchRetention        time.Duration     `mapstructure:"batch_retention"`
+	BatchRetentionMax     int               `mapstructure:"batch_retention_max"`
+	DedupeTTL             time.Duration     `mapstructure:"dedupe_ttl"`
+	TLSCertFile           string            `mapstructure:"tls_cert_file"`
+	TLSKeyFile            string            `mapstructure:"tls_key_file"`
+	TLSCAFile             string            `mapstructure:"tls_ca_file"`
 }
 
 func Load(configPath string) (*Config, error) {
@@ -29,6 +55,38 @@ func Load(configPath string) (*Config, error) {
 	viper.SetDefault("batch_size", 50)
 	viper.SetDefault("snapshot_threshold", 0.1)
 	viper.SetDefault("relay_endpoint", "http://localhost:9000/api/v1/ingest")
+	viper.SetDefault("max_message_size", 16<<20)
+	viper.SetDefault("outbox_path", "./relay-data/outbox.db")
+	viper.SetDefault("relay_batch_max_frames", 16)
+	viper.SetDefault("relay_batch_max_bytes", 4<<20)
+	viper.SetDefault("relay_batch_interval", 50*time.Millisecond)
+	viper.SetDefault("relay_client_queue_size", 64)
+	viper.SetDefault("relay_drop_policy", "drop_oldest")
+	viper.SetDefault("relay_stream_priorities", map[string]string{
+		"mesh":       "critical",
+		"pose":       "critical",
+		"lighting":   "high",
+		"pointcloud": "normal",
+		"camera":     "low",
+		"depth":      "low",
+	})
+	viper.SetDefault("relay_ping_interval", 15*time.Second)
+	viper.SetDefault("relay_pong_wait", 45*time.Second)
+	viper.SetDefault("relay_write_wait", 10*time.Second)
+	viper.SetDefault("relay_idle_timeout", 5*time.Minute)
+	viper.SetDefault("relay_resume_grace", 2*time.Minute)
+	viper.SetDefault("relay_devices_path", "./relay-data/devices.db")
+	viper.SetDefault("relay_auth_required", false)
+	viper.SetDefault("relay_admin_token", "")
+	viper.SetDefault("relay_mdns", true)
+	viper.SetDefault("relay_sync", true)
+	viper.SetDefault("relay_sync_types", []string{"mesh", "pose", "lighting"})
+	viper.SetDefault("batch_retention", 24*time.Hour)
+	viper.SetDefault("batch_retention_max", 10000)
+	viper.SetDefault("dedupe_ttl", time.Hour)
+	viper.SetDefault("tls_cert_file", "")
+	viper.SetDefault("tls_key_file", "")
+	viper.SetDefault("tls_ca_file", "")
 
 	// Environment variables
 	viper.SetEnvPrefix("STAG")
@@ -92,6 +150,152 @@ func Load(configPath string) (*Config, error) {
 		viper.Set("relay_endpoint", endpoint)
 	}
 
+	if maxSize := os.Getenv("STAG_MAX_MESSAGE_SIZE"); maxSize != "" {
+		if m, err := strconv.Atoi(maxSize); err == nil {
+			viper.Set("max_message_size", m)
+		}
+	}
+
+	if outboxPath := os.Getenv("STAG_OUTBOX_PATH"); outboxPath != "" {
+		viper.Set("outbox_path", outboxPath)
+	}
+
+	if maxFrames := os.Getenv("STAG_RELAY_BATCH_MAX_FRAMES"); maxFrames != "" {
+		if m, err := strconv.Atoi(maxFrames); err == nil {
+			viper.Set("relay_batch_max_frames", m)
+		}
+	}
+
+	if maxBytes := os.Getenv("STAG_RELAY_BATCH_MAX_BYTES"); maxBytes != "" {
+		if m, err := strconv.Atoi(maxBytes); err == nil {
+			viper.Set("relay_batch_max_bytes", m)
+		}
+	}
+
+	if interval := os.Getenv("STAG_RELAY_BATCH_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			viper.Set("relay_batch_interval", d)
+		}
+	}
+
+	if queueSize := os.Getenv("STAG_RELAY_CLIENT_QUEUE_SIZE"); queueSize != "" {
+		if q, err := strconv.Atoi(queueSize); err == nil {
+			viper.Set("relay_client_queue_size", q)
+		}
+	}
+
+	if policy := os.Getenv("STAG_RELAY_DROP_POLICY"); policy != "" {
+		viper.Set("relay_drop_policy", policy)
+	}
+
+	// Format: camera=low,depth=low,pose=critical
+	if priorities := os.Getenv("STAG_RELAY_STREAM_PRIORITIES"); priorities != "" {
+		classes := make(map[string]string)
+		for _, pair := range strings.Split(priorities, ",") {
+			if stream, class, ok := strings.Cut(pair, "="); ok {
+				classes[strings.ToLower(strings.TrimSpace(stream))] = strings.TrimSpace(class)
+			}
+		}
+		viper.Set("relay_stream_priorities", classes)
+	}
+
+	if interval := os.Getenv("STAG_RELAY_PING_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			viper.Set("relay_ping_interval", d)
+		}
+	}
+
+	if wait := os.Getenv("STAG_RELAY_PONG_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil {
+			viper.Set("relay_pong_wait", d)
+		}
+	}
+
+	if wait := os.Getenv("STAG_RELAY_WRITE_WAIT"); wait != "" {
+		if d, err := time.ParseDuration(wait); err == nil {
+			viper.Set("relay_write_wait", d)
+		}
+	}
+
+	if timeout := os.Getenv("STAG_RELAY_IDLE_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			viper.Set("relay_idle_timeout", d)
+		}
+	}
+
+	if grace := os.Getenv("STAG_RELAY_RESUME_GRACE"); grace != "" {
+		if d, err := time.ParseDuration(grace); err == nil {
+			viper.Set("relay_resume_grace", d)
+		}
+	}
+
+	if devicesPath := os.Getenv("STAG_RELAY_DEVICES_PATH"); devicesPath != "" {
+		viper.Set("relay_devices_path", devicesPath)
+	}
+
+	if authRequired := os.Getenv("STAG_RELAY_AUTH_REQUIRED"); authRequired != "" {
+		if b, err := strconv.ParseBool(authRequired); err == nil {
+			viper.Set("relay_auth_required", b)
+		}
+	}
+
+	if adminToken := os.Getenv("STAG_RELAY_ADMIN_TOKEN"); adminToken != "" {
+		viper.Set("relay_admin_token", adminToken)
+	}
+
+	if mdns := os.Getenv("STAG_RELAY_MDNS"); mdns != "" {
+		if b, err := strconv.ParseBool(mdns); err == nil {
+			viper.Set("relay_mdns", b)
+		}
+	}
+
+	if sync := os.Getenv("STAG_RELAY_SYNC"); sync != "" {
+		if b, err := strconv.ParseBool(sync); err == nil {
+			viper.Set("relay_sync", b)
+		}
+	}
+
+	// Format: mesh,pose,lighting
+	if syncTypes := os.Getenv("STAG_RELAY_SYNC_TYPES"); syncTypes != "" {
+		types := make([]string, 0)
+		for _, streamType := range strings.Split(syncTypes, ",") {
+			if streamType = strings.TrimSpace(streamType); streamType != "" {
+				types = append(types, streamType)
+			}
+		}
+		viper.Set("relay_sync_types", types)
+	}
+
+	if retention := os.Getenv("STAG_BATCH_RETENTION"); retention != "" {
+		if d, err := time.ParseDuration(retention); err == nil {
+			viper.Set("batch_retention", d)
+		}
+	}
+
+	if retentionMax := os.Getenv("STAG_BATCH_RETENTION_MAX"); retentionMax != "" {
+		if m, err := strconv.Atoi(retentionMax); err == nil {
+			viper.Set("batch_retention_max", m)
+		}
+	}
+
+	if ttl := os.Getenv("STAG_DEDUPE_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil {
+			viper.Set("dedupe_ttl", d)
+		}
+	}
+
+	if certFile := os.Getenv("STAG_TLS_CERT_FILE"); certFile != "" {
+		viper.Set("tls_cert_file", certFile)
+	}
+
+	if keyFile := os.Getenv("STAG_TLS_KEY_FILE"); keyFile != "" {
+		viper.Set("tls_key_file", keyFile)
+	}
+
+	if caFile := os.Getenv("STAG_TLS_CA_FILE"); caFile != "" {
+		viper.Set("tls_ca_file", caFile)
+	}
+
 	// Unmarshal configuration
 	var cfg Config
 	if err := viper.Unmarshal(&cfg); err != nil {
@@ -144,10 +348,108 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("snapshot_threshold must be between 0 and 1, got %f", c.SnapshotThreshold)
 	}
 
+	if c.MaxMessageSize < 1024 {
+		return fmt.Errorf("max_message_size must be at least 1024 bytes, got %d", c.MaxMessageSize)
+	}
+
+	if c.OutboxPath == "" {
+		return fmt.Errorf("outbox_path cannot be empty")
+	}
+
+	if c.RelayBatchMaxFrames < 1 || c.RelayBatchMaxFrames > 1000 {
+		return fmt.Errorf("relay_batch_max_frames must be between 1 and 1000, got %d", c.RelayBatchMaxFrames)
+	}
+
+	if c.RelayBatchMaxBytes < 1024 {
+		return fmt.Errorf("relay_batch_max_bytes must be at least 1024 bytes, got %d", c.RelayBatchMaxBytes)
+	}
+
+	if c.RelayBatchInterval < time.Millisecond || c.RelayBatchInterval > 10*time.Second {
+		return fmt.Errorf("relay_batch_interval must be between 1ms and 10s, got %s", c.RelayBatchInterval)
+	}
+
+	if c.RelayClientQueueSize < 1 || c.RelayClientQueueSize > 10000 {
+		return fmt.Errorf("relay_client_queue_size must be between 1 and 10000, got %d", c.RelayClientQueueSize)
+	}
+
+	validDropPolicies := []string{"drop_oldest", "drop_newest", "block"}
+	validDropPolicy := false
+	for _, policy := range validDropPolicies {
+		if c.RelayDropPolicy == policy {
+			validDropPolicy = true
+			break
+		}
+	}
+	if !validDropPolicy {
+		return fmt.Errorf("relay_drop_policy must be one of %v, got %s", validDropPolicies, c.RelayDropPolicy)
+	}
+
+	validPriorities := []string{"low", "normal", "high", "critical"}
+	for stream, class := range c.RelayStreamPriorities {
+		validPriority := false
+		for _, priority := range validPriorities {
+			if class == priority {
+				validPriority = true
+				break
+			}
+		}
+		if !validPriority {
+			return fmt.Errorf("relay_stream_priorities.%s must be one of %v, got %s", stream, validPriorities, class)
+		}
+	}
+	if class, ok := c.RelayStreamPriorities["mesh"]; ok && class != "critical" {
+		return fmt.Errorf("relay_stream_priorities.mesh must be critical, got %s", class)
+	}
+
+	if c.RelayPingInterval < time.Second {
+		return fmt.Errorf("relay_ping_interval must be at least 1s, got %s", c.RelayPingInterval)
+	}
+
+	if c.RelayPongWait <= c.RelayPingInterval {
+		return fmt.Errorf("relay_pong_wait must be longer than relay_ping_interval (%s), got %s", c.RelayPingInterval, c.RelayPongWait)
+	}
+
+	if c.RelayWriteWait < time.Second {
+		return fmt.Errorf("relay_write_wait must be at least 1s, got %s", c.RelayWriteWait)
+	}
+
+	if c.RelayIdleTimeout < c.RelayPongWait {
+		return fmt.Errorf("relay_idle_timeout must be at least relay_pong_wait (%s), got %s", c.RelayPongWait, c.RelayIdleTimeout)
+	}
+
+	if c.RelayResumeGrace < 0 || c.RelayResumeGrace > time.Hour {
+		return fmt.Errorf("relay_resume_grace must be between 0 and 1h, got %s", c.RelayResumeGrace)
+	}
+
+	if c.RelayDevicesPath == "" {
+		return fmt.Errorf("relay_devices_path cannot be empty")
+	}
+
+	if c.BatchRetention < time.Minute {
+		return fmt.Errorf("batch_retention must be at least 1m, got %s", c.BatchRetention)
+	}
+
+	if c.BatchRetentionMax < 1 {
+		return fmt.Errorf("batch_retention_max must be at least 1, got %d", c.BatchRetentionMax)
+	}
+
+	if c.DedupeTTL < time.Minute {
+		return fmt.Errorf("dedupe_ttl must be at least 1m, got %s", c.DedupeTTL)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+
 	return nil
 }
 
+// TLSEnabled reports whether the service should serve HTTPS and WSS.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
 func (c *Config) String() string {
-	return fmt.Sprintf("Config{Port: %d, DatabasePath: %s, LogLevel: %s, WorkerThreads: %d, BatchSize: %d, SnapshotThreshold: %.2f, RelayEndpoint: %s}",
-		c.Port, c.DatabasePath, c.LogLevel, c.WorkerThreads, c.BatchSize, c.SnapshotThreshold, c.RelayEndpoint)
+	return fmt.Sprintf("Config{Port: %d, DatabasePath: %s, LogLevel: %s, WorkerThreads: %d, BatchSize: %d, SnapshotThreshold: %.2f, RelayEndpoint: %s, MaxMessageSize: %d, OutboxPath: %s, RelayBatchMaxFrames: %d, RelayBatchMaxBytes: %d, RelayBatchInterval: %s, RelayClientQueueSize: %d, RelayDropPolicy: %s, RelayStreamPriorities: %v, RelayPingInterval: %s, RelayPongWait: %s, RelayWriteWait: %s, RelayIdleTimeout: %s, RelayResumeGrace: %s, RelayDevicesPath: %s, RelayAuthRequired: %t, RelayMDNS: %t, RelaySync: %t, RelaySyncTypes: %v, BatchRetention: %s, BatchRetentionMax: %d, DedupeTTL: %s, TLSCertFile: %s, TLSKeyFile: %s, TLSCAFile: %s}",
+		c.Port, c.DatabasePath, c.LogLevel, c.WorkerThreads, c.BatchSize, c.SnapshotThreshold, c.RelayEndpoint, c.MaxMessageSize, c.OutboxPath, c.RelayBatchMaxFrames, c.RelayBatchMaxBytes, c.RelayBatchInterval, c.RelayClientQueueSize, c.RelayDropPolicy, c.RelayStreamPriorities, c.RelayPingInterval, c.RelayPongWait, c.RelayWriteWait, c.RelayIdleTimeout, c.RelayResumeGrace, c.RelayDevicesPath, c.RelayAuthRequired, c.RelayMDNS, c.RelaySync, c.RelaySyncTypes, c.BatchRetention, c.BatchRetentionMax, c.DedupeTTL, c.TLSCertFile, c.TLSKeyFile, c.TLSCAFile)
 }
\ No newline at end of file
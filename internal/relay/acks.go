@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Frame nack error codes
+const (
+	ErrCodeInvalidPacket   = "invalid_packet"
+	ErrCodeCodecMismatch   = "codec_mismatch"
+	ErrCodeStagUnavailable = "stag_unavailable"
+	ErrCodeStagRejected    = "stag_rejected"
+)
+
+// Frame ack statuses. Queued frames are held in the relay's outbox and
+// delivered once Stag is reachable again.
+const (
+	AckStatusDelivered = "delivered"
+	AckStatusQueued    = "queued"
+)
+
+// FrameAck tells the client a frame was delivered to Stag, or durably
+// queued for delivery.
+type FrameAck struct {
+	Type        string    `json:"type"`
+	FrameNumber uint64    `json:"frame_number"`
+	Status      string    `json:"status"`
+	BatchID     string    `json:"batch_id"`
+	TraceID     string    `json:"trace_id,omitempty"`
+	Events      int       `json:"events"`
+	Dropped     int       `json:"dropped,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// FrameNack tells the client a frame was not delivered. Retryable nacks
+// can be resent as-is; non-retryable ones will fail again.
+type FrameNack struct {
+	Type        string        `json:"type"`
+	FrameNumber uint64        `json:"frame_number"`
+	BatchID     string        `json:"batch_id,omitempty"`
+	Retryable   bool          `json:"retryable"`
+	Error       ProtocolError `json:"error"`
+	Timestamp   time.Time     `json:"timestamp"`
+}
+
+func (s *Service) sendFrameAck(client *Client, frameNumber uint64, batchID, status, traceID string, events, dropped int) {
+	ack := FrameAck{
+		Type:        "frame_ack",
+		FrameNumber: frameNumber,
+		Status:      status,
+		BatchID:     batchID,
+		TraceID:     traceID,
+		Events:      events,
+		Dropped:     dropped,
+		Timestamp:   time.Now(),
+	}
+	if err := s.sendFrameResult(client, ack); err != nil {
+		s.logger.Warn("Failed to send frame ack", "client_id", client.ID, "frame_number", frameNumber, "error", err)
+	}
+}
+
+func (s *Service) sendFrameNack(client *Client, frameNumber uint64, batchID, code string, cause error, retryable bool) {
+	nack := FrameNack{
+		Type:        "frame_nack",
+		FrameNumber: frameNumber,
+		BatchID:     batchID,
+		Retryable:   retryable,
+		Error: ProtocolError{
+			Code:    code,
+			Message: cause.Error(),
+		},
+		Timestamp: time.Now(),
+	}
+	if err := s.sendFrameResult(client, nack); err != nil {
+		s.logger.Warn("Failed to send frame nack", "client_id", client.ID, "frame_number", frameNumber, "error", err)
+	}
+}
+
+// sendFrameResult sends an ack or nack to whichever connection currently
+// holds the client's identity, holding it if the client is away but may
+// still resume.
+func (s *Service) sendFrameResult(client *Client, v interface{}) error {
+	r := client.resume.Load()
+	if r == nil {
+		return client.SendJSON(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return r.send(data)
+}
+
+// peekFrameNumber reads the frame number from a packet header that failed
+// to decode, so the nack can still reference it. Returns 0 if unavailable.
+func peekFrameNumber(data []byte) uint64 {
+	if len(data) < 16 || string(data[:4]) != PacketMagic {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(data[8:16])
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// DisconnectRevoked is recorded when a device is disconnected because its
+// key was revoked.
+const DisconnectRevoked = "key_revoked"
+
+// deviceKeyFromRequest returns the API key a device presented, from an
+// "Authorization: Bearer" header or, for WebSocket clients that cannot set
+// headers, the api_key query parameter.
+func deviceKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authenticateDevice resolves the device behind a request. It returns nil
+// without an error when no key was presented.
+func (s *Service) authenticateDevice(r *http.Request) (*Device, error) {
+	key := deviceKeyFromRequest(r)
+	if key == "" {
+		return nil, nil
+	}
+	return s.devices.Authenticate(key)
+}
+
+// requireAdmin guards the admin API. With an admin token configured the
+// request must present it; otherwise only loopback requests are allowed.
+func (s *Service) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := s.config.RelayAdminToken; token != "" {
+			presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				http.Error(w, "Admin token required", http.StatusUnauthorized)
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "Admin API is only available from localhost", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redactDevice returns a copy of device without its key hash, for admin
+// responses.
+func redactDevice(device *Device) *Device {
+	redacted := *device
+	redacted.KeyHash = ""
+	return &redacted
+}
+
+func (s *Service) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.devices.List()
+	if err != nil {
+		s.logger.Error("Failed to list devices", "error", err)
+		http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+		return
+	}
+	for i, device := range devices {
+		devices[i] = redactDevice(device)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"devices": devices,
+		"count":   len(devices),
+	})
+}
+
+// handleIssueDeviceKey registers a device, or rotates its key. The key is
+// only ever returned here.
+func (s *Service) handleIssueDeviceKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Name     string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DeviceID == "" {
+		http.Error(w, "Request body must include device_id", http.StatusBadRequest)
+		return
+	}
+
+	key, device, err := s.devices.Issue(req.DeviceID, req.Name)
+	if err != nil {
+		s.logger.Error("Failed to issue device key", "device_id", req.DeviceID, "error", err)
+		http.Error(w, "Failed to issue device key", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("🔑 Issued device key", "device_id", device.DeviceID, "key_hint", device.KeyHint)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device":  redactDevice(device),
+		"api_key": key,
+	})
+}
+
+// handleRevokeDevice revokes a device's key and disconnects it.
+func (s *Service) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+
+	if err := s.devices.Revoke(deviceID); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		s.logger.Error("Failed to revoke device", "device_id", deviceID, "error", err)
+		http.Error(w, "Failed to revoke device", http.StatusInternalServerError)
+		return
+	}
+
+	s.clientsMux.RLock()
+	connected := make([]*Client, 0)
+	for _, client := range s.clients {
+		if client.Authenticated && client.DeviceID == deviceID {
+			connected = append(connected, client)
+		}
+	}
+	s.clientsMux.RUnlock()
+
+	for _, client := range connected {
+		client.SetCloseReason(DisconnectRevoked)
+		go client.Close(websocket.ClosePolicyViolation, "device key revoked")
+	}
+
+	s.logger.Info("🔒 Revoked device key", "device_id", deviceID, "disconnected", len(connected))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":    deviceID,
+		"revoked":      true,
+		"disconnected": len(connected),
+	})
+}
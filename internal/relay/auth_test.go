@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveTestRelay serves a relay with no Stag behind it.
+func serveTestRelay(t *testing.T) (*Service, *httptest.Server) {
+	t.Helper()
+
+	s := newTestService(t, "", openTestOutbox(t))
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+// dialTestRelay opens a StreamKit WebSocket with the given query string.
+// The connection is closed when the test ends.
+func dialTestRelay(t *testing.T, server *httptest.Server, query string, header http.Header) (*websocket.Conn, int) {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/streamkit?" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("failed to dial relay: %v", err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp.StatusCode
+}
+
+// readTestMessage reads the next JSON message the relay sends.
+func readTestMessage(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg map[string]interface{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	return msg
+}
+
+// handshakeTestRelay sends session_info and returns session_accepted.
+func handshakeTestRelay(t *testing.T, conn *websocket.Conn, streams ...StreamConfig) map[string]interface{} {
+	t.Helper()
+
+	if len(streams) == 0 {
+		streams = []StreamConfig{{Type: "pose"}}
+	}
+	info := SessionInfo{Type: "session_info", SessionID: "room", Streams: streams, TargetFPS: 30, SDKVersion: "1.0.0"}
+	if err := conn.WriteJSON(info); err != nil {
+		t.Fatalf("failed to send session_info: %v", err)
+	}
+	msg := readTestMessage(t, conn)
+	if msg["type"] != "session_accepted" {
+		t.Fatalf("handshake answered with %v, want session_accepted", msg)
+	}
+	return msg
+}
+
+func TestDeviceKeyFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   string
+	}{
+		{"bearer header", "Bearer tdk_header", "", "tdk_header"},
+		{"api_key query", "", "api_key=tdk_query", "tdk_query"},
+		{"header wins over query", "Bearer tdk_header", "api_key=tdk_query", "tdk_header"},
+		{"other scheme falls back to query", "Basic abc", "api_key=tdk_query", "tdk_query"},
+		{"none", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws/streamkit?"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := deviceKeyFromRequest(r); got != tt.want {
+				t.Fatalf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketDeviceIdentity(t *testing.T) {
+	s, server := serveTestRelay(t)
+	key, _, err := s.devices.Issue("ipad", "Test iPad")
+	if err != nil {
+		t.Fatalf("failed to issue key: %v", err)
+	}
+	bearer := http.Header{"Authorization": []string{"Bearer " + key}}
+
+	tests := []struct {
+		name     string
+		query    string
+		header   http.Header
+		status   int
+		deviceID string
+	}{
+		{"bearer header", "device_id=ipad", bearer, http.StatusSwitchingProtocols, "ipad"},
+		{"api_key query", "api_key=" + key, nil, http.StatusSwitchingProtocols, "ipad"},
+		{"device_id differs from key", "device_id=phone&api_key=" + key, nil, http.StatusSwitchingProtocols, "ipad"},
+		{"invalid key", "device_id=ipad&api_key=tdk_wrong", nil, http.StatusUnauthorized, ""},
+		{"unregistered device without key", "device_id=phone", nil, http.StatusSwitchingProtocols, "phone"},
+		{"registered device without key", "device_id=ipad", nil, http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, status := dialTestRelay(t, server, tt.query, tt.header)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if conn == nil {
+				return
+			}
+			if accepted := handshakeTestRelay(t, conn); accepted["device_id"] != tt.deviceID {
+				t.Fatalf("connected as %v, want %s", accepted["device_id"], tt.deviceID)
+			}
+		})
+	}
+
+	t.Run("revoked key", func(t *testing.T) {
+		conn, _ := dialTestRelay(t, server, "", bearer)
+		handshakeTestRelay(t, conn)
+
+		req := httptest.NewRequest("DELETE", "/admin/devices/ipad", nil)
+		req.RemoteAddr = "127.0.0.1:50000"
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("revoke status = %d, want 200", rec.Code)
+		}
+
+		// The open connection is closed and the key no longer connects
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("revoked connection read %v, want a policy violation close", err)
+		}
+		if _, status := dialTestRelay(t, server, "", bearer); status != http.StatusUnauthorized {
+			t.Fatalf("revoked key status = %d, want 401", status)
+		}
+	})
+}
+
+func TestWebSocketAuthRequired(t *testing.T) {
+	s := newTestService(t, "", openTestOutbox(t))
+	s.config.RelayAuthRequired = true
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	key, _, err := s.devices.Issue("ipad", "")
+	if err != nil {
+		t.Fatalf("failed to issue key: %v", err)
+	}
+
+	if _, status := dialTestRelay(t, server, "device_id=phone", nil); status != http.StatusUnauthorized {
+		t.Fatalf("status without key = %d, want 401", status)
+	}
+	if _, status := dialTestRelay(t, server, "api_key="+key, nil); status != http.StatusSwitchingProtocols {
+		t.Fatalf("status with key = %d, want 101", status)
+	}
+}
+
+func TestAdminAPIRequiresLoopbackOrToken(t *testing.T) {
+	s, _ := serveTestRelay(t)
+
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		header     string
+		status     int
+	}{
+		{"loopback without token", "", "127.0.0.1:50000", "", http.StatusOK},
+		{"ipv6 loopback without token", "", "[::1]:50000", "", http.StatusOK},
+		{"lan caller without token", "", "192.168.1.20:50000", "", http.StatusForbidden},
+		{"lan caller with token", "secret", "192.168.1.20:50000", "Bearer secret", http.StatusOK},
+		{"lan caller with wrong token", "secret", "192.168.1.20:50000", "Bearer guess", http.StatusUnauthorized},
+		{"loopback without the configured token", "secret", "127.0.0.1:50000", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.config.RelayAdminToken = tt.token
+			req := httptest.NewRequest("GET", "/admin/devices", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestResumeTokenBoundToDevice(t *testing.T) {
+	s, server := serveTestRelay(t)
+	ipadKey, _, err := s.devices.Issue("ipad", "")
+	if err != nil {
+		t.Fatalf("failed to issue key: %v", err)
+	}
+	phoneKey, _, err := s.devices.Issue("phone", "")
+	if err != nil {
+		t.Fatalf("failed to issue key: %v", err)
+	}
+
+	conn, _ := dialTestRelay(t, server, "api_key="+ipadKey, nil)
+	accepted := handshakeTestRelay(t, conn)
+	token, _ := accepted["resume_token"].(string)
+	if token == "" {
+		t.Fatalf("session_accepted carries no resume token")
+	}
+
+	// Another device, or no device, cannot take over the identity
+	for _, query := range []string{"api_key=" + phoneKey, "device_id=laptop"} {
+		other, _ := dialTestRelay(t, server, query+"&resume_token="+token, nil)
+		if msg := readTestMessage(t, other); msg["type"] != "resume_rejected" {
+			t.Fatalf("resume with %s answered %v, want resume_rejected", query, msg)
+		}
+	}
+
+	resumed, _ := dialTestRelay(t, server, "api_key="+ipadKey+"&resume_token="+token, nil)
+	msg := readTestMessage(t, resumed)
+	if msg["type"] != "session_resumed" || msg["client_id"] != accepted["client_id"] {
+		t.Fatalf("resume by the same device answered %v, want session_resumed as %v", msg, accepted["client_id"])
+	}
+}
@@ -0,0 +1,258 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientSendBuffer is how many outbound messages may wait for the writer.
+const ClientSendBuffer = 256
+
+var errClientClosed = errors.New("client connection closed")
+
+// Client is a connected StreamKit device. Its connection has a single
+// writer goroutine: everything sent to the device goes through Send, so
+// acks from the coalescer, replies from the read loop and server pushes
+// never write concurrently. Counters are atomic so /stats can read them
+// while the read loop runs.
+type Client struct {
+	ID         string
+	Conn       *websocket.Conn
+	SessionID  string
+	DeviceID   string
+	RemoteAddr string
+	StartTime  time.Time
+
+	// Authenticated is set when DeviceID comes from a device key rather
+	// than the query string
+	Authenticated bool
+
+	eventCount    atomic.Int64
+	bytesReceived atomic.Int64
+	lastPing      atomic.Int64 // unix nanoseconds, any message or pong
+	lastMessage   atomic.Int64 // unix nanoseconds, data messages only
+	closeReason   atomic.Pointer[string]
+	syncSent      atomic.Int64 // anchor updates pushed from Stag
+	syncDropped   atomic.Int64 // anchor updates dropped on a full send buffer
+
+	// Set once by the session_info handshake or on resume
+	session atomic.Pointer[SessionState]
+	resume  atomic.Pointer[resumeState]
+
+	pingInterval time.Duration
+	writeWait    time.Duration
+
+	send      chan outboundMessage
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeMsg  []byte
+	done      chan struct{} // closed when the writer has exited
+
+	// Decoded frames wait here for the coalescer; forwarded is closed
+	// once the queue has been drained after disconnect
+	queue     *frameQueue
+	forwarded chan struct{}
+}
+
+// SessionState is what the client and relay agreed on in the handshake.
+// It is never modified once set.
+type SessionState struct {
+	SDKVersion  string
+	TargetFPS   int
+	Compression map[string]string // negotiated per declared stream type
+}
+
+type outboundMessage struct {
+	messageType int
+	data        []byte
+}
+
+func newClient(conn *websocket.Conn, id, sessionID, deviceID, remoteAddr string, pingInterval, writeWait time.Duration) *Client {
+	c := &Client{
+		ID:           id,
+		Conn:         conn,
+		SessionID:    sessionID,
+		DeviceID:     deviceID,
+		RemoteAddr:   remoteAddr,
+		StartTime:    time.Now(),
+		pingInterval: pingInterval,
+		writeWait:    writeWait,
+		send:         make(chan outboundMessage, ClientSendBuffer),
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+		forwarded:    make(chan struct{}),
+	}
+	c.lastPing.Store(c.StartTime.UnixNano())
+	c.lastMessage.Store(c.StartTime.UnixNano())
+
+	go c.writeLoop()
+
+	return c
+}
+
+// Send queues a message for the writer goroutine. It blocks while the send
+// buffer is full and fails once the client is closing.
+func (c *Client) Send(messageType int, data []byte) error {
+	select {
+	case <-c.closing:
+		return errClientClosed
+	default:
+	}
+
+	select {
+	case c.send <- outboundMessage{messageType: messageType, data: data}:
+		return nil
+	case <-c.closing:
+		return errClientClosed
+	case <-c.done:
+		return errClientClosed
+	}
+}
+
+// TrySend queues a message only if the send buffer has room. It reports
+// whether the message was queued.
+func (c *Client) TrySend(messageType int, data []byte) bool {
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- outboundMessage{messageType: messageType, data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendJSON marshals v and sends it to the client as a text message.
+func (c *Client) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return c.Send(websocket.TextMessage, data)
+}
+
+// Close flushes messages already queued, sends a close frame with the given
+// code and reason, and closes the connection. Later calls are no-ops.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		close(c.closing)
+	})
+	<-c.done
+}
+
+// writeLoop is the connection's only writer. It also pings the client
+// every ping interval so dead connections hit their read deadline.
+func (c *Client) writeLoop() {
+	defer close(c.done)
+	defer c.Conn.Close()
+
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				c.SetCloseReason(DisconnectWriteError)
+				return
+			}
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeWait)); err != nil {
+				c.SetCloseReason(DisconnectWriteError)
+				return
+			}
+		case <-c.closing:
+			if c.flush() == nil {
+				c.Conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(time.Second))
+			}
+			return
+		}
+	}
+}
+
+// flush writes the messages still queued when the client starts closing.
+func (c *Client) flush() error {
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) write(msg outboundMessage) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeWait))
+	return c.Conn.WriteMessage(msg.messageType, msg.data)
+}
+
+// recordMessage notes an inbound message of size bytes.
+func (c *Client) recordMessage(size int) {
+	now := time.Now().UnixNano()
+	c.lastPing.Store(now)
+	c.lastMessage.Store(now)
+	c.bytesReceived.Add(int64(size))
+}
+
+func (c *Client) recordPong() {
+	c.lastPing.Store(time.Now().UnixNano())
+}
+
+func (c *Client) addEvents(n int) {
+	c.eventCount.Add(int64(n))
+}
+
+func (c *Client) EventCount() int64 {
+	return c.eventCount.Load()
+}
+
+func (c *Client) BytesReceived() int64 {
+	return c.bytesReceived.Load()
+}
+
+// LastPing returns when the client last sent a message or answered a ping.
+func (c *Client) LastPing() time.Time {
+	return time.Unix(0, c.lastPing.Load())
+}
+
+// LastMessage returns when the client last sent a data message.
+func (c *Client) LastMessage() time.Time {
+	return time.Unix(0, c.lastMessage.Load())
+}
+
+// SetCloseReason records why the connection is ending. The first reason
+// set wins.
+func (c *Client) SetCloseReason(reason string) {
+	c.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// CloseReason returns the recorded reason, or "" while still connected.
+func (c *Client) CloseReason() string {
+	if reason := c.closeReason.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
+
+// Session returns the negotiated session, or nil before the handshake.
+func (c *Client) Session() *SessionState {
+	return c.session.Load()
+}
+
+func (c *Client) Handshaken() bool {
+	return c.session.Load() != nil
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/logging"
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// pendingFrame is a decoded frame waiting to be merged into an ingest batch.
+type pendingFrame struct {
+	client      *Client
+	frameNumber uint64
+	events      []storage.SpatialEvent
+	info        storage.ProcessingInfo
+	size        int
+	dropped     int // events shed under load before delivery
+}
+
+// Coalescer merges frames from all clients into larger ingest batches,
+// flushing when a batch reaches maxFrames or maxBytes, or every interval.
+// It follows the same queue-and-ticker shape as performance.BatchProcessor.
+type Coalescer struct {
+	logger    *logging.Logger
+	maxFrames int
+	maxBytes  int
+	interval  time.Duration
+	queue     chan *pendingFrame
+	frames    []*pendingFrame
+	bytes     int
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	deliver   func([]*pendingFrame)
+}
+
+func NewCoalescer(logger *logging.Logger, maxFrames, maxBytes int, interval time.Duration, deliver func([]*pendingFrame)) *Coalescer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Coalescer{
+		logger:    logger,
+		maxFrames: maxFrames,
+		maxBytes:  maxBytes,
+		interval:  interval,
+		queue:     make(chan *pendingFrame, maxFrames*2),
+		frames:    make([]*pendingFrame, 0, maxFrames),
+		ctx:       ctx,
+		cancel:    cancel,
+		deliver:   deliver,
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	return c
+}
+
+// Add hands a frame to the coalescer. It returns false once the coalescer
+// has been stopped, in which case the frame will never be delivered.
+func (c *Coalescer) Add(frame *pendingFrame) bool {
+	if c.ctx.Err() != nil {
+		c.logger.Warn("Coalescer stopped, dropping frame", "client_id", frame.client.ID, "frame_number", frame.frameNumber)
+		return false
+	}
+
+	select {
+	case c.queue <- frame:
+		return true
+	case <-c.ctx.Done():
+		c.logger.Warn("Coalescer stopped, dropping frame", "client_id", frame.client.ID, "frame_number", frame.frameNumber)
+		return false
+	}
+}
+
+func (c *Coalescer) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case frame := <-c.queue:
+			c.mu.Lock()
+			c.frames = append(c.frames, frame)
+			c.bytes += frame.size
+			shouldFlush := len(c.frames) >= c.maxFrames || c.bytes >= c.maxBytes
+			c.mu.Unlock()
+
+			if shouldFlush {
+				c.flush()
+			}
+
+		case <-ticker.C:
+			c.flush()
+
+		case <-c.ctx.Done():
+			// Pick up anything still queued before the final flush
+			for empty := false; !empty; {
+				select {
+				case frame := <-c.queue:
+					c.mu.Lock()
+					c.frames = append(c.frames, frame)
+					c.mu.Unlock()
+				default:
+					empty = true
+				}
+			}
+			c.flush()
+			return
+		}
+	}
+}
+
+func (c *Coalescer) flush() {
+	c.mu.Lock()
+	if len(c.frames) == 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	toDeliver := make([]*pendingFrame, len(c.frames))
+	copy(toDeliver, c.frames)
+	c.frames = c.frames[:0]
+	c.bytes = 0
+	c.mu.Unlock()
+
+	c.deliver(toDeliver)
+}
+
+// Stop flushes any pending frames and waits for the final delivery.
+func (c *Coalescer) Stop() {
+	c.cancel()
+	c.wg.Wait()
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Stream compression codecs carried in the stream header codec byte.
+// A compressed payload is prefixed with its uncompressed size (u32).
+const (
+	CodecNone    uint8 = 0
+	CodecDeflate uint8 = 1
+	CodecZstd    uint8 = 2
+	CodecLZ4     uint8 = 3
+)
+
+// MaxDecompressedStreamSize bounds the declared size of a compressed stream
+// so a malformed packet cannot make the relay allocate unbounded memory.
+const MaxDecompressedStreamSize = 64 << 20
+
+var codecNames = map[uint8]string{
+	CodecNone:    "none",
+	CodecDeflate: "deflate",
+	CodecZstd:    "zstd",
+	CodecLZ4:     "lz4",
+}
+
+// SupportedCompression lists the compression names accepted during the
+// session handshake, in order of preference.
+var SupportedCompression = []string{"zstd", "lz4", "deflate", "none"}
+
+var (
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MaxDecompressedStreamSize))
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+)
+
+func CodecName(codec uint8) string {
+	if name, ok := codecNames[codec]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", codec)
+}
+
+// CodecByName resolves a handshake compression name to its codec.
+func CodecByName(name string) (uint8, bool) {
+	for codec, n := range codecNames {
+		if n == name {
+			return codec, true
+		}
+	}
+	return CodecNone, false
+}
+
+func decompressPayload(codec uint8, data []byte) ([]byte, error) {
+	if codec == CodecNone {
+		return data, nil
+	}
+
+	if len(data) < 4 {
+		return nil, fmt.Errorf("compressed payload too short")
+	}
+	originalSize := int(binary.LittleEndian.Uint32(data))
+	if originalSize > MaxDecompressedStreamSize {
+		return nil, fmt.Errorf("declared size %d exceeds limit of %d bytes", originalSize, MaxDecompressedStreamSize)
+	}
+	compressed := data[4:]
+
+	var out []byte
+	var err error
+
+	switch codec {
+	case CodecDeflate:
+		reader := flate.NewReader(bytes.NewReader(compressed))
+		defer reader.Close()
+		out, err = io.ReadAll(io.LimitReader(reader, int64(originalSize)+1))
+	case CodecZstd:
+		out, err = zstdDecoder.DecodeAll(compressed, make([]byte, 0, originalSize))
+	case CodecLZ4:
+		out = make([]byte, originalSize)
+		var n int
+		n, err = lz4.UncompressBlock(compressed, out)
+		out = out[:n]
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %d", codec)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s decompression failed: %w", CodecName(codec), err)
+	}
+	if len(out) != originalSize {
+		return nil, fmt.Errorf("%s decompressed to %d bytes, expected %d", CodecName(codec), len(out), originalSize)
+	}
+
+	return out, nil
+}
+
+// compressPayload is the inverse of decompressPayload. It returns ok=false
+// when compression would not make the payload smaller.
+func compressPayload(codec uint8, data []byte) ([]byte, bool, error) {
+	var b bytes.Buffer
+	putU32(&b, uint32(len(data)))
+
+	switch codec {
+	case CodecNone:
+		return data, false, nil
+	case CodecDeflate:
+		writer, err := flate.NewWriter(&b, flate.BestSpeed)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, false, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, false, err
+		}
+	case CodecZstd:
+		b.Write(zstdEncoder.EncodeAll(data, nil))
+	case CodecLZ4:
+		dst := make([]byte, lz4.CompressBlockBound(len(data)))
+		var c lz4.Compressor
+		n, err := c.CompressBlock(data, dst)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			// Incompressible
+			return data, false, nil
+		}
+		b.Write(dst[:n])
+	default:
+		return nil, false, fmt.Errorf("unsupported compression codec %d", codec)
+	}
+
+	if b.Len() >= len(data) {
+		return data, false, nil
+	}
+	return b.Bytes(), true, nil
+}
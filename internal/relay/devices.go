@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	devicesBucket    = "devices"
+	deviceKeysBucket = "device_keys"
+)
+
+// DeviceKeyPrefix marks relay device API keys so they are easy to spot.
+const DeviceKeyPrefix = "tdk_"
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrInvalidKey     = errors.New("invalid device key")
+)
+
+// Device is a registered StreamKit device. Only a hash of its API key is
+// stored; the key itself is shown once when issued.
+type Device struct {
+	DeviceID  string     `json:"device_id"`
+	Name      string     `json:"name,omitempty"`
+	KeyHash   string     `json:"key_hash,omitempty"`
+	KeyHint   string     `json:"key_hint"` // first characters of the key
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (d *Device) Revoked() bool {
+	return d.RevokedAt != nil
+}
+
+// DeviceRegistry stores registered devices and their API keys in bbolt.
+// Keys are indexed by hash so authentication is a single lookup.
+type DeviceRegistry struct {
+	db *bbolt.DB
+}
+
+func OpenDeviceRegistry(path string) (*DeviceRegistry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create device registry directory: %w", err)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: 1 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device registry: %w", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{devicesBucket, deviceKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create device registry buckets: %w", err)
+	}
+
+	return &DeviceRegistry{db: db}, nil
+}
+
+func (r *DeviceRegistry) Close() error {
+	return r.db.Close()
+}
+
+// Issue registers a device, or replaces the key of an existing one, and
+// returns the new API key. Any previous key stops working.
+func (r *DeviceRegistry) Issue(deviceID, name string) (string, *Device, error) {
+	if deviceID == "" {
+		return "", nil, fmt.Errorf("device_id cannot be empty")
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("failed to generate device key: %w", err)
+	}
+	key := DeviceKeyPrefix + hex.EncodeToString(secret)
+
+	device := &Device{
+		DeviceID:  deviceID,
+		Name:      name,
+		KeyHash:   hashDeviceKey(key),
+		KeyHint:   key[:len(DeviceKeyPrefix)+6],
+		CreatedAt: time.Now(),
+	}
+
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		devices := tx.Bucket([]byte(devicesBucket))
+		keys := tx.Bucket([]byte(deviceKeysBucket))
+
+		if data := devices.Get([]byte(deviceID)); data != nil {
+			var previous Device
+			if err := json.Unmarshal(data, &previous); err != nil {
+				return fmt.Errorf("failed to unmarshal device: %w", err)
+			}
+			if err := keys.Delete([]byte(previous.KeyHash)); err != nil {
+				return err
+			}
+			if name == "" {
+				device.Name = previous.Name
+			}
+		}
+
+		data, err := json.Marshal(device)
+		if err != nil {
+			return fmt.Errorf("failed to marshal device: %w", err)
+		}
+		if err := devices.Put([]byte(deviceID), data); err != nil {
+			return err
+		}
+		return keys.Put([]byte(device.KeyHash), []byte(deviceID))
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to issue key for device %s: %w", deviceID, err)
+	}
+
+	return key, device, nil
+}
+
+// Revoke disables a device's key. The device stays listed as revoked until
+// a new key is issued for it.
+func (r *DeviceRegistry) Revoke(deviceID string) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		devices := tx.Bucket([]byte(devicesBucket))
+		data := devices.Get([]byte(deviceID))
+		if data == nil {
+			return ErrDeviceNotFound
+		}
+
+		var device Device
+		if err := json.Unmarshal(data, &device); err != nil {
+			return fmt.Errorf("failed to unmarshal device: %w", err)
+		}
+		if err := tx.Bucket([]byte(deviceKeysBucket)).Delete([]byte(device.KeyHash)); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		device.RevokedAt = &now
+		data, err := json.Marshal(&device)
+		if err != nil {
+			return fmt.Errorf("failed to marshal device: %w", err)
+		}
+		return devices.Put([]byte(deviceID), data)
+	})
+}
+
+// Authenticate returns the device an API key belongs to.
+func (r *DeviceRegistry) Authenticate(key string) (*Device, error) {
+	hash := hashDeviceKey(key)
+
+	var device Device
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		deviceID := tx.Bucket([]byte(deviceKeysBucket)).Get([]byte(hash))
+		if deviceID == nil {
+			return ErrInvalidKey
+		}
+		data := tx.Bucket([]byte(devicesBucket)).Get(deviceID)
+		if data == nil {
+			return ErrInvalidKey
+		}
+		return json.Unmarshal(data, &device)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if device.Revoked() || subtle.ConstantTimeCompare([]byte(device.KeyHash), []byte(hash)) != 1 {
+		return nil, ErrInvalidKey
+	}
+	return &device, nil
+}
+
+// Get returns a registered device, including a revoked one.
+func (r *DeviceRegistry) Get(deviceID string) (*Device, error) {
+	var device Device
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(devicesBucket)).Get([]byte(deviceID))
+		if data == nil {
+			return ErrDeviceNotFound
+		}
+		return json.Unmarshal(data, &device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// List returns all registered devices, including revoked ones, by ID.
+func (r *DeviceRegistry) List() ([]*Device, error) {
+	var devices []*Device
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(devicesBucket)).ForEach(func(k, v []byte) error {
+			var device Device
+			if err := json.Unmarshal(v, &device); err != nil {
+				return fmt.Errorf("failed to unmarshal device %s: %w", k, err)
+			}
+			devices = append(devices, &device)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	return devices, nil
+}
+
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestDevices(t *testing.T) *DeviceRegistry {
+	t.Helper()
+
+	devices, err := OpenDeviceRegistry(filepath.Join(t.TempDir(), "devices.db"))
+	if err != nil {
+		t.Fatalf("failed to open device registry: %v", err)
+	}
+	t.Cleanup(func() { devices.Close() })
+	return devices
+}
+
+func TestDeviceKeyIssueAuthenticateRevoke(t *testing.T) {
+	devices := openTestDevices(t)
+
+	key, device, err := devices.Issue("ipad", "Test iPad")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !strings.HasPrefix(key, DeviceKeyPrefix) || !strings.HasPrefix(key, device.KeyHint) || device.KeyHash == "" {
+		t.Fatalf("issued key %q with hint %q and hash %q", key, device.KeyHint, device.KeyHash)
+	}
+
+	authenticated, err := devices.Authenticate(key)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if authenticated.DeviceID != "ipad" || authenticated.Name != "Test iPad" {
+		t.Fatalf("key authenticated as %s (%s), want ipad (Test iPad)", authenticated.DeviceID, authenticated.Name)
+	}
+	if _, err := devices.Authenticate(key + "0"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unknown key authenticated, err %v", err)
+	}
+
+	// Issuing again rotates the key and keeps the name
+	rotated, device, err := devices.Issue("ipad", "")
+	if err != nil {
+		t.Fatalf("Issue again: %v", err)
+	}
+	if device.Name != "Test iPad" {
+		t.Fatalf("rotating the key changed the name to %q", device.Name)
+	}
+	if _, err := devices.Authenticate(key); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("replaced key still authenticates, err %v", err)
+	}
+	if _, err := devices.Authenticate(rotated); err != nil {
+		t.Fatalf("rotated key does not authenticate: %v", err)
+	}
+
+	if err := devices.Revoke("ipad"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := devices.Authenticate(rotated); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("revoked key still authenticates, err %v", err)
+	}
+	revoked, err := devices.Get("ipad")
+	if err != nil || !revoked.Revoked() {
+		t.Fatalf("revoked device is not listed as revoked (err %v)", err)
+	}
+
+	if err := devices.Revoke("phone"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("revoking an unknown device returned %v, want ErrDeviceNotFound", err)
+	}
+	if _, err := devices.Get("phone"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("Get of an unknown device returned %v, want ErrDeviceNotFound", err)
+	}
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/mdns"
+)
+
+// DiscoveryService is the DNS-SD service type relays advertise on the LAN.
+const DiscoveryService = "_tabular-relay._tcp"
+
+// WebSocketPath is where StreamKit devices connect.
+const WebSocketPath = "/ws/streamkit"
+
+// Advertiser announces a running relay over mDNS so devices and tooling can
+// find it without typing in the LAN IP.
+type Advertiser struct {
+	server *mdns.Server
+}
+
+// Advertise starts answering mDNS queries for this relay. The TXT records
+// carry the version, WebSocket path and whether the relay serves wss://.
+func Advertise(version string, port int, ip net.IP, tlsEnabled, authRequired bool) (*Advertiser, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	hostname = strings.TrimSuffix(hostname, ".local")
+
+	txt := []string{
+		"version=" + version,
+		"path=" + WebSocketPath,
+		"tls=" + strconv.FormatBool(tlsEnabled),
+		"auth=" + strconv.FormatBool(authRequired),
+	}
+	service, err := mdns.NewMDNSService("tabular-relay-"+hostname, DiscoveryService, "", hostname+".local.", port, []net.IP{ip}, txt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mDNS service: %w", err)
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mDNS responder: %w", err)
+	}
+	return &Advertiser{server: server}, nil
+}
+
+func (a *Advertiser) Shutdown() error {
+	return a.server.Shutdown()
+}
+
+// DiscoveredRelay is a relay found by Discover.
+type DiscoveredRelay struct {
+	Instance     string `json:"instance"`
+	Host         string `json:"host"`
+	Addr         string `json:"addr"`
+	Port         int    `json:"port"`
+	Version      string `json:"version"`
+	Path         string `json:"path"`
+	TLS          bool   `json:"tls"`
+	AuthRequired bool   `json:"auth_required"`
+}
+
+// URL returns the WebSocket URL devices should connect to.
+func (d DiscoveredRelay) URL() string {
+	scheme := "ws"
+	if d.TLS {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(d.Addr, strconv.Itoa(d.Port)), d.Path)
+}
+
+// Discover browses the LAN for relays for up to timeout and returns them
+// sorted by instance name. The mDNS client reports malformed packets on the
+// LAN through the standard library logger; callers that don't want that
+// output should redirect it themselves.
+func Discover(timeout time.Duration) ([]DiscoveredRelay, error) {
+	entries := make(chan *mdns.ServiceEntry, 16)
+	found := make(map[string]DiscoveredRelay)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for entry := range entries {
+			relay := parseServiceEntry(entry)
+			found[relay.Instance] = relay
+		}
+	}()
+
+	params := mdns.DefaultParams(DiscoveryService)
+	params.Entries = entries
+	params.Timeout = timeout
+	params.DisableIPv6 = true
+
+	err := mdns.Query(params)
+
+	close(entries)
+	<-collected
+	if err != nil {
+		return nil, fmt.Errorf("mDNS query failed: %w", err)
+	}
+
+	relays := make([]DiscoveredRelay, 0, len(found))
+	for _, relay := range found {
+		relays = append(relays, relay)
+	}
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Instance < relays[j].Instance
+	})
+	return relays, nil
+}
+
+func parseServiceEntry(entry *mdns.ServiceEntry) DiscoveredRelay {
+	relay := DiscoveredRelay{
+		Instance: strings.TrimSuffix(entry.Name, "."+DiscoveryService+".local."),
+		Host:     strings.TrimSuffix(entry.Host, "."),
+		Port:     entry.Port,
+		Path:     WebSocketPath,
+	}
+	if entry.AddrV4 != nil {
+		relay.Addr = entry.AddrV4.String()
+	} else if entry.AddrV6 != nil {
+		relay.Addr = entry.AddrV6.String()
+	}
+
+	for _, field := range entry.InfoFields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "version":
+			relay.Version = value
+		case "path":
+			relay.Path = value
+		case "tls":
+			relay.TLS, _ = strconv.ParseBool(value)
+		case "auth":
+			relay.AuthRequired, _ = strconv.ParseBool(value)
+		}
+	}
+	return relay
+}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Drop policies applied when a client's frame queue is full. Streams are
+// shed lowest priority first and critical streams are never shed; once only
+// those are left the read loop blocks until the queue has room.
+const (
+	DropPolicyOldest = "drop_oldest" // drop the oldest queued frame of the lowest class
+	DropPolicyNewest = "drop_newest" // shed streams from the incoming frame
+	DropPolicyBlock  = "block"       // never drop, stall the client's socket
+)
+
+// Flow control watermarks as fractions of the client queue capacity. The
+// client is told to slow down at the high mark and to resume at the low one.
+const (
+	FlowHighWatermark = 0.75
+	FlowLowWatermark  = 0.25
+)
+
+// Flow control actions
+const (
+	FlowActionSlowDown = "slow_down"
+	FlowActionResume   = "resume"
+)
+
+// ErrCodeFrameDropped is sent in a frame_nack when every stream in a frame
+// was shed under load. Resending it would only add to the load.
+const ErrCodeFrameDropped = "frame_dropped"
+
+// FlowControl asks the client to lower or restore its send rate.
+type FlowControl struct {
+	Type          string    `json:"type"`
+	Action        string    `json:"action"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	SuggestedFPS  int       `json:"suggested_fps,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// frameQueue is a bounded FIFO of decoded frames between a client's read
+// loop and the coalescer, so a slow Stag fills the queue instead of
+// stalling the socket.
+type frameQueue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	frames     []*pendingFrame
+	capacity   int
+	policy     string
+	priorities streamPriorities
+	throttled  bool
+	closed     bool
+
+	droppedFrames int64
+	droppedEvents int64
+	droppedByType map[string]int64
+}
+
+// queueStats is a point-in-time view of a client's frame queue.
+type queueStats struct {
+	Depth         int
+	Capacity      int
+	Throttled     bool
+	DroppedFrames int64
+	DroppedEvents int64
+	DroppedByType map[string]int64
+}
+
+func newFrameQueue(capacity int, policy string, priorities streamPriorities) *frameQueue {
+	q := &frameQueue{
+		frames:        make([]*pendingFrame, 0, capacity),
+		capacity:      capacity,
+		policy:        policy,
+		priorities:    priorities,
+		droppedByType: make(map[string]int64),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push appends a frame, shedding non-critical streams per the queue's policy
+// when full and blocking when nothing more can be shed. It returns the
+// frames emptied by shedding, including the pushed frame if the queue is
+// closed, and whether the client should now be told to slow down.
+func (q *frameQueue) push(frame *pendingFrame) (dropped []*pendingFrame, slowDown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) >= q.capacity {
+		switch q.policy {
+		case DropPolicyOldest:
+			dropped = q.shedOldest()
+			if len(q.frames) >= q.capacity && q.shed(frame, criticalRank-1) {
+				q.droppedFrames++
+				return append(dropped, frame), false
+			}
+		case DropPolicyNewest:
+			if q.shed(frame, criticalRank-1) {
+				q.droppedFrames++
+				return []*pendingFrame{frame}, false
+			}
+		}
+	}
+
+	for len(q.frames) >= q.capacity && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		// The client is going away; report the frame so it is still nacked
+		q.shed(frame, criticalRank)
+		q.droppedFrames++
+		return append(dropped, frame), false
+	}
+
+	q.frames = append(q.frames, frame)
+	q.cond.Broadcast()
+
+	if !q.throttled && float64(len(q.frames)) >= FlowHighWatermark*float64(q.capacity) {
+		q.throttled = true
+		slowDown = true
+	}
+	return dropped, slowDown
+}
+
+// pop removes the oldest frame, blocking while the queue is empty. ok is
+// false once the queue is closed and drained. resume reports whether the
+// client should now be told to resume.
+func (q *frameQueue) pop() (frame *pendingFrame, resume bool, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.frames) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.frames) == 0 {
+		return nil, false, false
+	}
+
+	frame = q.frames[0]
+	q.frames[0] = nil
+	q.frames = q.frames[1:]
+	q.cond.Broadcast()
+
+	if q.throttled && float64(len(q.frames)) <= FlowLowWatermark*float64(q.capacity) {
+		q.throttled = false
+		resume = true
+	}
+	return frame, resume, true
+}
+
+// close wakes any blocked push or pop. Frames already queued are still
+// handed out by pop.
+func (q *frameQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *frameQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	droppedByType := make(map[string]int64, len(q.droppedByType))
+	for streamType, count := range q.droppedByType {
+		droppedByType[streamType] = count
+	}
+	return queueStats{
+		Depth:         len(q.frames),
+		Capacity:      q.capacity,
+		Throttled:     q.throttled,
+		DroppedFrames: q.droppedFrames,
+		DroppedEvents: q.droppedEvents,
+		DroppedByType: droppedByType,
+	}
+}
+
+// shedOldest drops a single queued frame: the oldest one made up only of
+// the lowest priority class present, trying one class at a time and never
+// critical. Other frames are left untouched. Returns the removed frames.
+func (q *frameQueue) shedOldest() []*pendingFrame {
+	for rank := 0; rank < criticalRank; rank++ {
+		for i, frame := range q.frames {
+			if !q.sheddable(frame, rank) {
+				continue
+			}
+			q.shed(frame, rank)
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			q.droppedFrames++
+			return []*pendingFrame{frame}
+		}
+	}
+	return nil
+}
+
+// sheddable reports whether shedding events ranked at or below maxRank
+// would leave the frame empty.
+func (q *frameQueue) sheddable(frame *pendingFrame, maxRank int) bool {
+	for _, event := range frame.events {
+		if q.priorities.rank(event.EventType) > maxRank {
+			return false
+		}
+	}
+	return true
+}
+
+// shed removes the events ranked at or below maxRank from a frame and
+// reports whether the frame was left empty.
+func (q *frameQueue) shed(frame *pendingFrame, maxRank int) bool {
+	kept := frame.events[:0]
+	for _, event := range frame.events {
+		if q.priorities.rank(event.EventType) <= maxRank {
+			frame.dropped++
+			q.droppedEvents++
+			q.droppedByType[event.EventType]++
+			continue
+		}
+		kept = append(kept, event)
+	}
+	frame.events = kept
+	return len(frame.events) == 0
+}
+
+// forwardQueuedFrames moves a client's queued frames into the coalescer
+// until the queue is closed and drained.
+func (s *Service) forwardQueuedFrames(client *Client) {
+	defer close(client.forwarded)
+
+	for {
+		frame, resume, ok := client.queue.pop()
+		if !ok {
+			return
+		}
+		if resume {
+			s.sendFlowControl(client, FlowActionResume)
+		}
+
+		if !s.coalescer.Add(frame) {
+			err := fmt.Errorf("relay is shutting down")
+			s.sendFrameNack(client, frame.frameNumber, "", ErrCodeStagUnavailable, err, true)
+		}
+	}
+}
+
+func (s *Service) sendFlowControl(client *Client, action string) {
+	stats := client.queue.stats()
+	msg := FlowControl{
+		Type:          "flow_control",
+		Action:        action,
+		QueueDepth:    stats.Depth,
+		QueueCapacity: stats.Capacity,
+		Timestamp:     time.Now(),
+	}
+	if session := client.Session(); action == FlowActionSlowDown && session != nil && session.TargetFPS > 1 {
+		msg.SuggestedFPS = session.TargetFPS / 2
+	}
+
+	s.logger.Info("Flow control",
+		"client_id", client.ID,
+		"action", action,
+		"queue_depth", stats.Depth,
+		"queue_capacity", stats.Capacity,
+	)
+
+	if err := client.SendJSON(msg); err != nil {
+		s.logger.Warn("Failed to send flow control", "client_id", client.ID, "action", action, "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+func testFrame(number uint64, eventTypes ...string) *pendingFrame {
+	frame := &pendingFrame{frameNumber: number}
+	for _, eventType := range eventTypes {
+		frame.events = append(frame.events, storage.SpatialEvent{EventType: eventType})
+	}
+	return frame
+}
+
+func testPriorities() streamPriorities {
+	return newStreamPriorities(map[string]string{
+		"pose":     PriorityCritical,
+		"lighting": PriorityHigh,
+		"depth":    PriorityLow,
+		"camera":   PriorityLow,
+	})
+}
+
+func TestFrameQueueShedOldestDropsOneFrame(t *testing.T) {
+	q := newFrameQueue(3, DropPolicyOldest, testPriorities())
+
+	mixed := testFrame(1, "pose", "camera")
+	lowOnly := testFrame(2, "depth", "camera")
+	highOnly := testFrame(3, "lighting")
+	for _, frame := range []*pendingFrame{mixed, lowOnly, highOnly} {
+		if dropped, _ := q.push(frame); len(dropped) != 0 {
+			t.Fatalf("frame %d: dropped %d frames below capacity", frame.frameNumber, len(dropped))
+		}
+	}
+
+	dropped, _ := q.push(testFrame(4, "pose"))
+	if len(dropped) != 1 || dropped[0] != lowOnly {
+		t.Fatalf("dropped %v, want only frame 2", dropped)
+	}
+
+	// Frames that were not dropped keep all their events
+	if len(mixed.events) != 2 || mixed.dropped != 0 {
+		t.Fatalf("frame 1 has %d events and %d dropped, want 2 and 0", len(mixed.events), mixed.dropped)
+	}
+	if len(highOnly.events) != 1 {
+		t.Fatalf("frame 3 has %d events, want 1", len(highOnly.events))
+	}
+
+	stats := q.stats()
+	if stats.Depth != 3 || stats.DroppedFrames != 1 || stats.DroppedEvents != 2 {
+		t.Fatalf("stats = %+v, want depth 3, 1 dropped frame, 2 dropped events", stats)
+	}
+	if stats.DroppedByType["depth"] != 1 || stats.DroppedByType["camera"] != 1 {
+		t.Fatalf("dropped by type = %v, want one depth and one camera", stats.DroppedByType)
+	}
+
+	var order []uint64
+	for i := 0; i < 3; i++ {
+		frame, _, _ := q.pop()
+		order = append(order, frame.frameNumber)
+	}
+	if order[0] != 1 || order[1] != 3 || order[2] != 4 {
+		t.Fatalf("popped frames %v, want [1 3 4]", order)
+	}
+}
+
+func TestFrameQueueShedOldestPrefersLowerClass(t *testing.T) {
+	q := newFrameQueue(2, DropPolicyOldest, testPriorities())
+
+	highOnly := testFrame(1, "lighting")
+	lowOnly := testFrame(2, "camera")
+	q.push(highOnly)
+	q.push(lowOnly)
+
+	// The newer low frame goes before the older high one
+	dropped, _ := q.push(testFrame(3, "pose"))
+	if len(dropped) != 1 || dropped[0] != lowOnly {
+		t.Fatalf("dropped %v, want only frame 2", dropped)
+	}
+	if len(highOnly.events) != 1 {
+		t.Fatalf("frame 1 has %d events, want 1", len(highOnly.events))
+	}
+}
+
+func TestFrameQueuePushAfterCloseReportsDrop(t *testing.T) {
+	q := newFrameQueue(2, DropPolicyBlock, testPriorities())
+	q.close()
+
+	frame := testFrame(1, "pose", "camera")
+	dropped, _ := q.push(frame)
+	if len(dropped) != 1 || dropped[0] != frame {
+		t.Fatalf("dropped %v, want the pushed frame", dropped)
+	}
+
+	stats := q.stats()
+	if stats.Depth != 0 || stats.DroppedFrames != 1 || stats.DroppedEvents != 2 {
+		t.Fatalf("stats = %+v, want depth 0, 1 dropped frame, 2 dropped events", stats)
+	}
+}
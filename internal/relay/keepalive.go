@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reasons a client connection ended, reported in logs and on /stats.
+const (
+	DisconnectClientClosed = "client_closed"
+	DisconnectReadTimeout  = "read_timeout"
+	DisconnectReadError    = "read_error"
+	DisconnectWriteError   = "write_error"
+	DisconnectIdle         = "idle"
+	DisconnectRejected     = "session_rejected"
+	DisconnectShutdown     = "server_shutdown"
+)
+
+// recentDisconnectsLimit bounds the disconnect history kept for /stats.
+const recentDisconnectsLimit = 20
+
+// disconnectRecord describes one ended connection.
+type disconnectRecord struct {
+	ClientID       string    `json:"client_id"`
+	SessionID      string    `json:"session_id"`
+	DeviceID       string    `json:"device_id"`
+	Reason         string    `json:"reason"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at"`
+	Duration       string    `json:"duration"`
+}
+
+// readErrorReason classifies the error that ended a client's read loop.
+func readErrorReason(err error) string {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return DisconnectClientClosed
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DisconnectReadTimeout
+	}
+	return DisconnectReadError
+}
+
+// extendReadDeadline gives the client another pong wait to send a message
+// or answer a ping.
+func (s *Service) extendReadDeadline(client *Client) {
+	client.Conn.SetReadDeadline(time.Now().Add(s.config.RelayPongWait))
+}
+
+// recordDisconnect counts why a connection ended and keeps it in the
+// bounded history.
+func (s *Service) recordDisconnect(client *Client) {
+	now := time.Now()
+	record := disconnectRecord{
+		ClientID:       client.ID,
+		SessionID:      client.SessionID,
+		DeviceID:       client.DeviceID,
+		Reason:         client.CloseReason(),
+		ConnectedAt:    client.StartTime,
+		DisconnectedAt: now,
+		Duration:       now.Sub(client.StartTime).String(),
+	}
+
+	s.disconnectsMux.Lock()
+	defer s.disconnectsMux.Unlock()
+
+	s.disconnectCounts[record.Reason]++
+	s.recentDisconnects = append(s.recentDisconnects, record)
+	if len(s.recentDisconnects) > recentDisconnectsLimit {
+		s.recentDisconnects = s.recentDisconnects[len(s.recentDisconnects)-recentDisconnectsLimit:]
+	}
+}
+
+// disconnectStats returns copies of the disconnect counts and history.
+func (s *Service) disconnectStats() (map[string]int64, []disconnectRecord) {
+	s.disconnectsMux.Lock()
+	defer s.disconnectsMux.Unlock()
+
+	counts := make(map[string]int64, len(s.disconnectCounts))
+	for reason, count := range s.disconnectCounts {
+		counts[reason] = count
+	}
+	recent := make([]disconnectRecord, len(s.recentDisconnects))
+	copy(recent, s.recentDisconnects)
+	return counts, recent
+}
+
+// reapIdleClients closes clients that keep answering pings but have not
+// sent a message within the idle timeout. Dead connections are caught
+// sooner by the read deadline.
+func (s *Service) reapIdleClients() {
+	defer close(s.reaped)
+
+	ticker := time.NewTicker(s.config.RelayPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.expireResumes()
+
+		cutoff := time.Now().Add(-s.config.RelayIdleTimeout)
+		s.clientsMux.RLock()
+		idle := make([]*Client, 0)
+		for _, client := range s.clients {
+			if client.LastMessage().Before(cutoff) {
+				idle = append(idle, client)
+			}
+		}
+		s.clientsMux.RUnlock()
+
+		for _, client := range idle {
+			s.logger.Info("Reaping idle client",
+				"client_id", client.ID,
+				"last_message", client.LastMessage().Format(time.RFC3339),
+				"idle_timeout", s.config.RelayIdleTimeout.String(),
+			)
+			client.SetCloseReason(DisconnectIdle)
+			go client.Close(websocket.CloseGoingAway, "idle timeout")
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/storage"
+	"go.etcd.io/bbolt"
+)
+
+const outboxBucket = "outbox"
+
+// outboxQuarantineBucket keeps entries that could not be decoded or that
+// Stag rejected, out of the delivery order but still on disk for inspection.
+const outboxQuarantineBucket = "outbox_quarantine"
+
+// Outbox retry backoff bounds
+const (
+	OutboxMinBackoff = 1 * time.Second
+	OutboxMaxBackoff = 60 * time.Second
+)
+
+// Outbox is a durable FIFO of ingest batches that could not be delivered
+// to Stag. Entries are keyed by a big-endian sequence so bbolt's key order
+// is delivery order. Bucket sizes are counted in memory so depth checks on
+// the delivery path do not scan the database.
+type Outbox struct {
+	db          *bbolt.DB
+	notify      chan struct{}
+	depth       atomic.Int64
+	quarantined atomic.Int64
+}
+
+type outboxEntry struct {
+	Key   []byte
+	Batch *storage.IngestBatch
+}
+
+// corruptEntryError is returned by Peek when the oldest entry cannot be
+// decoded.
+type corruptEntryError struct {
+	Key []byte
+	Err error
+}
+
+func (e *corruptEntryError) Error() string {
+	return fmt.Sprintf("failed to unmarshal queued batch %x: %v", e.Key, e.Err)
+}
+
+func (e *corruptEntryError) Unwrap() error {
+	return e.Err
+}
+
+func OpenOutbox(path string) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: 1 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+
+	o := &Outbox{
+		db:     db,
+		notify: make(chan struct{}, 1),
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{outboxBucket, outboxQuarantineBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		o.depth.Store(int64(tx.Bucket([]byte(outboxBucket)).Stats().KeyN))
+		o.quarantined.Store(int64(tx.Bucket([]byte(outboxQuarantineBucket)).Stats().KeyN))
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create outbox bucket: %w", err)
+	}
+
+	return o, nil
+}
+
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// Enqueue appends a batch to the tail of the outbox.
+func (o *Outbox) Enqueue(batch *storage.IngestBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	err = o.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(outboxBucket))
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist batch %s: %w", batch.BatchID, err)
+	}
+	o.depth.Add(1)
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the oldest queued batch, or nil when the outbox is empty.
+func (o *Outbox) Peek() (*outboxEntry, error) {
+	var entry *outboxEntry
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		key, data := tx.Bucket([]byte(outboxBucket)).Cursor().First()
+		if key == nil {
+			return nil
+		}
+		var batch storage.IngestBatch
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return &corruptEntryError{Key: append([]byte(nil), key...), Err: err}
+		}
+		entry = &outboxEntry{
+			Key:   append([]byte(nil), key...),
+			Batch: &batch,
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (o *Outbox) Remove(key []byte) error {
+	removed := false
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(outboxBucket))
+		if bucket.Get(key) == nil {
+			return nil
+		}
+		removed = true
+		return bucket.Delete(key)
+	})
+	if err == nil && removed {
+		o.depth.Add(-1)
+	}
+	return err
+}
+
+// Quarantine moves an entry that cannot be decoded, or that Stag will never
+// accept, out of the delivery order so the batches behind it can still be
+// delivered.
+func (o *Outbox) Quarantine(key []byte) error {
+	moved := false
+	err := o.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(outboxBucket))
+		data := bucket.Get(key)
+		if data == nil {
+			return nil
+		}
+		if err := tx.Bucket([]byte(outboxQuarantineBucket)).Put(key, data); err != nil {
+			return err
+		}
+		moved = true
+		return bucket.Delete(key)
+	})
+	if err == nil && moved {
+		o.depth.Add(-1)
+		o.quarantined.Add(1)
+	}
+	return err
+}
+
+// Depth returns the number of batches waiting for delivery.
+func (o *Outbox) Depth() int {
+	return int(o.depth.Load())
+}
+
+// Quarantined returns the number of entries moved out of the delivery
+// order.
+func (o *Outbox) Quarantined() int {
+	return int(o.quarantined.Load())
+}
+
+// drainOutbox delivers queued batches in order until stop is closed,
+// backing off exponentially while Stag stays unreachable.
+func (s *Service) drainOutbox() {
+	defer close(s.drained)
+
+	backoff := OutboxMinBackoff
+	backingOff := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.outbox.notify:
+			// New batches don't cut a backoff short
+			if backingOff {
+				continue
+			}
+		case <-timer.C:
+			backingOff = false
+		}
+
+		for {
+			entry, err := s.outbox.Peek()
+			var corrupt *corruptEntryError
+			if errors.As(err, &corrupt) {
+				s.logger.Error("Quarantining undecodable outbox entry", "key", fmt.Sprintf("%x", corrupt.Key), "error", corrupt.Err)
+				if err = s.outbox.Quarantine(corrupt.Key); err == nil {
+					continue
+				}
+			}
+			if err != nil {
+				s.logger.Error("Failed to read outbox", "error", err, "retry_in", backoff.String())
+				timer.Reset(backoff)
+				backingOff = true
+				break
+			}
+			if entry == nil {
+				backoff = OutboxMinBackoff
+				break
+			}
+
+			result, err := s.forwardToStag(entry.Batch)
+			if err != nil && isRetryableForwardError(err) {
+				s.logger.Warn("Stag still unreachable, retrying queued batches later",
+					"batch_id", entry.Batch.BatchID,
+					"queued", s.outbox.Depth(),
+					"retry_in", backoff.String(),
+					"error", err,
+				)
+				timer.Reset(backoff)
+				backingOff = true
+				backoff *= 2
+				if backoff > OutboxMaxBackoff {
+					backoff = OutboxMaxBackoff
+				}
+				break
+			}
+
+			// Its frames were already acked as queued, so a batch Stag
+			// will never accept is kept for inspection rather than dropped
+			if err != nil {
+				s.logger.Error("Quarantining queued batch rejected by stag",
+					"batch_id", entry.Batch.BatchID,
+					"events", len(entry.Batch.Events),
+					"error", err,
+				)
+				err = s.outbox.Quarantine(entry.Key)
+			} else {
+				s.logger.Info("Delivered queued batch",
+					"batch_id", entry.Batch.BatchID,
+					"events", len(entry.Batch.Events),
+					"trace_id", result.TraceID,
+				)
+				err = s.outbox.Remove(entry.Key)
+			}
+			if err != nil {
+				s.logger.Error("Failed to remove batch from outbox", "batch_id", entry.Batch.BatchID, "error", err)
+				timer.Reset(backoff)
+				backingOff = true
+				break
+			}
+			backoff = OutboxMinBackoff
+
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// stagStatusError is returned by forwardToStag when Stag answers with a
+// non-200 status.
+type stagStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *stagStatusError) Error() string {
+	return fmt.Sprintf("stag service returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// isRetryableForwardError reports whether a failed delivery may succeed
+// later. Network errors and 5xx/408/429 are retried; other 4xx responses
+// mean Stag will never accept the batch.
+func isRetryableForwardError(err error) bool {
+	var statusErr *stagStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	switch {
+	case statusErr.StatusCode >= 500:
+		return true
+	case statusErr.StatusCode == 408, statusErr.StatusCode == 429:
+		return true
+	default:
+		return false
+	}
+}
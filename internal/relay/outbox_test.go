@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/config"
+	"github.com/tabular/local-pipeline/internal/logging"
+	"github.com/tabular/local-pipeline/internal/storage"
+	"go.etcd.io/bbolt"
+)
+
+// newTestService starts a relay service delivering to endpoint, with its
+// outbox and device registry in a temporary directory.
+func newTestService(t *testing.T, endpoint string, outbox *Outbox) *Service {
+	t.Helper()
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	cfg.RelayEndpoint = endpoint
+	cfg.RelayMDNS = false
+	cfg.RelaySync = false
+
+	devices, err := OpenDeviceRegistry(filepath.Join(t.TempDir(), "devices.db"))
+	if err != nil {
+		t.Fatalf("failed to open device registry: %v", err)
+	}
+	t.Cleanup(func() { devices.Close() })
+
+	s := NewService(cfg, logging.NewLogger("error", "relay"), outbox, devices)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func openTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	return outbox
+}
+
+func TestOutboxDrainQuarantinesUndecodableEntry(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	stag := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch storage.IngestBatch
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("stag received an undecodable batch: %v", err)
+		}
+		mu.Lock()
+		delivered = append(delivered, batch.BatchID)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"trace_id": "t"})
+	}))
+	defer stag.Close()
+
+	outbox := openTestOutbox(t)
+
+	// A corrupt record at the head of the queue, ahead of valid batches
+	err := outbox.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(outboxBucket))
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatalf("failed to write corrupt entry: %v", err)
+	}
+	outbox.depth.Add(1) // written behind Enqueue's back
+	for _, id := range []string{"b1", "b2"} {
+		if err := outbox.Enqueue(&storage.IngestBatch{BatchID: id}); err != nil {
+			t.Fatalf("failed to enqueue %s: %v", id, err)
+		}
+	}
+
+	newTestService(t, stag.URL, outbox)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for outbox.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := outbox.Depth(); depth != 0 {
+		t.Fatalf("outbox depth = %d after draining, want 0", depth)
+	}
+
+	// A batch queued later is delivered too
+	if err := outbox.Enqueue(&storage.IngestBatch{BatchID: "b3"}); err != nil {
+		t.Fatalf("failed to enqueue b3: %v", err)
+	}
+	for outbox.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	got := append([]string(nil), delivered...)
+	mu.Unlock()
+	want := []string{"b1", "b2", "b3"}
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+
+	quarantined := 0
+	outbox.db.View(func(tx *bbolt.Tx) error {
+		quarantined = tx.Bucket([]byte(outboxQuarantineBucket)).Stats().KeyN
+		return nil
+	})
+	if quarantined != 1 {
+		t.Fatalf("quarantined %d entries, want 1", quarantined)
+	}
+}
+
+func TestOutboxDrainQuarantinesRejectedBatch(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	stag := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch storage.IngestBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		if batch.BatchID == "bad" {
+			http.Error(w, "invalid batch", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		delivered = append(delivered, batch.BatchID)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"trace_id": "t"})
+	}))
+	defer stag.Close()
+
+	// Depth survives a reopen
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("failed to open outbox: %v", err)
+	}
+	for _, id := range []string{"b1", "bad", "b2"} {
+		if err := outbox.Enqueue(&storage.IngestBatch{BatchID: id}); err != nil {
+			t.Fatalf("failed to enqueue %s: %v", id, err)
+		}
+	}
+	outbox.Close()
+	if outbox, err = OpenOutbox(path); err != nil {
+		t.Fatalf("failed to reopen outbox: %v", err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	if depth := outbox.Depth(); depth != 3 {
+		t.Fatalf("reopened outbox depth = %d, want 3", depth)
+	}
+
+	s := newTestService(t, stag.URL, outbox)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for outbox.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := outbox.Depth(); depth != 0 {
+		t.Fatalf("outbox depth = %d after draining, want 0", depth)
+	}
+
+	mu.Lock()
+	got := append([]string(nil), delivered...)
+	mu.Unlock()
+	if len(got) != 2 || got[0] != "b1" || got[1] != "b2" {
+		t.Fatalf("delivered %v, want [b1 b2]", got)
+	}
+
+	// The rejected batch is kept, not dropped
+	var quarantined storage.IngestBatch
+	outbox.db.View(func(tx *bbolt.Tx) error {
+		_, data := tx.Bucket([]byte(outboxQuarantineBucket)).Cursor().First()
+		return json.Unmarshal(data, &quarantined)
+	})
+	if quarantined.BatchID != "bad" || outbox.Quarantined() != 1 {
+		t.Fatalf("quarantined %d entries, first %q; want 1, bad", outbox.Quarantined(), quarantined.BatchID)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		OutboxDepth       int `json:"outbox_depth"`
+		OutboxQuarantined int `json:"outbox_quarantined"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if stats.OutboxDepth != 0 || stats.OutboxQuarantined != 1 {
+		t.Fatalf("stats report depth %d, quarantined %d; want 0 and 1", stats.OutboxDepth, stats.OutboxQuarantined)
+	}
+}
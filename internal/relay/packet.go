@@ -0,0 +1,671 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// StreamKit binary wire format (all integers little-endian, floats IEEE-754 float32):
+//
+//	header:  magic[4] "TBSK" | version u16 | flags u16 | frame u64 | device_time_ns i64 | stream_count u16 | reserved u16
+//	stream:  type u8 | flags u8 | codec u8 | reserved u8 | length u32 | payload[length]
+//	payload: [device_time_ns i64 if StreamFlagTimestamp] [transform if StreamFlagTransform] body
+//
+// When codec is not CodecNone the payload is compressed as a whole, see
+// decompressPayload.
+//
+// Each stream body is decoded according to its type, see the decode*Stream
+// functions below.
+const (
+	PacketMagic         = "TBSK"
+	PacketVersion       = 1
+	PacketHeaderSize    = 28
+	StreamHeaderSize    = 8
+	MaxStreamsPerPacket = 64
+)
+
+const (
+	StreamTypeMesh       uint8 = 1
+	StreamTypePose       uint8 = 2
+	StreamTypeCamera     uint8 = 3
+	StreamTypeDepth      uint8 = 4
+	StreamTypePointCloud uint8 = 5
+	StreamTypeLighting   uint8 = 6
+)
+
+// Stream flags
+const (
+	StreamFlagTimestamp uint8 = 1 << 0 // payload starts with its own device timestamp
+	StreamFlagTransform uint8 = 1 << 1 // payload carries a stream-level transform
+)
+
+var streamTypeNames = map[uint8]string{
+	StreamTypeMesh:       "mesh",
+	StreamTypePose:       "pose",
+	StreamTypeCamera:     "camera",
+	StreamTypeDepth:      "depth",
+	StreamTypePointCloud: "pointCloud",
+	StreamTypeLighting:   "lighting",
+}
+
+// StreamTypeName returns the event type name for a wire stream type.
+func StreamTypeName(t uint8) string {
+	if name, ok := streamTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", t)
+}
+
+// DecodePacket parses a binary StreamKit packet and decodes every stream it carries.
+func DecodePacket(data []byte) (*StreamKitPacket, error) {
+	if len(data) < PacketHeaderSize {
+		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
+	}
+
+	r := newPacketReader(data)
+
+	magic := string(r.bytes(4))
+	if magic != PacketMagic {
+		return nil, fmt.Errorf("invalid packet magic %q", magic)
+	}
+
+	packet := &StreamKitPacket{
+		Magic:   magic,
+		Version: r.u16(),
+	}
+	if packet.Version == 0 || packet.Version > PacketVersion {
+		return nil, fmt.Errorf("unsupported packet version %d", packet.Version)
+	}
+
+	packet.Flags = r.u16()
+	packet.FrameNumber = r.u64()
+	packet.Timestamp = time.Unix(0, r.i64())
+	streamCount := int(r.u16())
+	r.u16() // reserved
+
+	if streamCount > MaxStreamsPerPacket {
+		return nil, fmt.Errorf("too many streams in packet: %d", streamCount)
+	}
+
+	packet.Streams = make([]StreamData, 0, streamCount)
+	for i := 0; i < streamCount; i++ {
+		if r.remaining() < StreamHeaderSize {
+			return nil, fmt.Errorf("stream %d: truncated stream header", i)
+		}
+
+		stream := StreamData{
+			TypeID: r.u8(),
+			Flags:  r.u8(),
+			Codec:  r.u8(),
+		}
+		r.u8() // reserved
+		length := int(r.u32())
+		if length > r.remaining() {
+			return nil, fmt.Errorf("stream %d: length %d exceeds remaining %d bytes", i, length, r.remaining())
+		}
+		stream.Type = StreamTypeName(stream.TypeID)
+		stream.Compression = CodecName(stream.Codec)
+		stream.CompressedSize = length
+
+		payload, err := decompressPayload(stream.Codec, r.bytes(length))
+		if err != nil {
+			return nil, fmt.Errorf("stream %d (%s): %w", i, stream.Type, err)
+		}
+		stream.Data = payload
+		stream.OriginalSize = len(payload)
+
+		if err := decodeStream(&stream, packet.Timestamp); err != nil {
+			return nil, fmt.Errorf("stream %d (%s): %w", i, stream.Type, err)
+		}
+
+		packet.Streams = append(packet.Streams, stream)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.remaining() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after last stream", r.remaining())
+	}
+
+	return packet, nil
+}
+
+func decodeStream(stream *StreamData, packetTime time.Time) error {
+	if _, known := streamTypeNames[stream.TypeID]; !known {
+		// Unknown streams are carried through undecoded
+		return nil
+	}
+
+	r := newPacketReader(stream.Data)
+
+	stream.Timestamp = packetTime
+	if stream.Flags&StreamFlagTimestamp != 0 {
+		stream.Timestamp = time.Unix(0, r.i64())
+	}
+	if stream.Flags&StreamFlagTransform != 0 {
+		stream.Transform = r.transform()
+	}
+
+	switch stream.TypeID {
+	case StreamTypeMesh:
+		stream.Mesh = decodeMeshStream(r)
+		stream.Mesh.Transform = stream.Transform
+	case StreamTypePose:
+		stream.Pose = decodePoseStream(r)
+	case StreamTypeCamera:
+		stream.Camera = decodeCameraStream(r)
+		stream.Camera.Transform = stream.Transform
+		stream.Camera.Timestamp = stream.Timestamp
+	case StreamTypeDepth:
+		stream.Depth = decodeDepthStream(r)
+		stream.Depth.Transform = stream.Transform
+		stream.Depth.Timestamp = stream.Timestamp
+	case StreamTypePointCloud:
+		stream.PointCloud = decodePointCloudStream(r)
+		stream.PointCloud.Transform = stream.Transform
+		stream.PointCloud.Timestamp = stream.Timestamp
+	case StreamTypeLighting:
+		stream.Lighting = decodeLightingStream(r)
+		stream.Lighting.Transform = stream.Transform
+		stream.Lighting.Timestamp = stream.Timestamp
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.remaining() != 0 {
+		return fmt.Errorf("%d trailing bytes in payload", r.remaining())
+	}
+	return nil
+}
+
+// mesh: anchor_id str16 | classification str8 | confidence f32 |
+// vertex_count u32 | vertices f32[3*n] | index_count u32 | indices u32[m] |
+// normal_count u32 | normals f32[3*k]
+func decodeMeshStream(r *packetReader) *storage.MeshData {
+	mesh := &storage.MeshData{
+		AnchorID:       r.str16(),
+		Classification: r.str8(),
+		Confidence:     r.f32(),
+	}
+
+	mesh.Vertices = r.f32s(3 * int(r.u32()))
+
+	indexCount := int(r.u32())
+	if indexCount%3 != 0 {
+		r.fail(fmt.Errorf("index count %d is not a multiple of 3", indexCount))
+		return mesh
+	}
+	mesh.Faces = r.u32s(indexCount)
+
+	if normals := r.f32s(3 * int(r.u32())); len(normals) > 0 {
+		mesh.Normals = normals
+	}
+
+	vertexCount := uint32(len(mesh.Vertices) / 3)
+	for _, idx := range mesh.Faces {
+		if idx >= vertexCount {
+			r.fail(fmt.Errorf("face index %d out of range for %d vertices", idx, vertexCount))
+			break
+		}
+	}
+
+	return mesh
+}
+
+// pose: transform | velocity f32[3] | angular_velocity f32[3] | confidence f32
+func decodePoseStream(r *packetReader) *storage.PoseData {
+	pose := &storage.PoseData{
+		Transform: r.transform(),
+	}
+	copy(pose.Velocity[:], r.f32s(3))
+	copy(pose.AngularVelocity[:], r.f32s(3))
+	pose.Confidence = r.f32()
+	return pose
+}
+
+// camera: width u32 | height u32 | format str8 | intrinsics f32[9] |
+// exposure f32 | iso u32 | focal_length f32 | image_length u32 | image[image_length]
+func decodeCameraStream(r *packetReader) *storage.CameraData {
+	camera := &storage.CameraData{
+		Width:  int(r.u32()),
+		Height: int(r.u32()),
+		Format: r.str8(),
+	}
+	copy(camera.Intrinsics[:], r.f32s(9))
+	camera.Exposure = r.f32()
+	camera.ISO = int(r.u32())
+	camera.FocalLength = r.f32()
+
+	imageLength := int(r.u32())
+	camera.ImageData = append([]byte(nil), r.bytes(imageLength)...)
+
+	return camera
+}
+
+// depth: width u32 | height u32 | min_range f32 | max_range f32 |
+// depth f32[width*height] | confidence_count u32 | confidence f32[confidence_count]
+func decodeDepthStream(r *packetReader) *storage.DepthData {
+	depth := &storage.DepthData{
+		Width:  int(r.u32()),
+		Height: int(r.u32()),
+	}
+	depth.MinRange = r.f32()
+	depth.MaxRange = r.f32()
+	depth.Data = r.f32s(depth.Width * depth.Height)
+
+	confidenceCount := int(r.u32())
+	if confidenceCount != 0 && confidenceCount != len(depth.Data) {
+		r.fail(fmt.Errorf("depth confidence count %d does not match %d samples", confidenceCount, len(depth.Data)))
+		return depth
+	}
+	if confidenceCount > 0 {
+		depth.Confidence = r.f32s(confidenceCount)
+	}
+
+	return depth
+}
+
+// Point cloud attribute bits
+const (
+	pointCloudHasColors     uint8 = 1 << 0
+	pointCloudHasNormals    uint8 = 1 << 1
+	pointCloudHasConfidence uint8 = 1 << 2
+)
+
+// pointCloud: point_count u32 | points f32[3*n] | attributes u8 |
+// colors f32[3*n] | normals f32[3*n] | confidence f32[n] (each present if its attribute bit is set)
+func decodePointCloudStream(r *packetReader) *storage.PointCloudData {
+	pc := &storage.PointCloudData{}
+
+	pointCount := int(r.u32())
+	pc.Points = r.f32s(3 * pointCount)
+
+	attributes := r.u8()
+	if attributes&pointCloudHasColors != 0 {
+		pc.Colors = r.f32s(3 * pointCount)
+	}
+	if attributes&pointCloudHasNormals != 0 {
+		pc.Normals = r.f32s(3 * pointCount)
+	}
+	if attributes&pointCloudHasConfidence != 0 {
+		pc.Confidence = r.f32s(pointCount)
+	}
+
+	return pc
+}
+
+// lighting: ambient_intensity f32 | directional_light f32[3] | color_temperature f32 |
+// sh_count u32 | spherical_harmonics f32[sh_count]
+func decodeLightingStream(r *packetReader) *storage.LightingData {
+	lighting := &storage.LightingData{
+		AmbientIntensity: r.f32(),
+	}
+	copy(lighting.DirectionalLight[:], r.f32s(3))
+	lighting.ColorTemperature = r.f32()
+	if sh := r.f32s(int(r.u32())); len(sh) > 0 {
+		lighting.SphericalHarmonics = sh
+	}
+	return lighting
+}
+
+// packetReader is a bounds-checked little-endian reader. The first error
+// sticks and all subsequent reads return zero values.
+type packetReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func newPacketReader(buf []byte) *packetReader {
+	return &packetReader{buf: buf}
+}
+
+func (r *packetReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *packetReader) remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *packetReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.remaining() {
+		r.fail(fmt.Errorf("unexpected end of data: need %d bytes at offset %d, have %d", n, r.off, r.remaining()))
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *packetReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *packetReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *packetReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *packetReader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *packetReader) i64() int64 {
+	return int64(r.u64())
+}
+
+func (r *packetReader) f32() float64 {
+	return float64(math.Float32frombits(r.u32()))
+}
+
+func (r *packetReader) str8() string {
+	return string(r.bytes(int(r.u8())))
+}
+
+func (r *packetReader) str16() string {
+	return string(r.bytes(int(r.u16())))
+}
+
+func (r *packetReader) f32s(n int) []float64 {
+	if n < 0 || n > r.remaining()/4 {
+		r.fail(fmt.Errorf("array of %d elements exceeds remaining %d bytes", n, r.remaining()))
+		return nil
+	}
+	b := r.bytes(4 * n)
+	if b == nil {
+		return nil
+	}
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:])))
+	}
+	return out
+}
+
+func (r *packetReader) u32s(n int) []uint32 {
+	if n < 0 || n > r.remaining()/4 {
+		r.fail(fmt.Errorf("array of %d elements exceeds remaining %d bytes", n, r.remaining()))
+		return nil
+	}
+	b := r.bytes(4 * n)
+	if b == nil {
+		return nil
+	}
+	out := make([]uint32, n)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return out
+}
+
+// transform: translation f32[3] | rotation f32[4] (x, y, z, w) | scale f32[3]
+func (r *packetReader) transform() *storage.Transform {
+	t := &storage.Transform{}
+	copy(t.Translation[:], r.f32s(3))
+	copy(t.Rotation[:], r.f32s(4))
+	copy(t.Scale[:], r.f32s(3))
+	return t
+}
+
+// PacketWriter builds StreamKit packets in the wire format understood by
+// DecodePacket. It is used by the test client and tooling.
+type PacketWriter struct {
+	frameNumber uint64
+	timestamp   time.Time
+	codec       uint8
+	streams     []encodedStream
+}
+
+type encodedStream struct {
+	streamType uint8
+	flags      uint8
+	payload    []byte
+}
+
+func NewPacketWriter(frameNumber uint64, timestamp time.Time) *PacketWriter {
+	return &PacketWriter{
+		frameNumber: frameNumber,
+		timestamp:   timestamp,
+	}
+}
+
+// SetCompression selects the codec used for every stream in the packet.
+// Streams that do not shrink are sent uncompressed.
+func (w *PacketWriter) SetCompression(codec uint8) {
+	w.codec = codec
+}
+
+// addStream prefixes the body with the optional per-stream timestamp and
+// transform. A zero timestamp means the stream shares the packet timestamp.
+func (w *PacketWriter) addStream(streamType uint8, timestamp time.Time, transform *storage.Transform, body []byte) {
+	var b bytes.Buffer
+	var flags uint8
+	if !timestamp.IsZero() {
+		flags |= StreamFlagTimestamp
+		putU64(&b, uint64(timestamp.UnixNano()))
+	}
+	if transform != nil {
+		flags |= StreamFlagTransform
+		putTransform(&b, transform)
+	}
+	b.Write(body)
+
+	w.streams = append(w.streams, encodedStream{
+		streamType: streamType,
+		flags:      flags,
+		payload:    b.Bytes(),
+	})
+}
+
+func (w *PacketWriter) AddMesh(mesh *storage.MeshData) {
+	var b bytes.Buffer
+	putStr16(&b, mesh.AnchorID)
+	putStr8(&b, mesh.Classification)
+	putF32(&b, mesh.Confidence)
+	putU32(&b, uint32(len(mesh.Vertices)/3))
+	putF32s(&b, mesh.Vertices[:len(mesh.Vertices)/3*3])
+	putU32(&b, uint32(len(mesh.Faces)))
+	for _, f := range mesh.Faces {
+		putU32(&b, f)
+	}
+	putU32(&b, uint32(len(mesh.Normals)/3))
+	putF32s(&b, mesh.Normals[:len(mesh.Normals)/3*3])
+	w.addStream(StreamTypeMesh, time.Time{}, mesh.Transform, b.Bytes())
+}
+
+func (w *PacketWriter) AddPose(pose *storage.PoseData) {
+	var b bytes.Buffer
+	putTransform(&b, pose.Transform)
+	putF32s(&b, pose.Velocity[:])
+	putF32s(&b, pose.AngularVelocity[:])
+	putF32(&b, pose.Confidence)
+	w.addStream(StreamTypePose, time.Time{}, nil, b.Bytes())
+}
+
+func (w *PacketWriter) AddCamera(camera *storage.CameraData) {
+	var b bytes.Buffer
+	putU32(&b, uint32(camera.Width))
+	putU32(&b, uint32(camera.Height))
+	putStr8(&b, camera.Format)
+	putF32s(&b, camera.Intrinsics[:])
+	putF32(&b, camera.Exposure)
+	putU32(&b, uint32(camera.ISO))
+	putF32(&b, camera.FocalLength)
+	putU32(&b, uint32(len(camera.ImageData)))
+	b.Write(camera.ImageData)
+	w.addStream(StreamTypeCamera, camera.Timestamp, camera.Transform, b.Bytes())
+}
+
+func (w *PacketWriter) AddDepth(depth *storage.DepthData) {
+	samples := depth.Width * depth.Height
+	if len(depth.Data) < samples {
+		samples = 0
+	}
+
+	var b bytes.Buffer
+	putU32(&b, uint32(depth.Width))
+	putU32(&b, uint32(depth.Height))
+	putF32(&b, depth.MinRange)
+	putF32(&b, depth.MaxRange)
+	putF32s(&b, depth.Data[:samples])
+	if len(depth.Confidence) == samples && samples > 0 {
+		putU32(&b, uint32(samples))
+		putF32s(&b, depth.Confidence)
+	} else {
+		putU32(&b, 0)
+	}
+	w.addStream(StreamTypeDepth, depth.Timestamp, depth.Transform, b.Bytes())
+}
+
+func (w *PacketWriter) AddPointCloud(pc *storage.PointCloudData) {
+	n := len(pc.Points) / 3
+
+	var attributes uint8
+	if len(pc.Colors) == 3*n && n > 0 {
+		attributes |= pointCloudHasColors
+	}
+	if len(pc.Normals) == 3*n && n > 0 {
+		attributes |= pointCloudHasNormals
+	}
+	if len(pc.Confidence) == n && n > 0 {
+		attributes |= pointCloudHasConfidence
+	}
+
+	var b bytes.Buffer
+	putU32(&b, uint32(n))
+	putF32s(&b, pc.Points[:3*n])
+	b.WriteByte(attributes)
+	if attributes&pointCloudHasColors != 0 {
+		putF32s(&b, pc.Colors)
+	}
+	if attributes&pointCloudHasNormals != 0 {
+		putF32s(&b, pc.Normals)
+	}
+	if attributes&pointCloudHasConfidence != 0 {
+		putF32s(&b, pc.Confidence)
+	}
+	w.addStream(StreamTypePointCloud, pc.Timestamp, pc.Transform, b.Bytes())
+}
+
+func (w *PacketWriter) AddLighting(lighting *storage.LightingData) {
+	var b bytes.Buffer
+	putF32(&b, lighting.AmbientIntensity)
+	putF32s(&b, lighting.DirectionalLight[:])
+	putF32(&b, lighting.ColorTemperature)
+	putU32(&b, uint32(len(lighting.SphericalHarmonics)))
+	putF32s(&b, lighting.SphericalHarmonics)
+	w.addStream(StreamTypeLighting, lighting.Timestamp, lighting.Transform, b.Bytes())
+}
+
+// Bytes returns the encoded packet.
+func (w *PacketWriter) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(PacketMagic)
+	putU16(&b, PacketVersion)
+	putU16(&b, 0) // flags
+	putU64(&b, w.frameNumber)
+	putU64(&b, uint64(w.timestamp.UnixNano()))
+	putU16(&b, uint16(len(w.streams)))
+	putU16(&b, 0) // reserved
+
+	for _, stream := range w.streams {
+		payload, compressed, err := compressPayload(w.codec, stream.payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress %s stream: %w", StreamTypeName(stream.streamType), err)
+		}
+		codec := CodecNone
+		if compressed {
+			codec = w.codec
+		}
+
+		b.WriteByte(stream.streamType)
+		b.WriteByte(stream.flags)
+		b.WriteByte(codec)
+		b.WriteByte(0) // reserved
+		putU32(&b, uint32(len(payload)))
+		b.Write(payload)
+	}
+
+	return b.Bytes(), nil
+}
+
+func putU16(b *bytes.Buffer, v uint16) {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func putU32(b *bytes.Buffer, v uint32) {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func putU64(b *bytes.Buffer, v uint64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func putF32(b *bytes.Buffer, v float64) {
+	putU32(b, math.Float32bits(float32(v)))
+}
+
+func putF32s(b *bytes.Buffer, vs []float64) {
+	for _, v := range vs {
+		putF32(b, v)
+	}
+}
+
+func putStr8(b *bytes.Buffer, s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	b.WriteByte(uint8(len(s)))
+	b.WriteString(s)
+}
+
+func putStr16(b *bytes.Buffer, s string) {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	putU16(b, uint16(len(s)))
+	b.WriteString(s)
+}
+
+func putTransform(b *bytes.Buffer, t *storage.Transform) {
+	if t == nil {
+		t = &storage.Transform{Rotation: [4]float64{0, 0, 0, 1}, Scale: [3]float64{1, 1, 1}}
+	}
+	putF32s(b, t.Translation[:])
+	putF32s(b, t.Rotation[:])
+	putF32s(b, t.Scale[:])
+}
@@ -0,0 +1,384 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// Values below are exactly representable as float32, so they survive the
+// wire format unchanged.
+
+func testTransform() *storage.Transform {
+	return &storage.Transform{
+		Translation: [3]float64{0.5, -1.25, 2},
+		Rotation:    [4]float64{0, 0.5, 0, 0.75},
+		Scale:       [3]float64{1, 1, 1},
+	}
+}
+
+func testFloats(n int, scale float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = float64(i%16) * scale
+	}
+	return values
+}
+
+// testPacketStreams returns one payload of every stream type, each large
+// enough to shrink under compression apart from the pose.
+func testPacketStreams(at time.Time) map[uint8]func(*PacketWriter) interface{} {
+	return map[uint8]func(*PacketWriter) interface{}{
+		StreamTypeMesh: func(w *PacketWriter) interface{} {
+			faces := make([]uint32, 0, 3*98)
+			for i := uint32(0); i < 98; i++ {
+				faces = append(faces, i, i+1, i+2)
+			}
+			mesh := &storage.MeshData{
+				AnchorID:       "mesh_1",
+				Vertices:       testFloats(3*100, 0.125),
+				Faces:          faces,
+				Normals:        testFloats(3*100, 0.0625),
+				Transform:      testTransform(),
+				Classification: "floor",
+				Confidence:     0.75,
+			}
+			w.AddMesh(mesh)
+			return mesh
+		},
+		StreamTypePose: func(w *PacketWriter) interface{} {
+			pose := &storage.PoseData{
+				Transform:       testTransform(),
+				Velocity:        [3]float64{0.25, 0, -0.5},
+				AngularVelocity: [3]float64{0, 0.125, 0},
+				Confidence:      1,
+			}
+			w.AddPose(pose)
+			return pose
+		},
+		StreamTypeCamera: func(w *PacketWriter) interface{} {
+			camera := &storage.CameraData{
+				ImageData:   bytes.Repeat([]byte("jpeg"), 1024),
+				Width:       64,
+				Height:      48,
+				Format:      "jpeg",
+				Intrinsics:  [9]float64{500, 0, 32, 0, 500, 24, 0, 0, 1},
+				Transform:   testTransform(),
+				Timestamp:   at.Add(time.Millisecond),
+				Exposure:    0.015625,
+				ISO:         400,
+				FocalLength: 4.25,
+			}
+			w.AddCamera(camera)
+			return camera
+		},
+		StreamTypeDepth: func(w *PacketWriter) interface{} {
+			depth := &storage.DepthData{
+				Data:       testFloats(32*24, 0.25),
+				Width:      32,
+				Height:     24,
+				Confidence: testFloats(32*24, 1),
+				MinRange:   0.5,
+				MaxRange:   5,
+				Timestamp:  at,
+			}
+			w.AddDepth(depth)
+			return depth
+		},
+		StreamTypePointCloud: func(w *PacketWriter) interface{} {
+			cloud := &storage.PointCloudData{
+				Points:     testFloats(3*200, 0.5),
+				Colors:     testFloats(3*200, 0.0625),
+				Normals:    testFloats(3*200, 0.125),
+				Confidence: testFloats(200, 0.25),
+				Timestamp:  at,
+			}
+			w.AddPointCloud(cloud)
+			return cloud
+		},
+		StreamTypeLighting: func(w *PacketWriter) interface{} {
+			lighting := &storage.LightingData{
+				AmbientIntensity:   1000,
+				DirectionalLight:   [3]float64{0, -1, 0},
+				SphericalHarmonics: testFloats(27*8, 0.5),
+				ColorTemperature:   6500,
+				Timestamp:          at,
+			}
+			w.AddLighting(lighting)
+			return lighting
+		},
+	}
+}
+
+func decodedPayload(stream *StreamData) interface{} {
+	switch stream.TypeID {
+	case StreamTypeMesh:
+		return stream.Mesh
+	case StreamTypePose:
+		return stream.Pose
+	case StreamTypeCamera:
+		return stream.Camera
+	case StreamTypeDepth:
+		return stream.Depth
+	case StreamTypePointCloud:
+		return stream.PointCloud
+	case StreamTypeLighting:
+		return stream.Lighting
+	}
+	return nil
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	at := time.Unix(0, 1700000000123456789)
+
+	for _, codec := range []uint8{CodecNone, CodecDeflate, CodecZstd, CodecLZ4} {
+		for streamType, add := range testPacketStreams(at) {
+			t.Run(CodecName(codec)+"/"+StreamTypeName(streamType), func(t *testing.T) {
+				w := NewPacketWriter(42, at)
+				w.SetCompression(codec)
+				want := add(w)
+
+				data, err := w.Bytes()
+				if err != nil {
+					t.Fatalf("failed to encode packet: %v", err)
+				}
+				packet, err := DecodePacket(data)
+				if err != nil {
+					t.Fatalf("failed to decode packet: %v", err)
+				}
+
+				if packet.FrameNumber != 42 || !packet.Timestamp.Equal(at) {
+					t.Fatalf("header frame %d at %v, want 42 at %v", packet.FrameNumber, packet.Timestamp, at)
+				}
+				if len(packet.Streams) != 1 {
+					t.Fatalf("decoded %d streams, want 1", len(packet.Streams))
+				}
+				stream := &packet.Streams[0]
+				if stream.TypeID != streamType {
+					t.Fatalf("stream type %d, want %d", stream.TypeID, streamType)
+				}
+				if streamType != StreamTypePose && stream.Codec != codec {
+					t.Errorf("stream sent with codec %s, want %s", CodecName(stream.Codec), CodecName(codec))
+				}
+				if got := decodedPayload(stream); !reflect.DeepEqual(got, want) {
+					t.Errorf("decoded payload differs\n got: %+v\nwant: %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func validTestPacket(t *testing.T) []byte {
+	t.Helper()
+
+	at := time.Unix(0, 1700000000000000000)
+	w := NewPacketWriter(7, at)
+	for _, add := range testPacketStreams(at) {
+		add(w)
+	}
+	data, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	return data
+}
+
+func TestDecodePacketRejectsInvalidHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+		want   string
+	}{
+		{"short", func(b []byte) []byte { return b[:PacketHeaderSize-1] }, "too short"},
+		{"magic", func(b []byte) []byte { copy(b, "XXXX"); return b }, "magic"},
+		{"version zero", func(b []byte) []byte { binary.LittleEndian.PutUint16(b[4:], 0); return b }, "version"},
+		{"future version", func(b []byte) []byte { binary.LittleEndian.PutUint16(b[4:], PacketVersion+1); return b }, "version"},
+		{"too many streams", func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[24:], MaxStreamsPerPacket+1)
+			return b
+		}, "too many streams"},
+		{"trailing bytes", func(b []byte) []byte { return append(b, 0) }, "trailing"},
+		{"oversized stream", func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[PacketHeaderSize+4:], uint32(len(b)))
+			return b
+		}, "exceeds remaining"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.modify(validTestPacket(t))
+			_, err := DecodePacket(data)
+			if err == nil {
+				t.Fatalf("decoded an invalid packet")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// singleStreamPacket builds a packet around one raw stream payload.
+func singleStreamPacket(streamType, codec uint8, payload []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(PacketMagic)
+	putU16(&b, PacketVersion)
+	putU16(&b, 0)
+	putU64(&b, 1)
+	putU64(&b, 0)
+	putU16(&b, 1)
+	putU16(&b, 0)
+
+	b.Write([]byte{streamType, 0, codec, 0})
+	putU32(&b, uint32(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func TestDecodePacketRejectsInvalidCompression(t *testing.T) {
+	sized := func(size uint32, body ...byte) []byte {
+		var b bytes.Buffer
+		putU32(&b, size)
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		codec   uint8
+		payload []byte
+		want    string
+	}{
+		{"unknown codec", 0xff, sized(4, 1, 2, 3, 4), "unsupported compression"},
+		{"missing size", CodecZstd, []byte{1, 2}, "too short"},
+		{"oversized", CodecZstd, sized(MaxDecompressedStreamSize + 1), "exceeds limit"},
+		{"corrupt zstd", CodecZstd, sized(64, 1, 2, 3, 4, 5, 6, 7, 8), "zstd decompression failed"},
+		{"corrupt deflate", CodecDeflate, sized(64, 0xff, 0xff, 0xff), "deflate decompression failed"},
+		{"corrupt lz4", CodecLZ4, sized(64, 0xf0, 1), "lz4 decompression failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodePacket(singleStreamPacket(StreamTypePose, tt.codec, tt.payload))
+			if err == nil {
+				t.Fatalf("decoded a stream with invalid compression")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodePacketRejectsTruncatedPacket(t *testing.T) {
+	for _, codec := range []uint8{CodecNone, CodecZstd} {
+		at := time.Unix(0, 1700000000000000000)
+		w := NewPacketWriter(7, at)
+		w.SetCompression(codec)
+		for _, add := range testPacketStreams(at) {
+			add(w)
+		}
+		data, err := w.Bytes()
+		if err != nil {
+			t.Fatalf("failed to encode packet: %v", err)
+		}
+
+		for n := 0; n < len(data); n++ {
+			if _, err := DecodePacket(data[:n]); err == nil {
+				t.Fatalf("%s packet truncated to %d of %d bytes decoded without error", CodecName(codec), n, len(data))
+			}
+		}
+	}
+}
+
+func TestDecodePacketRejectsTruncatedStreamBody(t *testing.T) {
+	at := time.Unix(0, 1700000000000000000)
+	w := NewPacketWriter(1, at)
+	testPacketStreams(at)[StreamTypeMesh](w)
+	data, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+
+	// Shorten the stream and the packet together so only the mesh body is
+	// cut off
+	length := binary.LittleEndian.Uint32(data[PacketHeaderSize+4:])
+	binary.LittleEndian.PutUint32(data[PacketHeaderSize+4:], length-4)
+	if _, err := DecodePacket(data[:len(data)-4]); err == nil {
+		t.Fatalf("decoded a mesh stream with a truncated body")
+	}
+}
+
+func TestCheckNegotiatedCodecs(t *testing.T) {
+	at := time.Unix(0, 1700000000000000000)
+	streams := testPacketStreams(at)
+	session := &SessionState{Compression: map[string]string{"mesh": "zstd", "camera": "none"}}
+
+	tests := []struct {
+		name       string
+		streamType uint8
+		codec      uint8
+		session    *SessionState
+		ok         bool
+	}{
+		{"negotiated codec", StreamTypeMesh, CodecZstd, session, true},
+		{"other codec", StreamTypeMesh, CodecLZ4, session, false},
+		{"uncompressed", StreamTypeMesh, CodecNone, session, true},
+		{"compressed when none was negotiated", StreamTypeCamera, CodecZstd, session, false},
+		{"undeclared stream", StreamTypeDepth, CodecLZ4, session, true},
+		{"before the handshake", StreamTypeMesh, CodecLZ4, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewPacketWriter(1, at)
+			w.SetCompression(tt.codec)
+			streams[tt.streamType](w)
+			data, err := w.Bytes()
+			if err != nil {
+				t.Fatalf("failed to encode packet: %v", err)
+			}
+			packet, err := DecodePacket(data)
+			if err != nil {
+				t.Fatalf("failed to decode packet: %v", err)
+			}
+			if packet.Streams[0].Codec != tt.codec {
+				t.Fatalf("stream sent with codec %s, want %s", packet.Streams[0].Compression, CodecName(tt.codec))
+			}
+
+			if err := checkNegotiatedCodecs(packet, tt.session); (err == nil) != tt.ok {
+				t.Fatalf("checkNegotiatedCodecs = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCodecMismatchNacksFrame(t *testing.T) {
+	_, server := serveTestRelay(t)
+	conn, _ := dialTestRelay(t, server, "device_id=phone", nil)
+	handshakeTestRelay(t, conn, StreamConfig{Type: "mesh", Compression: "zstd"})
+
+	at := time.Unix(0, 1700000000000000000)
+	w := NewPacketWriter(9, at)
+	w.SetCompression(CodecLZ4)
+	testPacketStreams(at)[StreamTypeMesh](w)
+	data, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+
+	msg := readTestMessage(t, conn)
+	nackErr, _ := msg["error"].(map[string]interface{})
+	if msg["type"] != "frame_nack" || msg["frame_number"] != float64(9) || msg["retryable"] != false || nackErr["code"] != ErrCodeCodecMismatch {
+		t.Fatalf("frame with the wrong codec answered %v, want a codec_mismatch nack", msg)
+	}
+}
@@ -0,0 +1,46 @@
+package relay
+
+import "strings"
+
+// Stream priority classes. Under load the relay sheds low streams first,
+// then normal, then high; critical streams are never shed.
+const (
+	PriorityLow      = "low"
+	PriorityNormal   = "normal"
+	PriorityHigh     = "high"
+	PriorityCritical = "critical"
+)
+
+const criticalRank = 3
+
+var priorityRanks = map[string]int{
+	PriorityLow:      0,
+	PriorityNormal:   1,
+	PriorityHigh:     2,
+	PriorityCritical: criticalRank,
+}
+
+// streamPriorities maps stream types to priority ranks. Lookups ignore
+// case, since config keys are lowercased on load.
+type streamPriorities map[string]int
+
+func newStreamPriorities(classes map[string]string) streamPriorities {
+	priorities := make(streamPriorities, len(classes))
+	for streamType, class := range classes {
+		rank, ok := priorityRanks[strings.ToLower(class)]
+		if !ok {
+			rank = criticalRank
+		}
+		priorities[strings.ToLower(streamType)] = rank
+	}
+	return priorities
+}
+
+// rank returns the priority rank of a stream type. Unconfigured streams are
+// treated as critical so they are never shed by accident.
+func (p streamPriorities) rank(streamType string) int {
+	if rank, ok := p[strings.ToLower(streamType)]; ok {
+		return rank
+	}
+	return criticalRank
+}
@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrCodeInvalidResumeToken is sent in ResumeRejected when a reconnecting
+// client presents an unknown or expired token. The client should perform
+// a fresh handshake.
+const ErrCodeInvalidResumeToken = "invalid_resume_token"
+
+// DisconnectSuperseded is recorded when a client's identity is resumed by
+// a newer connection while the old one is still open.
+const DisconnectSuperseded = "superseded"
+
+// maxHeldMessages bounds the acks kept for a disconnected client.
+const maxHeldMessages = 1024
+
+// SessionResumed is sent instead of a handshake reply when a client
+// reconnects with a valid resume token. Acks for frames that completed
+// while it was away follow right after.
+type SessionResumed struct {
+	Type            string         `json:"type"`
+	ClientID        string         `json:"client_id"`
+	SessionID       string         `json:"session_id"`
+	DeviceID        string         `json:"device_id"`
+	Streams         []StreamConfig `json:"streams"`
+	TargetFPS       int            `json:"target_fps"`
+	LastFrameNumber uint64         `json:"last_frame_number"`
+	PendingAcks     int            `json:"pending_acks"`
+	ServerTime      time.Time      `json:"server_time"`
+}
+
+// ResumeRejected tells a reconnecting client its resume token was not
+// accepted. The connection stays open for a normal handshake.
+type ResumeRejected struct {
+	Type  string        `json:"type"`
+	Error ProtocolError `json:"error"`
+}
+
+// resumeState is a client identity that outlives its connection. Acks for
+// frames of a disconnected client are held here and replayed when it
+// resumes within the grace window.
+type resumeState struct {
+	token     string
+	clientID  string
+	sessionID string
+	deviceID  string
+
+	// Device ID of the key the identity was created with, "" if none
+	authDeviceID string
+
+	lastFrameNumber atomic.Uint64
+
+	mu      sync.Mutex
+	session *SessionState
+	client  *Client   // nil while disconnected
+	expires time.Time // only meaningful while disconnected
+	held    [][]byte
+}
+
+func newResumeToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// send delivers a message to the current connection, or holds it until
+// the client resumes.
+func (r *resumeState) send(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != nil {
+		if err := r.client.Send(websocket.TextMessage, data); err == nil {
+			return nil
+		}
+	}
+	if len(r.held) >= maxHeldMessages {
+		return fmt.Errorf("too many messages held for client %s", r.clientID)
+	}
+	r.held = append(r.held, data)
+	return nil
+}
+
+// detach marks the identity as disconnected, starting the grace window.
+// It is a no-op if client has already been replaced.
+func (r *resumeState) detach(client *Client, grace time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client != client {
+		return
+	}
+	r.client = nil
+	r.expires = time.Now().Add(grace)
+}
+
+func (r *resumeState) expired(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client == nil && now.After(r.expires)
+}
+
+// observeFrame records the highest frame number seen for this identity.
+func (r *resumeState) observeFrame(frameNumber uint64) {
+	for {
+		last := r.lastFrameNumber.Load()
+		if frameNumber <= last || r.lastFrameNumber.CompareAndSwap(last, frameNumber) {
+			return
+		}
+	}
+}
+
+// registerResume issues a resume token for a freshly handshaken client, or
+// updates the session of one that already has an identity.
+func (s *Service) registerResume(client *Client, session *SessionState) (string, error) {
+	if r := client.resume.Load(); r != nil {
+		r.mu.Lock()
+		r.session = session
+		r.mu.Unlock()
+		return r.token, nil
+	}
+
+	token, err := newResumeToken()
+	if err != nil {
+		return "", err
+	}
+	r := &resumeState{
+		token:     token,
+		clientID:  client.ID,
+		sessionID: client.SessionID,
+		deviceID:  client.DeviceID,
+		session:   session,
+		client:    client,
+	}
+	if client.Authenticated {
+		r.authDeviceID = client.DeviceID
+	}
+
+	s.resumesMux.Lock()
+	s.resumes[token] = r
+	s.resumesMux.Unlock()
+
+	client.resume.Store(r)
+	return token, nil
+}
+
+// lookupResume returns the identity for a token if it is still within its
+// grace window.
+func (s *Service) lookupResume(token string) *resumeState {
+	s.resumesMux.Lock()
+	defer s.resumesMux.Unlock()
+
+	r, ok := s.resumes[token]
+	if !ok || r.expired(time.Now()) {
+		return nil
+	}
+	return r
+}
+
+// resumeClient hands a resumed identity to a new connection, closing the
+// old connection if it is still open. session_resumed is sent first, then
+// the acks held while the client was away, before any new ones.
+func (s *Service) resumeClient(client *Client, r *resumeState) {
+	r.mu.Lock()
+	session := r.session
+	client.session.Store(session)
+	client.resume.Store(r)
+
+	previous := r.client
+	r.client = client
+	held := r.held
+	r.held = nil
+
+	streams := make([]StreamConfig, 0, len(session.Compression))
+	for streamType, compression := range session.Compression {
+		streams = append(streams, StreamConfig{Type: streamType, Compression: compression})
+	}
+	resumed := SessionResumed{
+		Type:            "session_resumed",
+		ClientID:        client.ID,
+		SessionID:       client.SessionID,
+		DeviceID:        client.DeviceID,
+		Streams:         streams,
+		TargetFPS:       session.TargetFPS,
+		LastFrameNumber: r.lastFrameNumber.Load(),
+		PendingAcks:     len(held),
+		ServerTime:      time.Now(),
+	}
+	if err := client.SendJSON(resumed); err != nil {
+		s.logger.Warn("Failed to send session_resumed", "client_id", client.ID, "error", err)
+	}
+	for _, data := range held {
+		if err := client.Send(websocket.TextMessage, data); err != nil {
+			s.logger.Warn("Failed to replay held ack", "client_id", client.ID, "error", err)
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if previous != nil {
+		previous.SetCloseReason(DisconnectSuperseded)
+		go previous.Close(websocket.CloseGoingAway, "resumed by a new connection")
+	}
+
+	s.logger.Info("Session resumed",
+		"client_id", client.ID,
+		"session_id", client.SessionID,
+		"last_frame_number", resumed.LastFrameNumber,
+		"pending_acks", len(held),
+		"superseded", previous != nil,
+	)
+}
+
+// expireResumes forgets identities whose grace window has passed.
+func (s *Service) expireResumes() {
+	now := time.Now()
+
+	s.resumesMux.Lock()
+	defer s.resumesMux.Unlock()
+
+	for token, r := range s.resumes {
+		if r.expired(now) {
+			delete(s.resumes, token)
+			s.logger.Debug("Resume token expired", "client_id", r.clientID)
+		}
+	}
+}
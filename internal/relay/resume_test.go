@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForResume polls an identity until cond holds.
+func waitForResume(t *testing.T, s *Service, token string, cond func(r *resumeState) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.resumesMux.Lock()
+		r := s.resumes[token]
+		s.resumesMux.Unlock()
+		if r != nil {
+			r.mu.Lock()
+			ok := cond(r)
+			r.mu.Unlock()
+			if ok {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("resume state of %s did not reach the expected state", token)
+}
+
+func sendTestPose(t *testing.T, conn *websocket.Conn, frameNumber uint64) {
+	t.Helper()
+
+	at := time.Unix(0, 1700000000000000000)
+	w := NewPacketWriter(frameNumber, at)
+	testPacketStreams(at)[StreamTypePose](w)
+	data, err := w.Bytes()
+	if err != nil {
+		t.Fatalf("failed to encode packet: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+}
+
+func TestResumeReplaysHeldAcks(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	stag := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"trace_id": "t"})
+	}))
+	defer stag.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	s := newTestService(t, stag.URL, openTestOutbox(t))
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+
+	conn, _ := dialTestRelay(t, server, "device_id=phone", nil)
+	accepted := handshakeTestRelay(t, conn)
+	token, _ := accepted["resume_token"].(string)
+	if token == "" || accepted["resume_grace_seconds"] != s.config.RelayResumeGrace.Seconds() {
+		t.Fatalf("session_accepted = %v, want a resume token and the grace window", accepted)
+	}
+
+	// The frame is still at Stag when the device drops off
+	sendTestPose(t, conn, 5)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("frame never reached stag")
+	}
+	conn.Close()
+	waitForResume(t, s, token, func(r *resumeState) bool { return r.client == nil })
+
+	close(release)
+	waitForResume(t, s, token, func(r *resumeState) bool { return len(r.held) == 1 })
+
+	resumed, _ := dialTestRelay(t, server, "device_id=phone&resume_token="+token, nil)
+	msg := readTestMessage(t, resumed)
+	if msg["type"] != "session_resumed" || msg["client_id"] != accepted["client_id"] {
+		t.Fatalf("reconnect answered %v, want session_resumed as %v", msg, accepted["client_id"])
+	}
+	if msg["pending_acks"] != float64(1) || msg["last_frame_number"] != float64(5) {
+		t.Fatalf("session_resumed reports %v pending acks after frame %v, want 1 after 5", msg["pending_acks"], msg["last_frame_number"])
+	}
+	ack := readTestMessage(t, resumed)
+	if ack["type"] != "frame_ack" || ack["frame_number"] != float64(5) || ack["status"] != AckStatusDelivered {
+		t.Fatalf("held ack = %v, want frame 5 delivered", ack)
+	}
+
+	// The resumed connection gets acks directly
+	sendTestPose(t, resumed, 6)
+	<-received
+	if ack := readTestMessage(t, resumed); ack["type"] != "frame_ack" || ack["frame_number"] != float64(6) {
+		t.Fatalf("ack after resuming = %v, want frame 6", ack)
+	}
+}
+
+func TestExpiredResumeTokenGetsFreshIdentity(t *testing.T) {
+	s := newTestService(t, "", openTestOutbox(t))
+	s.config.RelayResumeGrace = 20 * time.Millisecond
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+
+	conn, _ := dialTestRelay(t, server, "device_id=phone", nil)
+	accepted := handshakeTestRelay(t, conn)
+	token := accepted["resume_token"].(string)
+	conn.Close()
+	waitForResume(t, s, token, func(r *resumeState) bool { return r.client == nil })
+	time.Sleep(2 * s.config.RelayResumeGrace)
+
+	again, _ := dialTestRelay(t, server, "device_id=phone&resume_token="+token, nil)
+	msg := readTestMessage(t, again)
+	if msg["type"] != "resume_rejected" {
+		t.Fatalf("expired token answered %v, want resume_rejected", msg)
+	}
+	if code := msg["error"].(map[string]interface{})["code"]; code != ErrCodeInvalidResumeToken {
+		t.Fatalf("resume_rejected code = %v, want %s", code, ErrCodeInvalidResumeToken)
+	}
+
+	// Client IDs only have second resolution, so the token marks the new identity
+	fresh := handshakeTestRelay(t, again)
+	if next, _ := fresh["resume_token"].(string); next == "" || next == token {
+		t.Fatalf("handshake after an expired token issued token %v, want a new one", fresh["resume_token"])
+	}
+
+	// The keepalive sweep forgets the old identity
+	s.expireResumes()
+	s.resumesMux.Lock()
+	_, kept := s.resumes[token]
+	s.resumesMux.Unlock()
+	if kept {
+		t.Fatalf("expired token is still registered after the sweep")
+	}
+}
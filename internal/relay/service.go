@@ -2,16 +2,19 @@ package relay
 
 import (
 	"bytes"
-	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/tabular/local-pipeline/internal/certs"
 	"github.com/tabular/local-pipeline/internal/config"
 	"github.com/tabular/local-pipeline/internal/logging"
 	"github.com/tabular/local-pipeline/internal/storage"
@@ -24,32 +27,96 @@ type Service struct {
 	clients    map[string]*Client
 	clientsMux sync.RWMutex
 	StartTime  time.Time
-}
 
-type Client struct {
-	ID         string
-	Conn       *websocket.Conn
-	SessionID  string
-	DeviceID   string
-	RemoteAddr string
-	StartTime  time.Time
-	LastPing   time.Time
-	EventCount int64
-	BytesReceived int64
+	outbox     *Outbox
+	devices    *DeviceRegistry
+	coalescer  *Coalescer
+	priorities streamPriorities
+	httpClient *http.Client
+	batchSeq   atomic.Uint64
+	stop       chan struct{}
+	drained    chan struct{}
+	reaped     chan struct{}
+
+	resumes    map[string]*resumeState
+	resumesMux sync.Mutex
+
+	feeds    map[string]*sessionFeed
+	feedsMux sync.Mutex
+
+	disconnectsMux    sync.Mutex
+	disconnectCounts  map[string]int64
+	recentDisconnects []disconnectRecord
 }
 
-func NewService(cfg *config.Config, logger *logging.Logger) *Service {
-	return &Service{
-		config:    cfg,
-		logger:    logger,
+func NewService(cfg *config.Config, logger *logging.Logger, outbox *Outbox, devices *DeviceRegistry) *Service {
+	s := &Service{
+		config: cfg,
+		logger: logger,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for local development
 			},
 		},
-		clients:   make(map[string]*Client),
-		StartTime: time.Now(),
+		clients:    make(map[string]*Client),
+		StartTime:  time.Now(),
+		outbox:     outbox,
+		devices:    devices,
+		priorities: newStreamPriorities(cfg.RelayStreamPriorities),
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        32,
+				MaxIdleConnsPerHost: 8,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		stop:             make(chan struct{}),
+		drained:          make(chan struct{}),
+		reaped:           make(chan struct{}),
+		disconnectCounts: make(map[string]int64),
+		resumes:          make(map[string]*resumeState),
+		feeds:            make(map[string]*sessionFeed),
+	}
+
+	// Trust the local CA when Stag serves a generated certificate
+	if cfg.TLSCAFile != "" {
+		pool, err := certs.CertPool(cfg.TLSCAFile)
+		if err != nil {
+			logger.Warn("Failed to load CA for Stag connections", "ca_file", cfg.TLSCAFile, "error", err)
+		} else {
+			s.httpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
 	}
+
+	s.coalescer = NewCoalescer(logger, cfg.RelayBatchMaxFrames, cfg.RelayBatchMaxBytes, cfg.RelayBatchInterval, s.deliverFrames)
+	go s.drainOutbox()
+	go s.reapIdleClients()
+
+	return s
+}
+
+// Stop disconnects all clients, flushes frames still being coalesced and
+// ends outbox delivery. Queued batches stay on disk for the next run.
+func (s *Service) Stop() {
+	s.clientsMux.RLock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.clientsMux.RUnlock()
+	for _, client := range clients {
+		client.SetCloseReason(DisconnectShutdown)
+		client.Close(websocket.CloseGoingAway, "relay shutting down")
+	}
+
+	s.stopSessionFeeds()
+	s.coalescer.Stop()
+	close(s.stop)
+	<-s.drained
+	<-s.reaped
+	s.httpClient.CloseIdleConnections()
 }
 
 func (s *Service) Handler() http.Handler {
@@ -64,6 +131,13 @@ func (s *Service) Handler() http.Handler {
 	// Stats endpoint
 	router.HandleFunc("/stats", s.handleStats).Methods("GET")
 
+	// Device key administration
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(s.requireAdmin)
+	adminRouter.HandleFunc("/devices", s.handleListDevices).Methods("GET")
+	adminRouter.HandleFunc("/devices", s.handleIssueDeviceKey).Methods("POST")
+	adminRouter.HandleFunc("/devices/{device_id}", s.handleRevokeDevice).Methods("DELETE")
+
 	// Enable CORS
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -107,6 +181,7 @@ func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
 		"uptime":             time.Since(s.StartTime).String(),
 		"active_connections": activeClients,
 		"stag_endpoint":      s.config.RelayEndpoint,
+		"outbox_depth":       s.outbox.Depth(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -119,30 +194,67 @@ func (s *Service) handleStats(w http.ResponseWriter, r *http.Request) {
 
 	var totalEvents int64
 	var totalBytes int64
+	var totalDropped int64
+	droppedByType := make(map[string]int64)
 	clients := make([]map[string]interface{}, 0, len(s.clients))
 
 	for _, client := range s.clients {
+		queue := client.queue.stats()
+		session := client.Session()
+		var sdkVersion string
+		var targetFPS int
+		var compression map[string]string
+		if session != nil {
+			sdkVersion, targetFPS, compression = session.SDKVersion, session.TargetFPS, session.Compression
+		}
 		clients = append(clients, map[string]interface{}{
-			"id":             client.ID,
-			"session_id":     client.SessionID,
-			"device_id":      client.DeviceID,
-			"remote_addr":    client.RemoteAddr,
-			"start_time":     client.StartTime.Format(time.RFC3339),
-			"last_ping":      client.LastPing.Format(time.RFC3339),
-			"event_count":    client.EventCount,
-			"bytes_received": client.BytesReceived,
-			"uptime":         time.Since(client.StartTime).String(),
+			"id":              client.ID,
+			"session_id":      client.SessionID,
+			"device_id":       client.DeviceID,
+			"authenticated":   client.Authenticated,
+			"remote_addr":     client.RemoteAddr,
+			"start_time":      client.StartTime.Format(time.RFC3339),
+			"last_ping":       client.LastPing().Format(time.RFC3339),
+			"last_message":    client.LastMessage().Format(time.RFC3339),
+			"event_count":     client.EventCount(),
+			"bytes_received":  client.BytesReceived(),
+			"handshaken":      session != nil,
+			"sdk_version":     sdkVersion,
+			"target_fps":      targetFPS,
+			"compression":     compression,
+			"queue_depth":     queue.Depth,
+			"queue_capacity":  queue.Capacity,
+			"throttled":       queue.Throttled,
+			"dropped_frames":  queue.DroppedFrames,
+			"dropped_events":  queue.DroppedEvents,
+			"dropped_by_type": queue.DroppedByType,
+			"sync_sent":       client.syncSent.Load(),
+			"sync_dropped":    client.syncDropped.Load(),
+			"uptime":          time.Since(client.StartTime).String(),
 		})
-		totalEvents += client.EventCount
-		totalBytes += client.BytesReceived
+		totalEvents += client.EventCount()
+		totalBytes += client.BytesReceived()
+		totalDropped += queue.DroppedEvents
+		for streamType, count := range queue.DroppedByType {
+			droppedByType[streamType] += count
+		}
 	}
 
+	disconnects, recentDisconnects := s.disconnectStats()
+
 	stats := map[string]interface{}{
 		"service_uptime":     time.Since(s.StartTime).String(),
 		"active_connections": len(s.clients),
 		"total_events":       totalEvents,
 		"total_bytes":        totalBytes,
+		"total_dropped":      totalDropped,
+		"dropped_by_type":    droppedByType,
+		"outbox_depth":       s.outbox.Depth(),
+		"outbox_quarantined": s.outbox.Quarantined(),
 		"clients":            clients,
+		"disconnects":        disconnects,
+		"recent_disconnects": recentDisconnects,
+		"sync_sessions":      s.syncSessions(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -153,6 +265,59 @@ func (s *Service) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
 	sessionID := r.URL.Query().Get("session_id")
 	deviceID := r.URL.Query().Get("device_id")
+	resumeToken := r.URL.Query().Get("resume_token")
+
+	// An authenticated device's identity comes from its key, not the query
+	device, err := s.authenticateDevice(r)
+	if err != nil {
+		s.logger.Warn("Rejected device key", "remote_addr", r.RemoteAddr, "device_id", deviceID, "error", err)
+		http.Error(w, "Invalid device key", http.StatusUnauthorized)
+		return
+	}
+	if device == nil && s.config.RelayAuthRequired {
+		s.logger.Warn("Rejected unauthenticated device", "remote_addr", r.RemoteAddr, "device_id", deviceID)
+		http.Error(w, "Device key required", http.StatusUnauthorized)
+		return
+	}
+	// Without a key, a device may not claim the ID of a registered one
+	if device == nil && deviceID != "" {
+		_, err := s.devices.Get(deviceID)
+		if err == nil {
+			s.logger.Warn("Rejected unauthenticated registered device", "remote_addr", r.RemoteAddr, "device_id", deviceID)
+			http.Error(w, "Device key required", http.StatusUnauthorized)
+			return
+		}
+		if !errors.Is(err, ErrDeviceNotFound) {
+			s.logger.Error("Failed to look up device", "device_id", deviceID, "error", err)
+			http.Error(w, "Failed to look up device", http.StatusInternalServerError)
+			return
+		}
+	}
+	authDeviceID := ""
+	if device != nil {
+		if deviceID != "" && deviceID != device.DeviceID {
+			s.logger.Warn("Ignoring device_id that does not match the device key",
+				"requested", deviceID,
+				"device_id", device.DeviceID,
+			)
+		}
+		deviceID = device.DeviceID
+		authDeviceID = device.DeviceID
+	}
+
+	// A valid resume token reclaims the identity of an earlier connection,
+	// as long as it is presented by the same authenticated device
+	var resume *resumeState
+	if resumeToken != "" {
+		resume = s.lookupResume(resumeToken)
+	}
+	if resume != nil && resume.authDeviceID != authDeviceID {
+		resume = nil
+	}
+	if resume != nil {
+		sessionID = resume.sessionID
+		deviceID = resume.deviceID
+	}
 
 	if sessionID == "" {
 		sessionID = fmt.Sprintf("session_%d", time.Now().Unix())
@@ -167,41 +332,75 @@ func (s *Service) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("WebSocket upgrade failed", "error", err)
 		return
 	}
+	conn.SetReadLimit(int64(s.config.MaxMessageSize))
 
 	clientID := fmt.Sprintf("%s_%s_%d", sessionID, deviceID, time.Now().Unix())
-	client := &Client{
-		ID:         clientID,
-		Conn:       conn,
-		SessionID:  sessionID,
-		DeviceID:   deviceID,
-		RemoteAddr: r.RemoteAddr,
-		StartTime:  time.Now(),
-		LastPing:   time.Now(),
+	if resume != nil {
+		clientID = resume.clientID
 	}
+	client := newClient(conn, clientID, sessionID, deviceID, r.RemoteAddr, s.config.RelayPingInterval, s.config.RelayWriteWait)
+	client.Authenticated = device != nil
+	s.extendReadDeadline(client)
+	conn.SetPongHandler(func(string) error {
+		client.recordPong()
+		s.extendReadDeadline(client)
+		return nil
+	})
+	client.queue = newFrameQueue(s.config.RelayClientQueueSize, s.config.RelayDropPolicy, s.priorities)
+	go s.forwardQueuedFrames(client)
 
 	s.clientsMux.Lock()
 	s.clients[clientID] = client
 	s.clientsMux.Unlock()
+	s.joinSessionFeed(sessionID)
 
 	s.logger.Info("WebSocket client connected",
 		"client_id", clientID,
 		"session_id", sessionID,
 		"device_id", deviceID,
 		"remote_addr", r.RemoteAddr,
+		"authenticated", client.Authenticated,
+		"resumed", resume != nil,
 	)
 
+	if resume != nil {
+		s.resumeClient(client, resume)
+	} else if resumeToken != "" {
+		client.SendJSON(ResumeRejected{
+			Type: "resume_rejected",
+			Error: ProtocolError{
+				Code:    ErrCodeInvalidResumeToken,
+				Message: "resume token is unknown or expired, start a new session",
+			},
+		})
+	}
+
 	defer func() {
 		s.clientsMux.Lock()
-		delete(s.clients, clientID)
+		// A resumed connection may already have taken over this ID
+		if s.clients[clientID] == client {
+			delete(s.clients, clientID)
+		}
 		s.clientsMux.Unlock()
-		
-		conn.Close()
+		s.leaveSessionFeed(sessionID)
+
+		if r := client.resume.Load(); r != nil {
+			r.detach(client, s.config.RelayResumeGrace)
+		}
+
+		// Let queued frames reach the coalescer so they can still be acked
+		client.queue.close()
+		<-client.forwarded
+
+		client.Close(websocket.CloseNormalClosure, "")
+		s.recordDisconnect(client)
 		s.logger.Info("WebSocket client disconnected",
 			"client_id", clientID,
 			"session_id", sessionID,
 			"device_id", deviceID,
-			"events_processed", client.EventCount,
-			"bytes_received", client.BytesReceived,
+			"reason", client.CloseReason(),
+			"events_processed", client.EventCount(),
+			"bytes_received", client.BytesReceived(),
 		)
 	}()
 
@@ -209,14 +408,16 @@ func (s *Service) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	for {
 		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			reason := readErrorReason(err)
+			if reason == DisconnectReadError && websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				s.logger.Error("WebSocket read error", "client_id", clientID, "error", err)
 			}
+			client.SetCloseReason(reason)
 			break
 		}
 
-		client.LastPing = time.Now()
-		client.BytesReceived += int64(len(data))
+		client.recordMessage(len(data))
+		s.extendReadDeadline(client)
 
 		switch messageType {
 		case websocket.BinaryMessage:
@@ -233,8 +434,6 @@ func (s *Service) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 					"error", err,
 				)
 			}
-		case websocket.PingMessage:
-			conn.WriteMessage(websocket.PongMessage, []byte{})
 		}
 	}
 }
@@ -253,19 +452,14 @@ func (s *Service) processTextMessage(client *Client, data []byte) error {
 
 	switch msgType {
 	case "session_info":
-		s.logger.Info("Received session info", 
-			"client_id", client.ID,
-			"session_id", client.SessionID,
-			"streams", msg["streams"],
-		)
+		return s.handleSessionInfo(client, data)
 	case "ping":
 		// Send pong
 		response := map[string]interface{}{
 			"type": "pong",
 			"timestamp": time.Now().Format(time.RFC3339),
 		}
-		responseData, _ := json.Marshal(response)
-		client.Conn.WriteMessage(websocket.TextMessage, responseData)
+		return client.SendJSON(response)
 	default:
 		s.logger.Debug("Unknown message type", "type", msgType, "client_id", client.ID)
 	}
@@ -277,74 +471,196 @@ func (s *Service) processBinaryMessage(client *Client, data []byte) error {
 	// Parse binary StreamKit packet
 	packet, err := s.parseStreamKitPacket(data)
 	if err != nil {
+		s.sendFrameNack(client, peekFrameNumber(data), "", ErrCodeInvalidPacket, err, false)
 		return fmt.Errorf("failed to parse StreamKit packet: %w", err)
 	}
+	if err := checkNegotiatedCodecs(packet, client.Session()); err != nil {
+		s.sendFrameNack(client, packet.FrameNumber, "", ErrCodeCodecMismatch, err, false)
+		return err
+	}
 
 	// Convert to spatial events
 	events := s.convertToSpatialEvents(packet, client)
+	if len(events) == 0 {
+		s.logger.Debug("Packet contained no decodable streams",
+			"client_id", client.ID,
+			"frame_number", packet.FrameNumber,
+		)
+		s.sendFrameAck(client, packet.FrameNumber, "", AckStatusDelivered, "", 0, 0)
+		return nil
+	}
 
-	// Create ingest batch
-	batch := &storage.IngestBatch{
-		BatchID:    fmt.Sprintf("batch_%s_%d", client.ID, time.Now().Unix()),
-		Events:     events,
-		Timestamp:  time.Now(),
-		RelayID:    "local-relay",
-		ProcessingInfo: storage.ProcessingInfo{
-			ReceivedAt:  time.Now(),
-			ProcessedAt: time.Now(),
-			Relay:       "local-relay",
+	frame := &pendingFrame{
+		client:      client,
+		frameNumber: packet.FrameNumber,
+		events:      events,
+		info: storage.ProcessingInfo{
+			ReceivedAt: time.Now(),
+			Relay:      "local-relay",
 		},
+		size: len(data),
+	}
+	for _, stream := range packet.Streams {
+		if stream.Codec != CodecNone {
+			addCompression(&frame.info, stream.Compression, stream.OriginalSize, stream.CompressedSize)
+		}
 	}
 
-	// Forward to Stag service
-	if err := s.forwardToStag(batch); err != nil {
-		return fmt.Errorf("failed to forward to stag: %w", err)
+	// Blocks only when the queue is full of frames that may not be dropped
+	if r := client.resume.Load(); r != nil {
+		r.observeFrame(packet.FrameNumber)
 	}
 
-	client.EventCount += int64(len(events))
+	dropped, slowDown := client.queue.push(frame)
+	if slowDown {
+		s.sendFlowControl(client, FlowActionSlowDown)
+	}
+	for _, d := range dropped {
+		s.sendFrameNack(client, d.frameNumber, "", ErrCodeFrameDropped, fmt.Errorf("frame shed under load"), false)
+	}
+	if len(dropped) > 0 {
+		s.logger.Debug("Shed frames under load",
+			"client_id", client.ID,
+			"frames", len(dropped),
+			"policy", s.config.RelayDropPolicy,
+		)
+	}
+	client.addEvents(len(frame.events))
 
-	s.logger.Info("Processed StreamKit packet",
+	s.logger.Debug("Queued StreamKit frame for coalescing",
 		"client_id", client.ID,
 		"session_id", client.SessionID,
 		"frame_number", packet.FrameNumber,
-		"events", len(events),
+		"events", len(frame.events),
 	)
 
 	return nil
 }
 
-func (s *Service) parseStreamKitPacket(data []byte) (*StreamKitPacket, error) {
-	if len(data) < 16 {
-		return nil, fmt.Errorf("packet too short")
+// deliverFrames merges coalesced frames into a single ingest batch and
+// forwards it to Stag, falling back to the outbox. Every frame is acked with
+// the shared batch ID.
+func (s *Service) deliverFrames(frames []*pendingFrame) {
+	batch := &storage.IngestBatch{
+		BatchID:   s.nextBatchID(),
+		Timestamp: time.Now(),
+		RelayID:   "local-relay",
+		ProcessingInfo: storage.ProcessingInfo{
+			ReceivedAt: frames[0].info.ReceivedAt,
+			Relay:      "local-relay",
+		},
+	}
+	for _, frame := range frames {
+		batch.Events = append(batch.Events, frame.events...)
+		if frame.info.Compressed {
+			addCompression(&batch.ProcessingInfo, frame.info.CompressionType, frame.info.OriginalSize, frame.info.CompressedSize)
+		}
+	}
+	batch.ProcessingInfo.ProcessedAt = time.Now()
+	batch.ProcessingInfo.ProcessingTime = batch.ProcessingInfo.ProcessedAt.Sub(batch.ProcessingInfo.ReceivedAt)
+
+	// Queue behind batches already waiting so delivery order is preserved
+	if s.outbox.Depth() > 0 {
+		s.queueBatch(batch, frames, nil)
+		return
+	}
+
+	result, err := s.forwardToStag(batch)
+	if err != nil {
+		if isRetryableForwardError(err) {
+			s.queueBatch(batch, frames, err)
+			return
+		}
+		s.logger.Error("Stag rejected batch",
+			"batch_id", batch.BatchID,
+			"frames", len(frames),
+			"error", err,
+		)
+		for _, frame := range frames {
+			s.sendFrameNack(frame.client, frame.frameNumber, batch.BatchID, ErrCodeStagRejected, err, false)
+		}
+		return
+	}
+
+	for _, frame := range frames {
+		s.sendFrameAck(frame.client, frame.frameNumber, batch.BatchID, AckStatusDelivered, result.TraceID, len(frame.events), frame.dropped)
+	}
+
+	s.logger.Info("Forwarded coalesced batch",
+		"batch_id", batch.BatchID,
+		"frames", len(frames),
+		"events", len(batch.Events),
+		"trace_id", result.TraceID,
+	)
+}
+
+// queueBatch persists a batch Stag could not take right now. Its frames are
+// acked as queued; they are only nacked if the outbox itself fails.
+func (s *Service) queueBatch(batch *storage.IngestBatch, frames []*pendingFrame, cause error) {
+	if err := s.outbox.Enqueue(batch); err != nil {
+		s.logger.Error("Failed to queue batch", "batch_id", batch.BatchID, "error", err)
+		for _, frame := range frames {
+			s.sendFrameNack(frame.client, frame.frameNumber, batch.BatchID, ErrCodeStagUnavailable, err, true)
+		}
+		return
 	}
 
-	// Simple packet parsing - in real implementation, this would be more sophisticated
-	packet := &StreamKitPacket{
-		Magic:       string(data[:4]),
-		Version:     1,
-		FrameNumber: uint64(time.Now().Unix()),
-		Timestamp:   time.Now(),
-		Streams:     []StreamData{},
+	for _, frame := range frames {
+		s.sendFrameAck(frame.client, frame.frameNumber, batch.BatchID, AckStatusQueued, "", len(frame.events), frame.dropped)
 	}
 
-	// For now, create a mock mesh stream
-	stream := StreamData{
-		Type: "mesh",
-		Data: data[16:], // Rest of the data
+	if cause != nil {
+		s.logger.Warn("📦 Stag unavailable, batch queued in outbox",
+			"batch_id", batch.BatchID,
+			"frames", len(frames),
+			"queued", s.outbox.Depth(),
+			"error", cause,
+		)
 	}
-	packet.Streams = append(packet.Streams, stream)
+}
 
-	return packet, nil
+// nextBatchID returns an ID unique across the relay's lifetime, even for
+// several batches within the same second.
+func (s *Service) nextBatchID() string {
+	return fmt.Sprintf("batch_local-relay_%d_%d", s.StartTime.UnixNano(), s.batchSeq.Add(1))
+}
+
+// addCompression folds one compressed stream or frame into info, marking the
+// codec as "mixed" when more than one is seen.
+func addCompression(info *storage.ProcessingInfo, compression string, originalSize, compressedSize int) {
+	info.Compressed = true
+	info.OriginalSize += originalSize
+	info.CompressedSize += compressedSize
+	if info.CompressionType == "" {
+		info.CompressionType = compression
+	} else if info.CompressionType != compression {
+		info.CompressionType = "mixed"
+	}
+}
+
+func (s *Service) parseStreamKitPacket(data []byte) (*StreamKitPacket, error) {
+	return DecodePacket(data)
 }
 
 func (s *Service) convertToSpatialEvents(packet *StreamKitPacket, client *Client) []storage.SpatialEvent {
 	events := []storage.SpatialEvent{}
+	session := client.Session()
 
 	for _, stream := range packet.Streams {
+		if session != nil {
+			if _, declared := session.Compression[stream.Type]; !declared {
+				s.logger.Debug("Skipping stream not declared in handshake",
+					"client_id", client.ID,
+					"stream_type", stream.Type,
+				)
+				continue
+			}
+		}
+
 		event := storage.SpatialEvent{
 			EventID:     fmt.Sprintf("event_%s_%d_%s", client.ID, packet.FrameNumber, stream.Type),
 			EventType:   stream.Type,
-			Timestamp:   packet.Timestamp,
+			Timestamp:   stream.Timestamp,
 			ServerTime:  time.Now(),
 			SessionID:   client.SessionID,
 			ClientID:    client.ID,
@@ -358,29 +674,38 @@ func (s *Service) convertToSpatialEvents(packet *StreamKitPacket, client *Client
 			},
 		}
 
+		if stream.Codec != CodecNone {
+			event.ProcessingInfo.Compressed = true
+			event.ProcessingInfo.CompressionType = stream.Compression
+			event.ProcessingInfo.OriginalSize = stream.OriginalSize
+			event.ProcessingInfo.CompressedSize = stream.CompressedSize
+		}
+
 		// Add stream-specific data
-		switch stream.Type {
-		case "mesh":
-			event.MeshData = &storage.MeshData{
-				AnchorID:   fmt.Sprintf("anchor_%s_%d", client.DeviceID, packet.FrameNumber),
-				Vertices:   []float64{0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 0.0, 1.0, 0.0},
-				Faces:      []uint32{0, 1, 2},
-				Transform:  &storage.Transform{Translation: [3]float64{0, 0, 0}, Rotation: [4]float64{0, 0, 0, 1}, Scale: [3]float64{1, 1, 1}},
-			}
-		case "pose":
-			event.PoseData = &storage.PoseData{
-				Transform: &storage.Transform{Translation: [3]float64{0, 0, 0}, Rotation: [4]float64{0, 0, 0, 1}, Scale: [3]float64{1, 1, 1}},
-			}
-		case "camera":
-			event.CameraData = &storage.CameraData{
-				ImageData:  stream.Data,
-				Width:      640,
-				Height:     480,
-				Format:     "jpeg",
-				Intrinsics: [9]float64{500, 0, 320, 0, 500, 240, 0, 0, 1},
-				Transform:  &storage.Transform{Translation: [3]float64{0, 0, 0}, Rotation: [4]float64{0, 0, 0, 1}, Scale: [3]float64{1, 1, 1}},
-				Timestamp:  packet.Timestamp,
+		event.Transform = stream.Transform
+		switch {
+		case stream.Mesh != nil:
+			event.MeshData = stream.Mesh
+		case stream.Pose != nil:
+			event.PoseData = stream.Pose
+			if event.Transform == nil {
+				event.Transform = stream.Pose.Transform
 			}
+		case stream.Camera != nil:
+			event.CameraData = stream.Camera
+		case stream.Depth != nil:
+			event.DepthData = stream.Depth
+		case stream.PointCloud != nil:
+			event.PointCloudData = stream.PointCloud
+		case stream.Lighting != nil:
+			event.LightingData = stream.Lighting
+		default:
+			s.logger.Debug("Skipping undecoded stream",
+				"client_id", client.ID,
+				"stream_type", stream.Type,
+				"bytes", len(stream.Data),
+			)
+			continue
 		}
 
 		events = append(events, event)
@@ -389,59 +714,88 @@ func (s *Service) convertToSpatialEvents(packet *StreamKitPacket, client *Client
 	return events
 }
 
-func (s *Service) forwardToStag(batch *storage.IngestBatch) error {
+// ingestResult is the part of Stag's ingest response the relay cares about.
+type ingestResult struct {
+	BatchID   string `json:"batch_id"`
+	Processed int    `json:"processed"`
+	TraceID   string `json:"trace_id"`
+}
+
+func (s *Service) forwardToStag(batch *storage.IngestBatch) (*ingestResult, error) {
 	// Serialize batch
 	jsonData, err := json.Marshal(batch)
 	if err != nil {
-		return fmt.Errorf("failed to marshal batch: %w", err)
+		return nil, fmt.Errorf("failed to marshal batch: %w", err)
 	}
 
 	// Create HTTP request
 	req, err := http.NewRequest("POST", s.config.RelayEndpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "tabular-relay/1.0.0")
 
-	// Send request with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := client.Do(req.WithContext(ctx))
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer resp.Body.Close()
+	defer func() {
+		// Drain so the keep-alive connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("stag service returned status %d: %s", resp.StatusCode, string(body))
+		return nil, &stagStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var result ingestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		// The batch was accepted; only the trace ID is lost
+		s.logger.Warn("Failed to decode stag ingest response", "batch_id", batch.BatchID, "error", err)
 	}
 
 	s.logger.Debug("Forwarded batch to stag",
 		"batch_id", batch.BatchID,
 		"events", len(batch.Events),
+		"trace_id", result.TraceID,
 		"endpoint", s.config.RelayEndpoint,
 	)
 
-	return nil
+	return &result, nil
 }
 
 type StreamKitPacket struct {
 	Magic       string
 	Version     uint16
+	Flags       uint16
 	FrameNumber uint64
 	Timestamp   time.Time
 	Streams     []StreamData
 }
 
 type StreamData struct {
-	Type string
-	Data []byte
-}
\ No newline at end of file
+	Type      string
+	TypeID    uint8
+	Flags     uint8
+	Data      []byte
+	Timestamp time.Time
+	Transform *storage.Transform
+
+	// Compression as received on the wire; Data is always decompressed
+	Codec          uint8
+	Compression    string
+	CompressedSize int
+	OriginalSize   int
+
+	// Decoded payload, set according to Type
+	Mesh       *storage.MeshData
+	Pose       *storage.PoseData
+	Camera     *storage.CameraData
+	Depth      *storage.DepthData
+	PointCloud *storage.PointCloudData
+	Lighting   *storage.LightingData
+}
@@ -0,0 +1,297 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Handshake limits
+const (
+	MinSDKVersion = "1.0.0"
+	MinTargetFPS  = 1
+	MaxTargetFPS  = 120
+)
+
+// Handshake error codes sent in SessionRejected
+const (
+	ErrCodeInvalidMessage        = "invalid_message"
+	ErrCodeUnsupportedSDKVersion = "unsupported_sdk_version"
+	ErrCodeInvalidStreams        = "invalid_streams"
+	ErrCodeInvalidTargetFPS      = "invalid_target_fps"
+)
+
+// SessionInfo is the first text message a StreamKit client sends after
+// connecting, describing the streams it is about to send.
+type SessionInfo struct {
+	Type       string         `json:"type"`
+	SessionID  string         `json:"sessionID"`
+	Streams    []StreamConfig `json:"streams"`
+	TargetFPS  int            `json:"targetFPS"`
+	SDKVersion string         `json:"sdkVersion"`
+}
+
+type StreamConfig struct {
+	Type        string `json:"type"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// SessionAccepted is the relay's reply to a valid SessionInfo. It is the
+// configuration the client must stream with.
+type SessionAccepted struct {
+	Type                 string         `json:"type"`
+	ClientID             string         `json:"client_id"`
+	ResumeToken          string         `json:"resume_token"`
+	ResumeGraceSeconds   int            `json:"resume_grace_seconds"`
+	SessionID            string         `json:"session_id"`
+	DeviceID             string         `json:"device_id"`
+	ProtocolVersion      int            `json:"protocol_version"`
+	Streams              []StreamConfig `json:"streams"`
+	TargetFPS            int            `json:"target_fps"`
+	MaxMessageSize       int            `json:"max_message_size"`
+	SupportedCompression []string       `json:"supported_compression"`
+	ServerTime           time.Time      `json:"server_time"`
+}
+
+// SessionRejected is sent instead of SessionAccepted when the handshake
+// fails. The relay closes the connection right after sending it.
+type SessionRejected struct {
+	Type  string        `json:"type"`
+	Error ProtocolError `json:"error"`
+}
+
+type ProtocolError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (s *Service) handleSessionInfo(client *Client, data []byte) error {
+	var info SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return s.rejectSession(client, &ProtocolError{
+			Code:    ErrCodeInvalidMessage,
+			Message: fmt.Sprintf("failed to parse session_info: %v", err),
+		})
+	}
+
+	if perr := validateSessionInfo(&info); perr != nil {
+		return s.rejectSession(client, perr)
+	}
+
+	accepted := SessionAccepted{
+		Type:                 "session_accepted",
+		ClientID:             client.ID,
+		SessionID:            client.SessionID,
+		DeviceID:             client.DeviceID,
+		ProtocolVersion:      PacketVersion,
+		Streams:              negotiateStreams(info.Streams),
+		TargetFPS:            info.TargetFPS,
+		MaxMessageSize:       s.config.MaxMessageSize,
+		SupportedCompression: SupportedCompression,
+		ServerTime:           time.Now(),
+	}
+
+	session := &SessionState{
+		SDKVersion:  info.SDKVersion,
+		TargetFPS:   info.TargetFPS,
+		Compression: make(map[string]string, len(accepted.Streams)),
+	}
+	for _, stream := range accepted.Streams {
+		session.Compression[stream.Type] = stream.Compression
+	}
+	client.session.Store(session)
+
+	token, err := s.registerResume(client, session)
+	if err != nil {
+		// The session still works, it just cannot be resumed
+		s.logger.Error("Failed to issue resume token", "client_id", client.ID, "error", err)
+	}
+	accepted.ResumeToken = token
+	accepted.ResumeGraceSeconds = int(s.config.RelayResumeGrace.Seconds())
+
+	s.logger.Info("Session accepted",
+		"client_id", client.ID,
+		"session_id", client.SessionID,
+		"streams", len(info.Streams),
+		"compression", session.Compression,
+		"target_fps", info.TargetFPS,
+		"sdk_version", info.SDKVersion,
+	)
+
+	return client.SendJSON(accepted)
+}
+
+// rejectSession sends a structured rejection and closes the connection,
+// which ends the client's read loop.
+func (s *Service) rejectSession(client *Client, perr *ProtocolError) error {
+	s.logger.Warn("Session rejected",
+		"client_id", client.ID,
+		"code", perr.Code,
+		"reason", perr.Message,
+	)
+
+	if err := client.SendJSON(SessionRejected{Type: "session_rejected", Error: *perr}); err != nil {
+		return fmt.Errorf("failed to send session_rejected: %w", err)
+	}
+
+	client.SetCloseReason(DisconnectRejected)
+	client.Close(websocket.ClosePolicyViolation, perr.Code)
+
+	return perr
+}
+
+func validateSessionInfo(info *SessionInfo) *ProtocolError {
+	version, err := parseSDKVersion(info.SDKVersion)
+	if err != nil {
+		return &ProtocolError{
+			Code:    ErrCodeUnsupportedSDKVersion,
+			Message: err.Error(),
+			Details: map[string]interface{}{"min_sdk_version": MinSDKVersion},
+		}
+	}
+	minVersion, _ := parseSDKVersion(MinSDKVersion)
+	if compareVersions(version, minVersion) < 0 {
+		return &ProtocolError{
+			Code:    ErrCodeUnsupportedSDKVersion,
+			Message: fmt.Sprintf("SDK version %s is older than the minimum supported %s", info.SDKVersion, MinSDKVersion),
+			Details: map[string]interface{}{"min_sdk_version": MinSDKVersion},
+		}
+	}
+
+	if info.TargetFPS < MinTargetFPS || info.TargetFPS > MaxTargetFPS {
+		return &ProtocolError{
+			Code:    ErrCodeInvalidTargetFPS,
+			Message: fmt.Sprintf("targetFPS must be between %d and %d, got %d", MinTargetFPS, MaxTargetFPS, info.TargetFPS),
+		}
+	}
+
+	if len(info.Streams) == 0 {
+		return &ProtocolError{
+			Code:    ErrCodeInvalidStreams,
+			Message: "at least one stream must be declared",
+		}
+	}
+	seen := make(map[string]bool, len(info.Streams))
+	for _, stream := range info.Streams {
+		if !isKnownStreamType(stream.Type) {
+			return &ProtocolError{
+				Code:    ErrCodeInvalidStreams,
+				Message: fmt.Sprintf("unknown stream type %q", stream.Type),
+				Details: map[string]interface{}{"supported_streams": knownStreamTypes()},
+			}
+		}
+		if seen[stream.Type] {
+			return &ProtocolError{
+				Code:    ErrCodeInvalidStreams,
+				Message: fmt.Sprintf("stream type %q declared more than once", stream.Type),
+			}
+		}
+		seen[stream.Type] = true
+	}
+
+	return nil
+}
+
+// negotiateStreams settles the compression for every declared stream,
+// falling back to "none" for codecs the relay does not support.
+func negotiateStreams(requested []StreamConfig) []StreamConfig {
+	negotiated := make([]StreamConfig, 0, len(requested))
+	for _, stream := range requested {
+		compression := stream.Compression
+		if compression == "" {
+			compression = "none"
+		}
+		if _, ok := CodecByName(compression); !ok {
+			compression = "none"
+		}
+		negotiated = append(negotiated, StreamConfig{
+			Type:        stream.Type,
+			Compression: compression,
+		})
+	}
+	return negotiated
+}
+
+// checkNegotiatedCodecs rejects a packet with a stream compressed by a codec
+// other than the one negotiated for it. Uncompressed streams are always
+// accepted, since writers fall back to none when compression does not help.
+func checkNegotiatedCodecs(packet *StreamKitPacket, session *SessionState) error {
+	if session == nil {
+		return nil
+	}
+	for _, stream := range packet.Streams {
+		negotiated, declared := session.Compression[stream.Type]
+		if !declared || stream.Codec == CodecNone || stream.Compression == negotiated {
+			continue
+		}
+		return fmt.Errorf("%s stream compressed with %s, negotiated %s", stream.Type, stream.Compression, negotiated)
+	}
+	return nil
+}
+
+func isKnownStreamType(name string) bool {
+	for _, known := range streamTypeNames {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+func knownStreamTypes() []string {
+	types := make([]string, 0, len(streamTypeNames))
+	for id := uint8(1); int(id) <= len(streamTypeNames); id++ {
+		types = append(types, streamTypeNames[id])
+	}
+	return types
+}
+
+// parseSDKVersion extracts major.minor.patch from versions such as
+// "1.2.3", "v1.2", "ios-1.2.3" or "1.2.3-beta.1".
+func parseSDKVersion(version string) ([3]int, error) {
+	var parsed [3]int
+
+	start := strings.IndexAny(version, "0123456789")
+	if start < 0 {
+		return parsed, fmt.Errorf("invalid SDK version %q", version)
+	}
+	core := version[start:]
+	if end := strings.IndexFunc(core, func(r rune) bool { return r != '.' && (r < '0' || r > '9') }); end >= 0 {
+		core = core[:end]
+	}
+
+	parts := strings.Split(strings.Trim(core, "."), ".")
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, fmt.Errorf("invalid SDK version %q", version)
+		}
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,333 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	syncRetryMin = 1 * time.Second
+	syncRetryMax = 30 * time.Second
+)
+
+// AnchorUpdate is pushed to devices when an anchor in their session changes
+// in Stag because of another device, so co-located devices converge on the
+// same spatial graph. Change is anchor_created, anchor_updated or
+// anchor_deleted; Version is the committed anchor version, absent for
+// deletes.
+type AnchorUpdate struct {
+	Type           string          `json:"type"`
+	Change         string          `json:"change"`
+	Seq            uint64          `json:"seq"`
+	SessionID      string          `json:"session_id"`
+	AnchorID       string          `json:"anchor_id"`
+	AnchorType     string          `json:"anchor_type"`
+	VersionID      string          `json:"version_id,omitempty"`
+	SourceDeviceID string          `json:"source_device_id,omitempty"`
+	Version        json.RawMessage `json:"version,omitempty"`
+	Timestamp      time.Time       `json:"timestamp"`
+}
+
+// SyncReset tells devices that updates were missed while the relay's
+// subscription to Stag was interrupted. They should refetch the session's
+// anchors from Stag.
+type SyncReset struct {
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// stagChange is the part of a Stag subscription message the relay uses.
+type stagChange struct {
+	Type       string          `json:"type"`
+	Seq        uint64          `json:"seq"`
+	AnchorID   string          `json:"anchor_id"`
+	AnchorType string          `json:"anchor_type"`
+	VersionID  string          `json:"version_id"`
+	Version    json.RawMessage `json:"version"`
+}
+
+// changeOrigin identifies who made a change, to avoid echoing it back.
+type changeOrigin struct {
+	ClientID string `json:"client_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// sessionFeed is the relay's subscription to Stag changes for one session,
+// shared by every connected device in it.
+type sessionFeed struct {
+	sessionID string
+	clients   int
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// joinSessionFeed starts the session's Stag subscription when its first
+// device connects.
+func (s *Service) joinSessionFeed(sessionID string) {
+	if !s.config.RelaySync {
+		return
+	}
+
+	s.feedsMux.Lock()
+	defer s.feedsMux.Unlock()
+
+	if feed, ok := s.feeds[sessionID]; ok {
+		feed.clients++
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feed := &sessionFeed{
+		sessionID: sessionID,
+		clients:   1,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	s.feeds[sessionID] = feed
+	go s.runSessionFeed(ctx, feed)
+}
+
+// leaveSessionFeed stops the subscription once the last device of the
+// session has disconnected.
+func (s *Service) leaveSessionFeed(sessionID string) {
+	if !s.config.RelaySync {
+		return
+	}
+
+	s.feedsMux.Lock()
+	defer s.feedsMux.Unlock()
+
+	feed, ok := s.feeds[sessionID]
+	if !ok {
+		return
+	}
+	feed.clients--
+	if feed.clients <= 0 {
+		feed.cancel()
+		delete(s.feeds, sessionID)
+	}
+}
+
+// stopSessionFeeds ends every subscription and waits for them to exit.
+func (s *Service) stopSessionFeeds() {
+	s.feedsMux.Lock()
+	feeds := make([]*sessionFeed, 0, len(s.feeds))
+	for sessionID, feed := range s.feeds {
+		feed.cancel()
+		feeds = append(feeds, feed)
+		delete(s.feeds, sessionID)
+	}
+	s.feedsMux.Unlock()
+
+	for _, feed := range feeds {
+		<-feed.done
+	}
+}
+
+// runSessionFeed keeps a subscription to Stag open for the session,
+// reconnecting with backoff and resuming after the last change seen.
+func (s *Service) runSessionFeed(ctx context.Context, feed *sessionFeed) {
+	defer close(feed.done)
+
+	var lastSeq uint64
+	resuming := false
+	delay := syncRetryMin
+
+	for {
+		subscribeURL, err := stagSubscribeURL(s.config.RelayEndpoint, feed.sessionID, s.config.RelaySyncTypes, lastSeq, resuming)
+		if err != nil {
+			s.logger.Error("Cannot subscribe to Stag changes", "session_id", feed.sessionID, "error", err)
+			return
+		}
+
+		connected, err := s.consumeSessionFeed(ctx, feed.sessionID, subscribeURL, &lastSeq)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = syncRetryMin
+		}
+		resuming = true
+		s.logger.Warn("Stag subscription interrupted, retrying",
+			"session_id", feed.sessionID,
+			"last_seq", lastSeq,
+			"retry_in", delay.String(),
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > syncRetryMax {
+			delay = syncRetryMax
+		}
+	}
+}
+
+// consumeSessionFeed reads changes from one subscription connection until
+// it fails or ctx is cancelled. connected reports whether the dial worked.
+func (s *Service) consumeSessionFeed(ctx context.Context, sessionID, subscribeURL string, lastSeq *uint64) (connected bool, err error) {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	if transport, ok := s.httpClient.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+
+	conn, _, err := dialer.DialContext(ctx, subscribeURL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Unblock the read below when the feed is stopped
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	s.logger.Info("🔄 Subscribed to Stag changes", "session_id", sessionID, "since", *lastSeq)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+
+		var change stagChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			s.logger.Warn("Ignoring malformed Stag change", "session_id", sessionID, "error", err)
+			continue
+		}
+
+		// A resync cannot replay deletions, so devices refetch as after a
+		// reset; the changes that follow it are forwarded as usual
+		if change.Type == "subscription_reset" || change.Type == "subscription_resync" {
+			*lastSeq = change.Seq
+			s.fanOutReset(sessionID)
+			continue
+		}
+		*lastSeq = change.Seq
+		s.fanOutChange(sessionID, &change)
+	}
+}
+
+// fanOutChange pushes a change to every handshaken device in the session
+// except the one that made it. Updates are dropped for devices whose send
+// buffer is full rather than stalling the whole session.
+func (s *Service) fanOutChange(sessionID string, change *stagChange) {
+	var origin changeOrigin
+	if len(change.Version) > 0 {
+		json.Unmarshal(change.Version, &origin)
+	}
+
+	update := AnchorUpdate{
+		Type:           "anchor_update",
+		Change:         change.Type,
+		Seq:            change.Seq,
+		SessionID:      sessionID,
+		AnchorID:       change.AnchorID,
+		AnchorType:     change.AnchorType,
+		VersionID:      change.VersionID,
+		SourceDeviceID: origin.DeviceID,
+		Version:        change.Version,
+		Timestamp:      time.Now(),
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		s.logger.Error("Failed to marshal anchor update", "session_id", sessionID, "error", err)
+		return
+	}
+
+	for _, client := range s.sessionClients(sessionID) {
+		if origin.ClientID != "" && origin.ClientID == client.ID {
+			continue
+		}
+		client.sendSync(data)
+	}
+}
+
+func (s *Service) fanOutReset(sessionID string) {
+	data, err := json.Marshal(SyncReset{
+		Type:      "sync_reset",
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	for _, client := range s.sessionClients(sessionID) {
+		client.sendSync(data)
+	}
+}
+
+func (s *Service) sessionClients(sessionID string) []*Client {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	clients := make([]*Client, 0)
+	for _, client := range s.clients {
+		if client.SessionID == sessionID && client.Handshaken() {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (s *Service) syncSessions() int {
+	s.feedsMux.Lock()
+	defer s.feedsMux.Unlock()
+	return len(s.feeds)
+}
+
+// stagSubscribeURL derives the WebSocket subscription URL for a session
+// from the Stag ingest endpoint, e.g. http://host:9000/api/v1/ingest
+// becomes ws://host:9000/api/v1/stags/{session}/subscribe.
+func stagSubscribeURL(ingestEndpoint, sessionID string, types []string, since uint64, resuming bool) (string, error) {
+	u, err := url.Parse(ingestEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid Stag endpoint: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported Stag endpoint scheme %q", u.Scheme)
+	}
+
+	base := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/ingest")
+	u.Path = base + "/stags/" + url.PathEscape(sessionID) + "/subscribe"
+
+	q := url.Values{}
+	if len(types) > 0 {
+		q.Set("types", strings.Join(types, ","))
+	}
+	if resuming {
+		q.Set("since", strconv.FormatUint(since, 10))
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// sendSync queues a sync message without blocking the session feed.
+func (c *Client) sendSync(data []byte) {
+	if c.TrySend(websocket.TextMessage, data) {
+		c.syncSent.Add(1)
+	} else {
+		c.syncDropped.Add(1)
+	}
+}
@@ -0,0 +1,296 @@
+package stag
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// Per-event ingest outcomes.
+const (
+	EventCreated   = "created"
+	EventUpdated   = "updated"
+	EventUnchanged = "unchanged"
+	EventDuplicate = "duplicate"
+	EventFailed    = "failed"
+	EventPending   = "pending"
+)
+
+// Batch processing states.
+const (
+	BatchProcessing = "processing"
+	BatchCompleted  = "completed"
+)
+
+// Ingest modes, chosen with ?mode= or the X-Ingest-Mode header.
+const (
+	// IngestModeQueue acknowledges as soon as the events are queued (default)
+	IngestModeQueue = "queue"
+	// IngestModeSync waits for the events to be committed and returns their results
+	IngestModeSync = "sync"
+	// IngestModeAsync answers 202 with a batch ID to poll for the results
+	IngestModeAsync = "async"
+)
+
+const (
+	// syncIngestTimeout bounds how long a sync ingest waits, below the
+	// server's 30s write timeout
+	syncIngestTimeout = 20 * time.Second
+
+	// pruneInterval is how often expired batch results and dedupe entries
+	// are deleted
+	pruneInterval = time.Minute
+)
+
+// eventOutcome is what processing an event did to its anchor.
+type eventOutcome struct {
+	Status    string
+	AnchorID  string
+	VersionID string
+}
+
+// ingestTracker follows queued events through the batch processor so their
+// outcomes can be reported per batch. Batches are held here only while they
+// are processing; the service forgets them once their result is persisted.
+type ingestTracker struct {
+	mu       sync.Mutex
+	inFlight map[string]*trackedBatch
+	pending  map[*storage.SpatialEvent]pendingEvent
+}
+
+type trackedBatch struct {
+	result    *storage.BatchResult
+	remaining int
+	done      chan struct{}
+}
+
+type pendingEvent struct {
+	batch *trackedBatch
+	index int
+}
+
+func newIngestTracker() *ingestTracker {
+	return &ingestTracker{
+		inFlight: make(map[string]*trackedBatch),
+		pending:  make(map[*storage.SpatialEvent]pendingEvent),
+	}
+}
+
+// track starts following the events of a batch. It must be called before
+// the events are handed to the batch processor. An empty batch is returned
+// already completed. If a batch with the same ID is still processing, that
+// batch is returned instead and existing is true.
+func (t *ingestTracker) track(batch *storage.IngestBatch, traceID string) (tb *trackedBatch, existing bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tb, ok := t.inFlight[batch.BatchID]; ok {
+		return tb, true
+	}
+
+	tb = &trackedBatch{
+		result: &storage.BatchResult{
+			BatchID:    batch.BatchID,
+			TraceID:    traceID,
+			RelayID:    batch.RelayID,
+			Status:     BatchProcessing,
+			Received:   len(batch.Events),
+			Events:     make([]storage.EventResult, len(batch.Events)),
+			ReceivedAt: time.Now(),
+		},
+		remaining: len(batch.Events),
+		done:      make(chan struct{}),
+	}
+	for i := range batch.Events {
+		tb.result.Events[i] = storage.EventResult{
+			Index:     i,
+			EventID:   batch.Events[i].EventID,
+			EventType: batch.Events[i].EventType,
+			Status:    EventPending,
+		}
+		t.pending[&batch.Events[i]] = pendingEvent{batch: tb, index: i}
+	}
+
+	if tb.remaining == 0 {
+		t.complete(tb)
+	} else {
+		t.inFlight[batch.BatchID] = tb
+	}
+	return tb, false
+}
+
+// record stores the outcome of a processed event. It returns the batch if
+// this was its last event.
+func (t *ingestTracker) record(event *storage.SpatialEvent, outcome eventOutcome, err error) *trackedBatch {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ref, ok := t.pending[event]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, event)
+
+	tb := ref.batch
+	result := &tb.result.Events[ref.index]
+	result.AnchorID = outcome.AnchorID
+	result.VersionID = outcome.VersionID
+	if err != nil {
+		result.Status = EventFailed
+		result.Error = err.Error()
+	} else {
+		result.Status = outcome.Status
+	}
+
+	switch result.Status {
+	case EventCreated:
+		tb.result.Created++
+	case EventUpdated:
+		tb.result.Updated++
+	case EventUnchanged:
+		tb.result.Unchanged++
+	case EventDuplicate:
+		tb.result.Duplicates++
+	case EventFailed:
+		tb.result.Failed++
+	}
+	if result.Status == EventCreated || result.Status == EventUpdated || result.Status == EventUnchanged {
+		tb.result.Processed++
+	}
+
+	tb.remaining--
+	if tb.remaining > 0 {
+		return nil
+	}
+	t.complete(tb)
+	return tb
+}
+
+// forget stops reporting a completed batch from memory.
+func (t *ingestTracker) forget(tb *trackedBatch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inFlight[tb.result.BatchID] == tb {
+		delete(t.inFlight, tb.result.BatchID)
+	}
+}
+
+func (t *ingestTracker) complete(tb *trackedBatch) {
+	now := time.Now()
+	tb.result.Status = BatchCompleted
+	tb.result.CompletedAt = &now
+	tb.result.ProcessingTime = now.Sub(tb.result.ReceivedAt)
+	close(tb.done)
+}
+
+// snapshot returns a copy of the batch's current result that is safe to
+// encode while processing continues.
+func (t *ingestTracker) snapshot(tb *trackedBatch) *storage.BatchResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := *tb.result
+	result.Events = append([]storage.EventResult(nil), tb.result.Events...)
+	return &result
+}
+
+// lookup returns the result of a batch that is still processing.
+func (t *ingestTracker) lookup(batchID string) (*storage.BatchResult, bool) {
+	t.mu.Lock()
+	tb, ok := t.inFlight[batchID]
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return t.snapshot(tb), true
+}
+
+// saveBatchResult persists a completed batch so it can be looked up later
+// and marks its ID seen, so a resend is answered with this result instead
+// of being processed again.
+func (s *Service) saveBatchResult(tb *trackedBatch) {
+	defer s.ingests.forget(tb)
+
+	result := s.ingests.snapshot(tb)
+	if err := s.store.SaveBatchResult(result); err != nil {
+		s.logger.Error("Failed to save batch result", "batch_id", result.BatchID, "error", err)
+		return
+	}
+	if err := s.store.MarkSeen(storage.DedupeBatch, []string{result.BatchID}, s.config.DedupeTTL); err != nil {
+		s.logger.Error("Failed to record batch ID", "batch_id", result.BatchID, "error", err)
+	}
+}
+
+// previousBatch returns the result of an earlier batch with the same ID
+// that completed within the dedupe TTL.
+func (s *Service) previousBatch(batchID string) (*storage.BatchResult, bool) {
+	seen, err := s.store.SeenIDs(storage.DedupeBatch, []string{batchID})
+	if err != nil {
+		s.logger.Warn("Failed to check batch ID", "batch_id", batchID, "error", err)
+		return nil, false
+	}
+	if !seen[batchID] {
+		return nil, false
+	}
+
+	result, err := s.store.GetBatchResult(batchID)
+	if err != nil {
+		// Pruned by retention; the ID alone is enough to skip it
+		result = &storage.BatchResult{BatchID: batchID, Status: BatchCompleted}
+	}
+	return result, true
+}
+
+// batchResponse is the ingest reply carrying a batch's per-event results.
+func batchResponse(result *storage.BatchResult, statusURL string) map[string]interface{} {
+	return map[string]interface{}{
+		"batch_id":   result.BatchID,
+		"status":     result.Status,
+		"processed":  result.Processed,
+		"errors":     result.Failed,
+		"queued":     false,
+		"created":    result.Created,
+		"updated":    result.Updated,
+		"unchanged":  result.Unchanged,
+		"duplicates": result.Duplicates,
+		"failed":     result.Failed,
+		"events":     result.Events,
+		"status_url": statusURL,
+		"trace_id":   result.TraceID,
+		"timestamp":  time.Now().Format(time.RFC3339),
+	}
+}
+
+// pruneExpired deletes batch results past the retention limits and expired
+// dedupe entries until the service stops.
+func (s *Service) pruneExpired() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.prune(time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Service) prune(now time.Time) {
+	deleted, err := s.store.PruneBatchResults(now.Add(-s.config.BatchRetention), s.config.BatchRetentionMax)
+	if err != nil {
+		s.logger.Error("Failed to prune batch results", "error", err)
+	} else if deleted > 0 {
+		s.logger.Debug("Pruned batch results", "deleted", deleted)
+	}
+
+	deleted, err = s.store.PruneSeenIDs(now)
+	if err != nil {
+		s.logger.Error("Failed to prune dedupe index", "error", err)
+	} else if deleted > 0 {
+		s.logger.Debug("Pruned dedupe index", "deleted", deleted)
+	}
+}
@@ -0,0 +1,294 @@
+package stag
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// ingestReply is the part of an ingest response the tests look at.
+type ingestReply struct {
+	BatchID    string                `json:"batch_id"`
+	Status     string                `json:"status"`
+	Duplicate  bool                  `json:"duplicate"`
+	Queued     bool                  `json:"queued"`
+	Created    int                   `json:"created"`
+	Updated    int                   `json:"updated"`
+	Duplicates int                   `json:"duplicates"`
+	Failed     int                   `json:"failed"`
+	Events     []storage.EventResult `json:"events"`
+	StatusURL  string                `json:"status_url"`
+	TraceID    string                `json:"trace_id"`
+}
+
+// testRouter serves the ingest routes the way cmd/stag does.
+func testRouter(s *Service) http.Handler {
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/ingest", s.HandleIngest).Methods("POST")
+	api.HandleFunc("/batches/{batch_id}", s.HandleGetBatch).Methods("GET")
+	return router
+}
+
+func postIngest(t *testing.T, h http.Handler, mode string, batch *storage.IngestBatch) (int, *ingestReply) {
+	t.Helper()
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("failed to marshal batch: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest?mode="+mode, bytes.NewReader(body)))
+
+	var reply ingestReply
+	if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil {
+		t.Fatalf("failed to decode %s ingest reply (status %d): %v", mode, rec.Code, err)
+	}
+	return rec.Code, &reply
+}
+
+// batchOf returns a batch of copies of the events.
+func batchOf(batchID string, events ...*storage.SpatialEvent) *storage.IngestBatch {
+	batch := &storage.IngestBatch{BatchID: batchID, RelayID: "test-relay"}
+	for _, event := range events {
+		batch.Events = append(batch.Events, *event)
+	}
+	return batch
+}
+
+// withID sets an event's ID.
+func withID(event *storage.SpatialEvent, eventID string) *storage.SpatialEvent {
+	event.EventID = eventID
+	return event
+}
+
+func TestSyncIngestReportsPerEventResults(t *testing.T) {
+	s := newTestService(t, openTestStore(t))
+	h := testRouter(s)
+
+	broken := withID(&storage.SpatialEvent{EventType: "mesh", SessionID: "room", ClientID: "a"}, "e2")
+	status, reply := postIngest(t, h, IngestModeSync, batchOf("b1", withID(poseEvent("a", 1), "e1"), broken))
+	if status != http.StatusOK || reply.Status != BatchCompleted || reply.Queued {
+		t.Fatalf("sync ingest answered %d with status %q, queued %v", status, reply.Status, reply.Queued)
+	}
+	if reply.Created != 1 || reply.Failed != 1 || len(reply.Events) != 2 {
+		t.Fatalf("sync ingest created %d, failed %d, %d results; want 1, 1, 2", reply.Created, reply.Failed, len(reply.Events))
+	}
+	created, failed := reply.Events[0], reply.Events[1]
+	if created.Status != EventCreated || created.EventID != "e1" || created.AnchorID != "pose_a" || created.VersionID != "v1" {
+		t.Fatalf("first event = %+v, want created pose_a v1", created)
+	}
+	if failed.Status != EventFailed || failed.Index != 1 || failed.Error == "" {
+		t.Fatalf("second event = %+v, want failed with an error", failed)
+	}
+
+	// The default mode only acknowledges the queued events
+	status, reply = postIngest(t, h, IngestModeQueue, batchOf("b2", withID(poseEvent("b", 1), "e3")))
+	if status != http.StatusOK || !reply.Queued || reply.Events != nil {
+		t.Fatalf("queue ingest answered %d, queued %v, results %v", status, reply.Queued, reply.Events)
+	}
+
+	// Events are processed in order, so this also waits for the queued batch
+	status, reply = postIngest(t, h, IngestModeSync, batchOf("b3", withID(poseEvent("a", 2), "e4")))
+	if status != http.StatusOK || reply.Updated != 1 || reply.Events[0].VersionID != "v2" {
+		t.Fatalf("second sync ingest answered %d, updated %d, results %+v; want 200, 1, v2", status, reply.Updated, reply.Events)
+	}
+}
+
+func TestIngestRejectsUnknownMode(t *testing.T) {
+	s := newTestService(t, openTestStore(t))
+	rec := httptest.NewRecorder()
+	testRouter(s).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest?mode=later", bytes.NewReader([]byte("{}"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown mode answered %d, want 400", rec.Code)
+	}
+}
+
+// gatedStore holds the batch processor before its first event until
+// release is closed, so a batch can be looked at while it is processing.
+type gatedStore struct {
+	storage.Storage
+	release chan struct{}
+}
+
+func (g *gatedStore) GetStagHead(stagID string) (*storage.Stag, error) {
+	<-g.release
+	return g.Storage.GetStagHead(stagID)
+}
+
+func getBatch(t *testing.T, h http.Handler, batchID string) (int, *storage.BatchResult) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/batches/"+batchID, nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	var result storage.BatchResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode batch %s: %v", batchID, err)
+	}
+	return rec.Code, &result
+}
+
+// waitForBatchResult polls a batch until it completes.
+func waitForBatchResult(t *testing.T, h http.Handler, batchID string) *storage.BatchResult {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, result := getBatch(t, h, batchID); result != nil && result.Status == BatchCompleted {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("batch %s did not complete", batchID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAsyncIngestBatchStatus(t *testing.T) {
+	store := &gatedStore{Storage: openTestStore(t), release: make(chan struct{})}
+	s := newTestService(t, store)
+	h := testRouter(s)
+
+	status, reply := postIngest(t, h, IngestModeAsync, batchOf("b1", withID(poseEvent("a", 1), "e1"), withID(poseEvent("b", 1), "e2")))
+	if status != http.StatusAccepted || reply.Status != BatchProcessing || reply.StatusURL != "/api/v1/batches/b1" {
+		t.Fatalf("async ingest answered %d, status %q, status URL %q", status, reply.Status, reply.StatusURL)
+	}
+
+	code, pending := getBatch(t, h, "b1")
+	if code != http.StatusOK || pending.Status != BatchProcessing || pending.Received != 2 {
+		t.Fatalf("batch while processing = %d %+v", code, pending)
+	}
+	for _, event := range pending.Events {
+		if event.Status != EventPending {
+			t.Fatalf("event %s is %s before processing, want pending", event.EventID, event.Status)
+		}
+	}
+
+	close(store.release)
+	done := waitForBatchResult(t, h, "b1")
+	if done.Created != 2 || done.Processed != 2 || done.CompletedAt == nil || done.TraceID != reply.TraceID {
+		t.Fatalf("completed batch = %+v, want 2 created with the ingest trace ID", done)
+	}
+	for _, event := range done.Events {
+		if event.Status != EventCreated || event.VersionID != "v1" {
+			t.Fatalf("event %s is %s %s, want created v1", event.EventID, event.Status, event.VersionID)
+		}
+	}
+
+	if code, _ := getBatch(t, h, "missing"); code != http.StatusNotFound {
+		t.Fatalf("unknown batch answered %d, want 404", code)
+	}
+}
+
+func TestBatchResultRetention(t *testing.T) {
+	store := openTestStore(t)
+	s := newTestService(t, store)
+	s.config.BatchRetention = time.Hour
+	s.config.BatchRetentionMax = 2
+	h := testRouter(s)
+
+	now := time.Now()
+	received := map[string]time.Time{
+		"expired": now.Add(-2 * time.Hour),
+		"oldest":  now.Add(-30 * time.Minute),
+		"older":   now.Add(-20 * time.Minute),
+		"newest":  now.Add(-10 * time.Minute),
+	}
+	for batchID, at := range received {
+		if err := store.SaveBatchResult(&storage.BatchResult{BatchID: batchID, Status: BatchCompleted, ReceivedAt: at}); err != nil {
+			t.Fatalf("failed to save batch %s: %v", batchID, err)
+		}
+	}
+
+	s.prune(now)
+
+	// Past BatchRetention, then the oldest beyond BatchRetentionMax
+	for batchID, want := range map[string]int{
+		"expired": http.StatusNotFound,
+		"oldest":  http.StatusNotFound,
+		"older":   http.StatusOK,
+		"newest":  http.StatusOK,
+	} {
+		if code, _ := getBatch(t, h, batchID); code != want {
+			t.Errorf("batch %s answered %d after pruning, want %d", batchID, code, want)
+		}
+	}
+}
+
+func TestResentBatchAnsweredFromStoredResult(t *testing.T) {
+	store := openTestStore(t)
+	s := newTestService(t, store)
+	h := testRouter(s)
+
+	_, first := postIngest(t, h, IngestModeSync, batchOf("b1", withID(poseEvent("a", 1), "e1")))
+	if first.Created != 1 || first.Duplicate {
+		t.Fatalf("first ingest created %d, duplicate %v", first.Created, first.Duplicate)
+	}
+
+	// A resend within DedupeTTL is not processed again, even with new content
+	for _, mode := range []string{IngestModeSync, IngestModeAsync, IngestModeQueue} {
+		status, resent := postIngest(t, h, mode, batchOf("b1", withID(poseEvent("a", 2), "e1")))
+		if status != http.StatusOK || !resent.Duplicate || resent.TraceID != first.TraceID {
+			t.Fatalf("%s resend answered %d, duplicate %v, trace %s; want the stored result of trace %s",
+				mode, status, resent.Duplicate, resent.TraceID, first.TraceID)
+		}
+		if resent.Created != 1 || len(resent.Events) != 1 || resent.Events[0].VersionID != "v1" {
+			t.Fatalf("%s resend results = %+v, want the first ingest's", mode, resent.Events)
+		}
+	}
+	anchor, err := store.GetAnchorHead("room", "pose_a")
+	if err != nil || anchor.VersionCount != 1 {
+		t.Fatalf("resends changed the anchor (err %v)", err)
+	}
+
+	// Once the batch ID expires the batch is processed again
+	s.prune(time.Now().Add(s.config.DedupeTTL + time.Minute))
+	_, again := postIngest(t, h, IngestModeSync, batchOf("b1", withID(poseEvent("a", 2), "e1")))
+	if again.Duplicate || again.Updated != 1 {
+		t.Fatalf("resend after the dedupe TTL: duplicate %v, updated %d; want processed", again.Duplicate, again.Updated)
+	}
+}
+
+func TestDuplicateEventIDsSkipped(t *testing.T) {
+	store := openTestStore(t)
+	s := newTestService(t, store)
+	h := testRouter(s)
+
+	// Within a batch
+	_, reply := postIngest(t, h, IngestModeSync, batchOf("b1",
+		withID(poseEvent("a", 1), "e1"),
+		withID(poseEvent("a", 2), "e1"),
+		withID(poseEvent("b", 1), "e2"),
+	))
+	if reply.Created != 2 || reply.Duplicates != 1 || reply.Events[1].Status != EventDuplicate {
+		t.Fatalf("batch with a repeated event ID: created %d, duplicates %d, results %+v", reply.Created, reply.Duplicates, reply.Events)
+	}
+
+	// Across batches
+	_, reply = postIngest(t, h, IngestModeSync, batchOf("b2",
+		withID(poseEvent("b", 2), "e2"),
+		withID(poseEvent("c", 1), "e3"),
+	))
+	if reply.Duplicates != 1 || reply.Created != 1 || reply.Events[0].Status != EventDuplicate || reply.Events[1].Status != EventCreated {
+		t.Fatalf("batch repeating an earlier event ID: duplicates %d, created %d, results %+v", reply.Duplicates, reply.Created, reply.Events)
+	}
+
+	for _, anchorID := range []string{"pose_a", "pose_b", "pose_c"} {
+		anchor, err := store.GetAnchorHead("room", anchorID)
+		if err != nil {
+			t.Fatalf("GetAnchorHead %s: %v", anchorID, err)
+		}
+		if anchor.VersionCount != 1 {
+			t.Fatalf("%s has %d versions, want 1", anchorID, anchor.VersionCount)
+		}
+	}
+}
@@ -4,23 +4,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/tabular/local-pipeline/internal/config"
 	"github.com/tabular/local-pipeline/internal/logging"
 	"github.com/tabular/local-pipeline/internal/performance"
 	"github.com/tabular/local-pipeline/internal/storage"
 )
 
 type Service struct {
+	config          *config.Config
 	store           storage.Storage
 	logger          *logging.Logger
 	StartTime       time.Time
 	batchProcessor  *performance.BatchProcessor
 	processingMutex sync.RWMutex
 	healthChecker   *HealthChecker
+	changes         *changeHub
+	ingests         *ingestTracker
+	upgrader        websocket.Upgrader
+	stop            chan struct{}
 }
 
 type HealthChecker struct {
@@ -41,8 +50,9 @@ type StagHealth struct {
 	LastChecked     time.Time
 }
 
-func NewService(store storage.Storage, logger *logging.Logger) *Service {
+func NewService(cfg *config.Config, store storage.Storage, logger *logging.Logger) *Service {
 	s := &Service{
+		config:    cfg,
 		store:     store,
 		logger:    logger,
 		StartTime: time.Now(),
@@ -50,6 +60,14 @@ func NewService(store storage.Storage, logger *logging.Logger) *Service {
 			stagHealth:      make(map[string]*StagHealth),
 			lastHealthCheck: time.Now(),
 		},
+		changes: newChangeHub(),
+		ingests: newIngestTracker(),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Viewers are served from anywhere during local development
+			},
+		},
+		stop: make(chan struct{}),
 	}
 	
 	// Initialize batch processor for performance
@@ -62,16 +80,40 @@ func NewService(store storage.Storage, logger *logging.Logger) *Service {
 	
 	// Start health monitoring
 	go s.startHealthMonitoring()
+	go s.pruneExpired()
 	
 	return s
 }
 
+// Stop ends all change subscriptions so the HTTP server can shut down.
+func (s *Service) Stop() {
+	close(s.stop)
+	s.changes.close()
+}
+
+// HandleIngest queues a batch of events for processing. The mode query
+// parameter (or X-Ingest-Mode header) picks the response:
+//   - queue (default): acknowledge once queued
+//   - sync: wait for the events to be committed and report each one
+//   - async: answer 202 with a status URL for the batch
 func (s *Service) HandleIngest(w http.ResponseWriter, r *http.Request) {
 	stopTimer := s.logger.StartTimer()
 	defer func() {
 		duration := stopTimer()
 		s.logger.Debug("Ingest request completed", "duration", duration)
 	}()
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = r.Header.Get("X-Ingest-Mode")
+	}
+	if mode == "" {
+		mode = IngestModeQueue
+	}
+	if mode != IngestModeQueue && mode != IngestModeSync && mode != IngestModeAsync {
+		http.Error(w, "mode must be queue, sync or async", http.StatusBadRequest)
+		return
+	}
 	
 	// Parse request body
 	var batch storage.IngestBatch
@@ -80,6 +122,11 @@ func (s *Service) HandleIngest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	resendable := batch.BatchID != ""
+	if !resendable {
+		batch.BatchID = fmt.Sprintf("batch_%d", time.Now().UnixNano())
+	}
+	statusURL := strings.TrimSuffix(r.URL.Path, "/ingest") + "/batches/" + url.PathEscape(batch.BatchID)
 
 	traceID := logging.GenerateTraceID()
 	ctx := &logging.PipelineContext{
@@ -91,8 +138,33 @@ func (s *Service) HandleIngest(w http.ResponseWriter, r *http.Request) {
 	s.logger.PipelineInfo(ctx, "🚀 Ingest batch received", 
 		"event_count", len(batch.Events),
 		"relay_id", batch.RelayID,
+		"mode", mode,
 	)
 
+	// A resent batch is answered with the earlier outcome instead of being
+	// processed again
+	if resendable {
+		if previous, ok := s.previousBatch(batch.BatchID); ok {
+			s.logger.PipelineInfo(ctx, "♻️ Duplicate ingest batch skipped", "original_trace_id", previous.TraceID)
+			s.writeDuplicateBatch(w, previous, statusURL)
+			return
+		}
+	}
+
+	// Follow the events so their outcomes can be reported
+	tracked, existing := s.ingests.track(&batch, traceID)
+	if existing {
+		s.logger.PipelineInfo(ctx, "♻️ Duplicate of a batch still processing", "original_trace_id", tracked.result.TraceID)
+		if mode == IngestModeSync && !waitForBatch(r, tracked) {
+			return
+		}
+		s.writeDuplicateBatch(w, s.ingests.snapshot(tracked), statusURL)
+		return
+	}
+	if len(batch.Events) == 0 {
+		s.saveBatchResult(tracked)
+	}
+
 	// Add events to batch processor for performance
 	processed := 0
 	for i := range batch.Events {
@@ -126,22 +198,105 @@ func (s *Service) HandleIngest(w http.ResponseWriter, r *http.Request) {
 		s.logger.PipelineError(ctx, "Failed to update system stats", "error", err)
 	}
 
-	// Response
-	response := map[string]interface{}{
-		"batch_id":   batch.BatchID,
-		"processed":  processed,
-		"errors":     0, // Errors reported asynchronously
-		"queued":     true,
-		"trace_id":   traceID,
-		"timestamp":  time.Now().Format(time.RFC3339),
+	w.Header().Set("Content-Type", "application/json")
+
+	switch mode {
+	case IngestModeSync:
+		if !waitForBatch(r, tracked) {
+			return
+		}
+
+		result := s.ingests.snapshot(tracked)
+		status := http.StatusOK
+		if result.Status != BatchCompleted {
+			// Still committing; the rest of the results can be polled
+			w.Header().Set("Location", statusURL)
+			status = http.StatusAccepted
+		}
+
+		s.logger.PipelineInfo(ctx, "✅ Ingest batch committed",
+			"status", result.Status,
+			"created", result.Created,
+			"updated", result.Updated,
+			"unchanged", result.Unchanged,
+			"duplicates", result.Duplicates,
+			"failed", result.Failed,
+		)
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(batchResponse(result, statusURL))
+
+	case IngestModeAsync:
+		s.logger.PipelineInfo(ctx, "✅ Ingest batch accepted", "events", processed)
+
+		w.Header().Set("Location", statusURL)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"batch_id":   batch.BatchID,
+			"status":     BatchProcessing,
+			"received":   processed,
+			"status_url": statusURL,
+			"trace_id":   traceID,
+			"timestamp":  time.Now().Format(time.RFC3339),
+		})
+
+	default:
+		s.logger.PipelineInfo(ctx, "✅ Ingest batch queued", "processed", processed)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"batch_id":   batch.BatchID,
+			"processed":  processed,
+			"errors":     0, // Use mode=sync or the status URL for per-event results
+			"queued":     true,
+			"status_url": statusURL,
+			"trace_id":   traceID,
+			"timestamp":  time.Now().Format(time.RFC3339),
+		})
 	}
+}
+
+// waitForBatch waits up to syncIngestTimeout for a batch to be committed.
+// It returns false if the client went away.
+func waitForBatch(r *http.Request, tb *trackedBatch) bool {
+	timer := time.NewTimer(syncIngestTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-tb.done:
+	case <-timer.C:
+	case <-r.Context().Done():
+		return false
+	}
+	return true
+}
 
-	s.logger.PipelineInfo(ctx, "✅ Ingest batch queued", "processed", processed)
+func (s *Service) writeDuplicateBatch(w http.ResponseWriter, result *storage.BatchResult, statusURL string) {
+	response := batchResponse(result, statusURL)
+	response["duplicate"] = true
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleGetBatch reports the outcome of an ingest batch, or its progress
+// while it is still processing.
+func (s *Service) HandleGetBatch(w http.ResponseWriter, r *http.Request) {
+	batchID := mux.Vars(r)["batch_id"]
+
+	result, ok := s.ingests.lookup(batchID)
+	if !ok {
+		stored, err := s.store.GetBatchResult(batchID)
+		if err != nil {
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+		result = stored
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 // New batch processing method for performance
 func (s *Service) processBatch(events []*storage.SpatialEvent) error {
 	if len(events) == 0 {
@@ -155,10 +310,43 @@ func (s *Service) processBatch(events []*storage.SpatialEvent) error {
 	s.logger.PipelineInfo(ctx, "🔄 Processing event batch", "batch_size", len(events))
 	
 	processed := 0
+	duplicates := 0
 	errors := 0
-	
+
+	// Skip events already committed by an earlier batch (relay retries,
+	// device resends)
+	eventIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		if event.EventID != "" {
+			eventIDs = append(eventIDs, event.EventID)
+		}
+	}
+	seen, err := s.store.SeenIDs(storage.DedupeEvent, eventIDs)
+	if err != nil {
+		s.logger.PipelineWarn(ctx, "Failed to check event IDs, processing all", "error", err)
+		seen = make(map[string]bool)
+	}
+	committed := make([]string, 0, len(eventIDs))
+	completed := make([]*trackedBatch, 0)
+
 	for _, event := range events {
-		if err := s.processEvent(event); err != nil {
+		if event.EventID != "" && seen[event.EventID] {
+			if tb := s.ingests.record(event, eventOutcome{Status: EventDuplicate}, nil); tb != nil {
+				completed = append(completed, tb)
+			}
+			duplicates++
+			continue
+		}
+
+		outcome, err := s.processEvent(event)
+		if tb := s.ingests.record(event, outcome, err); tb != nil {
+			completed = append(completed, tb)
+		}
+		if err == nil && event.EventID != "" {
+			seen[event.EventID] = true
+			committed = append(committed, event.EventID)
+		}
+		if err != nil {
 			eventCtx := &logging.PipelineContext{
 				TraceID:   fmt.Sprintf("%v", event.Metadata["trace_id"]),
 				EventType: event.EventType,
@@ -173,8 +361,16 @@ func (s *Service) processBatch(events []*storage.SpatialEvent) error {
 		}
 	}
 	
+	if err := s.store.MarkSeen(storage.DedupeEvent, committed, s.config.DedupeTTL); err != nil {
+		s.logger.PipelineError(ctx, "Failed to record event IDs", "error", err)
+	}
+	for _, tb := range completed {
+		s.saveBatchResult(tb)
+	}
+
 	s.logger.PipelineInfo(ctx, "✅ Batch processing completed", 
 		"processed", processed, 
+		"duplicates", duplicates,
 		"errors", errors,
 		"success_rate", fmt.Sprintf("%.1f%%", float64(processed)/float64(len(events))*100),
 	)
@@ -182,15 +378,15 @@ func (s *Service) processBatch(events []*storage.SpatialEvent) error {
 	return nil
 }
 
-func (s *Service) processEvent(event *storage.SpatialEvent) error {
+func (s *Service) processEvent(event *storage.SpatialEvent) (eventOutcome, error) {
 	// Map session ID to stag ID
 	stagID := event.SessionID
 	if stagID == "" {
 		stagID = "default"
 	}
 
-	// Get or create stag
-	stag, err := s.store.GetStag(stagID)
+	// Get or create stag; the anchors' latest versions are not needed here
+	stag, err := s.store.GetStagHead(stagID)
 	if err != nil {
 		// Create new stag
 		stag = &storage.Stag{
@@ -203,12 +399,22 @@ func (s *Service) processEvent(event *storage.SpatialEvent) error {
 		}
 		
 		if err := s.store.CreateStag(stag); err != nil {
-			return fmt.Errorf("failed to create stag: %w", err)
+			return eventOutcome{}, fmt.Errorf("failed to create stag: %w", err)
 		}
 		
 		s.logger.Info("Created new stag", "stag_id", stagID)
 	}
 
+	// Track bandwidth savings even when the event turns out to be unchanged
+	if info := event.ProcessingInfo; info.Compressed {
+		stag.Stats.CompressedEventCount++
+		stag.Stats.CompressedBytes += int64(info.CompressedSize)
+		stag.Stats.UncompressedBytes += int64(info.OriginalSize)
+		if err := s.store.UpdateStagStats(stag.ID, stag.Stats); err != nil {
+			return eventOutcome{}, fmt.Errorf("failed to update stag stats: %w", err)
+		}
+	}
+
 	// Process different event types
 	switch event.EventType {
 	case "mesh":
@@ -228,9 +434,9 @@ func (s *Service) processEvent(event *storage.SpatialEvent) error {
 	}
 }
 
-func (s *Service) processMeshEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processMeshEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.MeshData == nil {
-		return fmt.Errorf("mesh event missing mesh data")
+		return eventOutcome{}, fmt.Errorf("mesh event missing mesh data")
 	}
 
 	anchorID := event.MeshData.AnchorID
@@ -241,57 +447,57 @@ func (s *Service) processMeshEvent(stag *storage.Stag, event *storage.SpatialEve
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processPoseEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processPoseEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.PoseData == nil {
-		return fmt.Errorf("pose event missing pose data")
+		return eventOutcome{}, fmt.Errorf("pose event missing pose data")
 	}
 
 	anchorID := fmt.Sprintf("pose_%s", event.ClientID)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processCameraEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processCameraEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.CameraData == nil {
-		return fmt.Errorf("camera event missing camera data")
+		return eventOutcome{}, fmt.Errorf("camera event missing camera data")
 	}
 
 	anchorID := fmt.Sprintf("camera_%s", event.ClientID)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processDepthEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processDepthEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.DepthData == nil {
-		return fmt.Errorf("depth event missing depth data")
+		return eventOutcome{}, fmt.Errorf("depth event missing depth data")
 	}
 
 	anchorID := fmt.Sprintf("depth_%s", event.ClientID)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processPointCloudEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processPointCloudEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.PointCloudData == nil {
-		return fmt.Errorf("pointCloud event missing point cloud data")
+		return eventOutcome{}, fmt.Errorf("pointCloud event missing point cloud data")
 	}
 
 	anchorID := fmt.Sprintf("pointcloud_%s_%d", event.ClientID, event.FrameNumber)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processLightingEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processLightingEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	if event.LightingData == nil {
-		return fmt.Errorf("lighting event missing lighting data")
+		return eventOutcome{}, fmt.Errorf("lighting event missing lighting data")
 	}
 
 	anchorID := fmt.Sprintf("lighting_%s", event.ClientID)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processGenericEvent(stag *storage.Stag, event *storage.SpatialEvent) error {
+func (s *Service) processGenericEvent(stag *storage.Stag, event *storage.SpatialEvent) (eventOutcome, error) {
 	anchorID := fmt.Sprintf("generic_%s_%d", event.ClientID, event.FrameNumber)
 	return s.processAnchorEvent(stag, anchorID, event)
 }
 
-func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event *storage.SpatialEvent) error {
+func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event *storage.SpatialEvent) (eventOutcome, error) {
 	// Use optimized hashing for performance
 	hasher := performance.GetHasher()
 	defer performance.PutHasher(hasher)
@@ -309,15 +515,16 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 		Component:   "stag-anchor-processor",
 	}
 	
+	outcome := eventOutcome{AnchorID: anchorID}
+
 	// Get or create anchor
-	anchor, err := s.store.GetAnchor(stag.ID, anchorID)
+	anchor, err := s.store.GetAnchorHead(stag.ID, anchorID)
 	if err != nil {
-		// Create new anchor
+		// Create new anchor; its first version is added below
 		anchor = &storage.Anchor{
 			ID:            anchorID,
 			StagID:        stag.ID,
-			CurrentHash:   contentHash,
-			Versions:      []storage.AnchorVersion{},
+			Type:          event.EventType,
 			LastSessionID: event.SessionID,
 			LastClientID:  event.ClientID,
 			LastDeviceID:  event.DeviceID,
@@ -325,7 +532,7 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 		}
 		
 		if err := s.store.CreateAnchor(anchor); err != nil {
-			return fmt.Errorf("failed to create anchor: %w", err)
+			return outcome, fmt.Errorf("failed to create anchor: %w", err)
 		}
 		
 		s.logger.PipelineInfo(ctx, "🆕 Created new anchor")
@@ -337,7 +544,8 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 	// Check if content has changed
 	if anchor.CurrentHash == contentHash {
 		s.logger.PipelineDebug(ctx, "🔄 Content unchanged, skipping version", "hash", contentHash[:8])
-		return nil
+		outcome.Status = EventUnchanged
+		return outcome, nil
 	}
 	
 	// For mesh data, also check geometric signature
@@ -345,14 +553,14 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 		geomSig := performance.CalculateGeometrySignature(event.MeshData)
 		if anchor.Metadata["geom_signature"] == geomSig {
 			s.logger.PipelineDebug(ctx, "🔄 Geometry unchanged, skipping version", "geom_sig", geomSig)
-			return nil
+			outcome.Status = EventUnchanged
+			return outcome, nil
 		}
 		anchor.Metadata["geom_signature"] = geomSig
 	}
 
-	// Create new version
+	// Create new version; the store assigns its VersionID
 	version := &storage.AnchorVersion{
-		VersionID:      fmt.Sprintf("v%d", time.Now().Unix()),
 		Hash:           contentHash,
 		Timestamp:      event.Timestamp,
 		ChangeType:     "update",
@@ -371,23 +579,37 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 		Metadata:       event.Metadata,
 	}
 
-	if len(anchor.Versions) == 0 {
+	if anchor.VersionCount == 0 {
 		version.ChangeType = "create"
 	}
 
 	if err := s.store.AddAnchorVersion(stag.ID, anchorID, version); err != nil {
-		return fmt.Errorf("failed to add anchor version: %w", err)
+		return outcome, fmt.Errorf("failed to add anchor version: %w", err)
 	}
 
 	// Update anchor
+	if anchor.Type == "" {
+		anchor.Type = event.EventType
+	}
 	anchor.CurrentHash = contentHash
 	anchor.LastSessionID = event.SessionID
 	anchor.LastClientID = event.ClientID
 	anchor.LastDeviceID = event.DeviceID
-	anchor.Versions = append(anchor.Versions, *version)
+	anchor.VersionCount++
+	anchor.LatestVersionID = version.VersionID
+	anchor.LatestVersion = version
 
 	if err := s.store.UpdateAnchor(anchor); err != nil {
-		return fmt.Errorf("failed to update anchor: %w", err)
+		return outcome, fmt.Errorf("failed to update anchor: %w", err)
+	}
+
+	outcome.VersionID = version.VersionID
+	if version.ChangeType == "create" {
+		outcome.Status = EventCreated
+		s.publishChange(ChangeAnchorCreated, anchor, version)
+	} else {
+		outcome.Status = EventUpdated
+		s.publishChange(ChangeAnchorUpdated, anchor, version)
 	}
 
 	// Update stag stats
@@ -414,7 +636,7 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 	}
 
 	if err := s.store.UpdateStagStats(stag.ID, stag.Stats); err != nil {
-		return fmt.Errorf("failed to update stag stats: %w", err)
+		return outcome, fmt.Errorf("failed to update stag stats: %w", err)
 	}
 
 	s.logger.PipelineInfo(ctx, "✅ Updated anchor", 
@@ -426,7 +648,7 @@ func (s *Service) processAnchorEvent(stag *storage.Stag, anchorID string, event
 	// Update stag health
 	s.updateStagHealth(stag.ID, true, nil)
 
-	return nil
+	return outcome, nil
 }
 
 // Health monitoring methods
@@ -455,8 +677,8 @@ func (s *Service) updateStagHealth(stagID string, healthy bool, err error) {
 	}
 	
 	// Get anchor count
-	if stag, stagErr := s.store.GetStag(stagID); stagErr == nil {
-		health.AnchorCount = len(stag.Anchors)
+	if anchors, listErr := s.store.ListAnchorHeads(stagID); listErr == nil {
+		health.AnchorCount = len(anchors)
 	}
 }
 
@@ -562,6 +784,29 @@ func (s *Service) HandleGetAnchor(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(anchor)
 }
 
+func (s *Service) HandleDeleteAnchor(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stagID := vars["stag_id"]
+	anchorID := vars["anchor_id"]
+
+	anchor, err := s.store.GetAnchorHead(stagID, anchorID)
+	if err != nil {
+		http.Error(w, "Anchor not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.store.DeleteAnchor(stagID, anchorID); err != nil {
+		s.logger.Error("Failed to delete anchor", "stag_id", stagID, "anchor_id", anchorID, "error", err)
+		http.Error(w, "Failed to delete anchor", http.StatusInternalServerError)
+		return
+	}
+
+	s.publishChange(ChangeAnchorDeleted, anchor, nil)
+	s.logger.Info("🗑️ Deleted anchor", "stag_id", stagID, "anchor_id", anchorID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Service) HandleGetAnchorHistory(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	stagID := vars["stag_id"]
@@ -610,7 +855,7 @@ func (s *Service) HandleGetStagStats(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	stagID := vars["stag_id"]
 
-	stag, err := s.store.GetStag(stagID)
+	stag, err := s.store.GetStagHead(stagID)
 	if err != nil {
 		s.logger.Error("Failed to get stag", "stag_id", stagID, "error", err)
 		http.Error(w, "Stag not found", http.StatusNotFound)
@@ -0,0 +1,516 @@
+package stag
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+// Change types pushed to subscribers.
+const (
+	ChangeAnchorCreated = "anchor_created"
+	ChangeAnchorUpdated = "anchor_updated"
+	ChangeAnchorDeleted = "anchor_deleted"
+)
+
+const (
+	// changeHistoryLimit bounds the changes kept per stag for resuming
+	// subscribers without reading the store
+	changeHistoryLimit = 1024
+
+	// subscriberBuffer is how many changes may wait for a slow subscriber
+	// before it is disconnected and has to resume
+	subscriberBuffer = 256
+
+	subscriptionPingInterval = 15 * time.Second
+	subscriptionWriteWait    = 10 * time.Second
+)
+
+// AnchorChange is one committed anchor change. Seq increases with every
+// change within a stag and is the change's commit time in microseconds, so
+// it stays meaningful across restarts; subscribers resume by passing the
+// last Seq they saw.
+type AnchorChange struct {
+	Type       string                 `json:"type"`
+	Seq        uint64                 `json:"seq"`
+	StagID     string                 `json:"stag_id"`
+	AnchorID   string                 `json:"anchor_id"`
+	AnchorType string                 `json:"anchor_type"`
+	VersionID  string                 `json:"version_id,omitempty"`
+	Version    *storage.AnchorVersion `json:"version,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// SubscriptionReset tells a resuming subscriber that the changes after its
+// cursor cannot be replayed. It should refetch the stag and continue from
+// Seq.
+type SubscriptionReset struct {
+	Type      string    `json:"type"`
+	StagID    string    `json:"stag_id"`
+	Seq       uint64    `json:"seq"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// SubscriptionResync starts a resume from the store, used when the changes
+// after the cursor are no longer in memory (too old, or Stag restarted).
+// AnchorIDs are the anchors the stag has now; the subscriber should drop any
+// others, as their deletion cannot be replayed. It is followed by the latest
+// version of every anchor changed since Seq, intermediate versions being
+// available from the anchor history.
+type SubscriptionResync struct {
+	Type      string    `json:"type"`
+	StagID    string    `json:"stag_id"`
+	Seq       uint64    `json:"seq"`
+	AnchorIDs []string  `json:"anchor_ids"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// changeHub fans committed anchor changes out to subscribers and keeps a
+// bounded per-stag history for resume.
+type changeHub struct {
+	mu          sync.Mutex
+	start       uint64 // seq when the hub started; history covers later changes only
+	seq         map[string]uint64
+	evicted     map[string]uint64 // seq of the newest change dropped from history
+	history     map[string][]*AnchorChange
+	subscribers map[string]map[*subscriber]struct{}
+	closed      bool
+}
+
+type subscriber struct {
+	types   map[string]bool // nil means all anchor types
+	changes chan *AnchorChange
+	lagged  bool
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{
+		start:       uint64(time.Now().UnixMicro()),
+		seq:         make(map[string]uint64),
+		evicted:     make(map[string]uint64),
+		history:     make(map[string][]*AnchorChange),
+		subscribers: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func (sub *subscriber) wants(anchorType string) bool {
+	return sub.types == nil || sub.types[strings.ToLower(anchorType)]
+}
+
+// current returns the seq of the stag's latest change.
+func (h *changeHub) current(stagID string) uint64 {
+	if seq := h.seq[stagID]; seq > h.start {
+		return seq
+	}
+	return h.start
+}
+
+// publish assigns the change its sequence number and delivers it. A
+// subscriber whose buffer is full is dropped rather than blocking ingest.
+func (h *changeHub) publish(change *AnchorChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	change.Seq = h.current(change.StagID) + 1
+	if now := uint64(time.Now().UnixMicro()); now > change.Seq {
+		change.Seq = now
+	}
+	h.seq[change.StagID] = change.Seq
+
+	history := append(h.history[change.StagID], change)
+	if len(history) > changeHistoryLimit {
+		h.evicted[change.StagID] = history[len(history)-changeHistoryLimit-1].Seq
+		history = history[len(history)-changeHistoryLimit:]
+	}
+	h.history[change.StagID] = history
+
+	for sub := range h.subscribers[change.StagID] {
+		if !sub.wants(change.AnchorType) {
+			continue
+		}
+		select {
+		case sub.changes <- change:
+		default:
+			sub.lagged = true
+			close(sub.changes)
+			delete(h.subscribers[change.StagID], sub)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the changes after since that
+// it missed. fromStore is true when those changes are no longer all in
+// history and have to be read from the store; reset is true when since is
+// ahead of the stag's latest change.
+func (h *changeHub) subscribe(stagID string, types map[string]bool, since uint64, resuming bool) (sub *subscriber, backlog []*AnchorChange, seq uint64, fromStore, reset bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &subscriber{
+		types:   types,
+		changes: make(chan *AnchorChange, subscriberBuffer),
+	}
+	if h.closed {
+		close(sub.changes)
+		return sub, nil, 0, false, false
+	}
+
+	seq = h.current(stagID)
+	if resuming {
+		switch {
+		case since > seq:
+			reset = true
+		case since < h.start || since < h.evicted[stagID]:
+			fromStore = true
+		default:
+			for _, change := range h.history[stagID] {
+				if change.Seq > since && sub.wants(change.AnchorType) {
+					backlog = append(backlog, change)
+				}
+			}
+		}
+	}
+
+	if h.subscribers[stagID] == nil {
+		h.subscribers[stagID] = make(map[*subscriber]struct{})
+	}
+	h.subscribers[stagID][sub] = struct{}{}
+	return sub, backlog, seq, fromStore, reset
+}
+
+func (h *changeHub) unsubscribe(stagID string, sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[stagID][sub]; ok {
+		delete(h.subscribers[stagID], sub)
+		close(sub.changes)
+	}
+}
+
+// close ends every subscription.
+func (h *changeHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for stagID, subs := range h.subscribers {
+		for sub := range subs {
+			close(sub.changes)
+		}
+		delete(h.subscribers, stagID)
+	}
+}
+
+func (h *changeHub) subscriberCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := 0
+	for _, subs := range h.subscribers {
+		count += len(subs)
+	}
+	return count
+}
+
+// publishChange records a committed anchor change for subscribers.
+func (s *Service) publishChange(changeType string, anchor *storage.Anchor, version *storage.AnchorVersion) {
+	change := &AnchorChange{
+		Type:       changeType,
+		StagID:     anchor.StagID,
+		AnchorID:   anchor.ID,
+		AnchorType: anchor.Type,
+		Version:    version,
+		Timestamp:  time.Now(),
+	}
+	if version != nil {
+		change.VersionID = version.VersionID
+	}
+	s.changes.publish(change)
+}
+
+// storedChanges rebuilds the changes after since from the store: the latest
+// version of every anchor updated at or after since, in commit order. An
+// anchor updated at exactly since may be sent again.
+func (s *Service) storedChanges(stagID string, sub *subscriber, since uint64) (*SubscriptionResync, []*AnchorChange, error) {
+	anchors, err := s.store.ListAnchors(stagID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resync := &SubscriptionResync{
+		Type:      "subscription_resync",
+		StagID:    stagID,
+		Seq:       since,
+		AnchorIDs: make([]string, 0, len(anchors)),
+		Timestamp: time.Now(),
+	}
+	var backlog []*AnchorChange
+	for _, anchor := range anchors {
+		if !sub.wants(anchor.Type) {
+			continue
+		}
+		resync.AnchorIDs = append(resync.AnchorIDs, anchor.ID)
+
+		seq := uint64(anchor.UpdatedAt.UnixMicro())
+		if seq < since || anchor.LatestVersion == nil {
+			continue
+		}
+		change := &AnchorChange{
+			Type:       ChangeAnchorUpdated,
+			Seq:        seq,
+			StagID:     stagID,
+			AnchorID:   anchor.ID,
+			AnchorType: anchor.Type,
+			VersionID:  anchor.LatestVersionID,
+			Version:    anchor.LatestVersion,
+			Timestamp:  anchor.UpdatedAt,
+		}
+		if uint64(anchor.CreatedAt.UnixMicro()) >= since {
+			change.Type = ChangeAnchorCreated
+		}
+		backlog = append(backlog, change)
+	}
+	sort.Strings(resync.AnchorIDs)
+	sort.SliceStable(backlog, func(i, j int) bool { return backlog[i].Seq < backlog[j].Seq })
+
+	return resync, backlog, nil
+}
+
+// resume works out what a subscriber missed. A resync is returned when the
+// backlog was read from the store, and reset is true when it cannot be
+// replayed at all.
+func (s *Service) resume(stagID string, sub *subscriber, since uint64, backlog []*AnchorChange, fromStore, reset bool) (*SubscriptionResync, []*AnchorChange, bool) {
+	if !fromStore {
+		return nil, backlog, reset
+	}
+	resync, backlog, err := s.storedChanges(stagID, sub, since)
+	if err != nil {
+		s.logger.Error("Failed to read changes for resuming subscriber", "stag_id", stagID, "since", since, "error", err)
+		return nil, nil, true
+	}
+	return resync, backlog, false
+}
+
+// HandleSubscribe streams anchor changes of a stag as they are committed,
+// over a WebSocket when the request asks for an upgrade and as
+// Server-Sent Events otherwise.
+//
+// Query parameters:
+//   - types: comma-separated anchor types to receive (default all)
+//   - since: resume after this seq; SSE clients may send Last-Event-ID instead.
+//     Changes still in memory are replayed as they were, older ones are
+//     rebuilt from the stored anchor versions.
+func (s *Service) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	stagID := mux.Vars(r)["stag_id"]
+
+	var types map[string]bool
+	if t := r.URL.Query().Get("types"); t != "" {
+		types = make(map[string]bool)
+		for _, anchorType := range strings.Split(t, ",") {
+			if anchorType = strings.TrimSpace(anchorType); anchorType != "" {
+				types[strings.ToLower(anchorType)] = true
+			}
+		}
+	}
+
+	cursor := r.URL.Query().Get("since")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+	var since uint64
+	resuming := cursor != ""
+	if resuming {
+		parsed, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			http.Error(w, "since must be a change sequence number", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocketSubscription(w, r, stagID, types, since, resuming)
+		return
+	}
+	s.serveEventStream(w, r, stagID, types, since, resuming)
+}
+
+func (s *Service) serveWebSocketSubscription(w http.ResponseWriter, r *http.Request, stagID string, types map[string]bool, since uint64, resuming bool) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("Subscription upgrade failed", "stag_id", stagID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sub, backlog, seq, fromStore, reset := s.changes.subscribe(stagID, types, since, resuming)
+	defer s.changes.unsubscribe(stagID, sub)
+	resync, backlog, reset := s.resume(stagID, sub, since, backlog, fromStore, reset)
+
+	s.logger.Info("📡 Subscriber connected", "stag_id", stagID, "transport", "websocket", "since", since, "backlog", len(backlog), "from_store", resync != nil, "reset", reset)
+
+	// Reader: answers pongs and notices when the subscriber goes away
+	gone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(3 * subscriptionPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(3 * subscriptionPingInterval))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(subscriptionWriteWait))
+		return conn.WriteJSON(v)
+	}
+
+	if reset {
+		if err := send(s.subscriptionReset(stagID, seq)); err != nil {
+			return
+		}
+	}
+	if resync != nil {
+		if err := send(resync); err != nil {
+			return
+		}
+	}
+	for _, change := range backlog {
+		if err := send(change); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(subscriptionPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case change, ok := <-sub.changes:
+			if !ok {
+				reason := "server shutting down"
+				if sub.lagged {
+					reason = "subscriber too slow, resume with since"
+				}
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+					time.Now().Add(time.Second))
+				return
+			}
+			if err := send(change); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(subscriptionWriteWait)); err != nil {
+				return
+			}
+		case <-gone:
+			s.logger.Info("Subscriber disconnected", "stag_id", stagID, "transport", "websocket")
+			return
+		}
+	}
+}
+
+func (s *Service) serveEventStream(w http.ResponseWriter, r *http.Request, stagID string, types map[string]bool, since uint64, resuming bool) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, backlog, seq, fromStore, reset := s.changes.subscribe(stagID, types, since, resuming)
+	defer s.changes.unsubscribe(stagID, sub)
+	resync, backlog, reset := s.resume(stagID, sub, since, backlog, fromStore, reset)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	s.logger.Info("📡 Subscriber connected", "stag_id", stagID, "transport", "sse", "since", since, "backlog", len(backlog), "from_store", resync != nil, "reset", reset)
+
+	writeEvent := func(event string, id uint64, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if reset {
+		if err := writeEvent("subscription_reset", seq, s.subscriptionReset(stagID, seq)); err != nil {
+			return
+		}
+	}
+	if resync != nil {
+		if err := writeEvent(resync.Type, resync.Seq, resync); err != nil {
+			return
+		}
+	}
+	for _, change := range backlog {
+		if err := writeEvent(change.Type, change.Seq, change); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(subscriptionPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case change, ok := <-sub.changes:
+			if !ok {
+				return
+			}
+			if err := writeEvent(change.Type, change.Seq, change); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			s.logger.Info("Subscriber disconnected", "stag_id", stagID, "transport", "sse")
+			return
+		}
+	}
+}
+
+func (s *Service) subscriptionReset(stagID string, seq uint64) *SubscriptionReset {
+	return &SubscriptionReset{
+		Type:      "subscription_reset",
+		StagID:    stagID,
+		Seq:       seq,
+		Reason:    "changes after the requested seq cannot be replayed; refetch the stag",
+		Timestamp: time.Now(),
+	}
+}
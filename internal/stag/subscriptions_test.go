@@ -0,0 +1,145 @@
+package stag
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tabular/local-pipeline/internal/config"
+	"github.com/tabular/local-pipeline/internal/logging"
+	"github.com/tabular/local-pipeline/internal/storage"
+)
+
+func openTestStore(t *testing.T) storage.Storage {
+	t.Helper()
+
+	store, err := storage.NewBoltStorage(filepath.Join(t.TempDir(), "stag.db"), 0.5)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func newTestService(t *testing.T, store storage.Storage) *Service {
+	t.Helper()
+
+	cfg, err := config.Load("")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	s := NewService(cfg, store, logging.NewLogger("error", "stag"))
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func poseEvent(clientID string, x float64) *storage.SpatialEvent {
+	return &storage.SpatialEvent{
+		EventType: "pose",
+		SessionID: "room",
+		ClientID:  clientID,
+		PoseData: &storage.PoseData{
+			Transform: &storage.Transform{Translation: [3]float64{x, 0, 0}, Rotation: [4]float64{0, 0, 0, 1}},
+		},
+		Metadata: map[string]interface{}{},
+	}
+}
+
+func ingest(t *testing.T, s *Service, event *storage.SpatialEvent) {
+	t.Helper()
+
+	if _, err := s.processEvent(event); err != nil {
+		t.Fatalf("failed to process event: %v", err)
+	}
+}
+
+func TestSubscribeResumesFromHistory(t *testing.T) {
+	s := newTestService(t, openTestStore(t))
+
+	ingest(t, s, poseEvent("a", 1))
+	since := s.changes.current("room")
+	ingest(t, s, poseEvent("b", 1))
+	ingest(t, s, poseEvent("a", 2))
+
+	sub, backlog, _, fromStore, reset := s.changes.subscribe("room", nil, since, true)
+	defer s.changes.unsubscribe("room", sub)
+
+	if fromStore || reset {
+		t.Fatalf("resume from history: fromStore=%v reset=%v", fromStore, reset)
+	}
+	if len(backlog) != 2 || backlog[0].AnchorID != "pose_b" || backlog[1].AnchorID != "pose_a" {
+		t.Fatalf("backlog = %v, want pose_b then pose_a", changeAnchors(backlog))
+	}
+	if backlog[0].Seq <= since || backlog[1].Seq <= backlog[0].Seq {
+		t.Fatalf("backlog seqs %d, %d do not increase after %d", backlog[0].Seq, backlog[1].Seq, since)
+	}
+}
+
+func TestSubscribeResumesFromStoreAfterRestart(t *testing.T) {
+	store := openTestStore(t)
+	before := newTestService(t, store)
+
+	ingest(t, before, poseEvent("a", 1))
+	ingest(t, before, poseEvent("b", 1))
+	since := before.changes.current("room")
+	ingest(t, before, poseEvent("a", 2))
+	ingest(t, before, poseEvent("c", 1))
+
+	after := newTestService(t, store)
+	sub, backlog, _, fromStore, reset := after.changes.subscribe("room", nil, since, true)
+	defer after.changes.unsubscribe("room", sub)
+	if !fromStore || reset || len(backlog) != 0 {
+		t.Fatalf("resume after restart: fromStore=%v reset=%v backlog=%d", fromStore, reset, len(backlog))
+	}
+
+	resync, backlog, reset := after.resume("room", sub, since, backlog, fromStore, reset)
+	if reset || resync == nil {
+		t.Fatalf("resume from store: resync=%v reset=%v", resync, reset)
+	}
+	if got := resync.AnchorIDs; len(got) != 3 || got[0] != "pose_a" || got[1] != "pose_b" || got[2] != "pose_c" {
+		t.Fatalf("resync anchors = %v, want pose_a pose_b pose_c", got)
+	}
+
+	if len(backlog) != 2 {
+		t.Fatalf("backlog = %v, want pose_a and pose_c", changeAnchors(backlog))
+	}
+	updated, created := backlog[0], backlog[1]
+	if updated.AnchorID != "pose_a" || updated.Type != ChangeAnchorUpdated || updated.VersionID != "v2" {
+		t.Fatalf("first change = %s %s %s, want anchor_updated pose_a v2", updated.Type, updated.AnchorID, updated.VersionID)
+	}
+	if updated.Version == nil || updated.Version.PoseData.Transform.Translation[0] != 2 {
+		t.Fatalf("first change does not carry the latest pose_a version")
+	}
+	if created.AnchorID != "pose_c" || created.Type != ChangeAnchorCreated {
+		t.Fatalf("second change = %s %s, want anchor_created pose_c", created.Type, created.AnchorID)
+	}
+	if updated.Seq < since || created.Seq < updated.Seq {
+		t.Fatalf("stored change seqs %d, %d are not in commit order after %d", updated.Seq, created.Seq, since)
+	}
+
+	// Changes after the restart come after every replayed one
+	ingest(t, after, poseEvent("b", 2))
+	if seq := after.changes.current("room"); seq <= created.Seq {
+		t.Fatalf("seq %d after restart is not after replayed seq %d", seq, created.Seq)
+	}
+}
+
+func TestSubscribeResetsCursorFromTheFuture(t *testing.T) {
+	s := newTestService(t, openTestStore(t))
+	ingest(t, s, poseEvent("a", 1))
+
+	since := s.changes.current("room") + 1000
+	sub, _, seq, fromStore, reset := s.changes.subscribe("room", nil, since, true)
+	defer s.changes.unsubscribe("room", sub)
+
+	if !reset || fromStore || seq >= since {
+		t.Fatalf("cursor ahead of seq %d: fromStore=%v reset=%v", seq, fromStore, reset)
+	}
+}
+
+func changeAnchors(changes []*AnchorChange) []string {
+	ids := make([]string, len(changes))
+	for i, change := range changes {
+		ids[i] = change.AnchorID
+	}
+	return ids
+}
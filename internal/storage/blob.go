@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	"go.etcd.io/bbolt"
+)
+
+// Large version payloads (camera images, depth maps and point clouds) are
+// kept in a content-addressed blob store instead of inline in the version.
+// A blob is keyed by the SHA-256 of its bytes, so identical payloads are
+// stored once, and is reference counted; it is deleted with the last
+// version that references it.
+
+const (
+	// blobMinSize is the smallest payload, in bytes, moved into the blob store
+	blobMinSize = 4 << 10
+
+	// blobChunkSize splits blobs into values bbolt can place without
+	// needing a long run of free pages
+	blobChunkSize = 256 << 10
+)
+
+// Payload names used as keys of AnchorVersion.Blobs.
+const (
+	blobCameraImage          = "camera_data.image_data"
+	blobDepthData            = "depth_data.data"
+	blobDepthConfidence      = "depth_data.confidence"
+	blobPointCloudPoints     = "point_cloud_data.points"
+	blobPointCloudColors     = "point_cloud_data.colors"
+	blobPointCloudNormals    = "point_cloud_data.normals"
+	blobPointCloudConfidence = "point_cloud_data.confidence"
+)
+
+// floatPayloads returns the version's float array payloads by blob name.
+func floatPayloads(version *AnchorVersion) map[string]*[]float64 {
+	fields := make(map[string]*[]float64)
+	if version.DepthData != nil {
+		fields[blobDepthData] = &version.DepthData.Data
+		fields[blobDepthConfidence] = &version.DepthData.Confidence
+	}
+	if version.PointCloudData != nil {
+		fields[blobPointCloudPoints] = &version.PointCloudData.Points
+		fields[blobPointCloudColors] = &version.PointCloudData.Colors
+		fields[blobPointCloudNormals] = &version.PointCloudData.Normals
+		fields[blobPointCloudConfidence] = &version.PointCloudData.Confidence
+	}
+	return fields
+}
+
+func encodeFloats(values []float64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(data[8*i:], math.Float64bits(v))
+	}
+	return data
+}
+
+func decodeFloats(data []byte) ([]float64, error) {
+	if len(data)%8 != 0 {
+		return nil, fmt.Errorf("float array blob has %d bytes, not a multiple of 8", len(data))
+	}
+	values := make([]float64, len(data)/8)
+	for i := range values {
+		values[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	return values, nil
+}
+
+func blobChunkKey(hash string, index uint64) []byte {
+	return append([]byte(hash+":"), encodeSeq(index)...)
+}
+
+// putBlob stores data, or adds a reference to an identical blob, and
+// returns its hash.
+func putBlob(tx *bbolt.Tx, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	refs := tx.Bucket([]byte(BlobRefsBucket))
+	count := uint64(0)
+	if v := refs.Get([]byte(hash)); v != nil {
+		count = binary.BigEndian.Uint64(v)
+	}
+
+	if count == 0 {
+		blobs := tx.Bucket([]byte(BlobsBucket))
+		for i := 0; i == 0 || i*blobChunkSize < len(data); i++ {
+			end := (i + 1) * blobChunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := blobs.Put(blobChunkKey(hash, uint64(i)), data[i*blobChunkSize:end]); err != nil {
+				return "", fmt.Errorf("failed to store blob %s: %w", hash, err)
+			}
+		}
+	}
+
+	if err := refs.Put([]byte(hash), encodeSeq(count+1)); err != nil {
+		return "", fmt.Errorf("failed to reference blob %s: %w", hash, err)
+	}
+	return hash, nil
+}
+
+// getBlob reassembles a blob from its chunks.
+func getBlob(tx *bbolt.Tx, hash string) ([]byte, error) {
+	prefix := []byte(hash + ":")
+	var data []byte
+	found := false
+	c := tx.Bucket([]byte(BlobsBucket)).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		data = append(data, v...)
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("blob %s not found", hash)
+	}
+	return data, nil
+}
+
+// releaseBlob drops a reference to a blob, deleting it with the last one.
+func releaseBlob(tx *bbolt.Tx, hash string) error {
+	refs := tx.Bucket([]byte(BlobRefsBucket))
+	v := refs.Get([]byte(hash))
+	if v == nil {
+		return nil
+	}
+	if count := binary.BigEndian.Uint64(v); count > 1 {
+		return refs.Put([]byte(hash), encodeSeq(count-1))
+	}
+
+	prefix := []byte(hash + ":")
+	blobs := tx.Bucket([]byte(BlobsBucket))
+	var chunks [][]byte
+	c := blobs.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		chunks = append(chunks, append([]byte(nil), k...))
+	}
+	for _, k := range chunks {
+		if err := blobs.Delete(k); err != nil {
+			return fmt.Errorf("failed to delete blob %s: %w", hash, err)
+		}
+	}
+	return refs.Delete([]byte(hash))
+}
+
+// storeBlobs moves a version's large payloads into the blob store and
+// records their hashes in Blobs. The payload structs are replaced with
+// copies, so the caller's version is left untouched if version is a
+// shallow copy of it.
+func storeBlobs(tx *bbolt.Tx, version *AnchorVersion) error {
+	if version.CameraData != nil {
+		camera := *version.CameraData
+		version.CameraData = &camera
+		if len(camera.ImageData) >= blobMinSize {
+			hash, err := putBlob(tx, camera.ImageData)
+			if err != nil {
+				return err
+			}
+			addBlobRef(version, blobCameraImage, hash)
+			camera.ImageData = nil
+		}
+	}
+	if version.DepthData != nil {
+		depth := *version.DepthData
+		version.DepthData = &depth
+	}
+	if version.PointCloudData != nil {
+		cloud := *version.PointCloudData
+		version.PointCloudData = &cloud
+	}
+
+	for name, field := range floatPayloads(version) {
+		if 8*len(*field) < blobMinSize {
+			continue
+		}
+		hash, err := putBlob(tx, encodeFloats(*field))
+		if err != nil {
+			return err
+		}
+		addBlobRef(version, name, hash)
+		*field = nil
+	}
+	return nil
+}
+
+func addBlobRef(version *AnchorVersion, name, hash string) {
+	if version.Blobs == nil {
+		version.Blobs = make(map[string]string)
+	}
+	version.Blobs[name] = hash
+}
+
+// loadBlobs restores the payloads of a version read from the versions
+// bucket.
+func loadBlobs(tx *bbolt.Tx, version *AnchorVersion) error {
+	for name, hash := range version.Blobs {
+		data, err := getBlob(tx, hash)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", name, err)
+		}
+
+		if name == blobCameraImage {
+			if version.CameraData != nil {
+				version.CameraData.ImageData = data
+			}
+			continue
+		}
+		field, ok := floatPayloads(version)[name]
+		if !ok {
+			return fmt.Errorf("version %s references blob for unknown payload %s", version.VersionID, name)
+		}
+		if *field, err = decodeFloats(data); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+	}
+	version.Blobs = nil
+	return nil
+}
+
+// deleteVersions removes an anchor's versions and releases the blobs they
+// reference. prefix is the anchor's version key prefix, stagID:anchorID:.
+func deleteVersions(tx *bbolt.Tx, prefix []byte) error {
+	bucket := tx.Bucket([]byte(VersionsBucket))
+
+	type stored struct {
+		key   []byte
+		blobs map[string]string
+	}
+	var versions []stored
+
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 {
+			continue
+		}
+		var version AnchorVersion
+		if err := UnmarshalVersion(v, &version); err != nil {
+			return fmt.Errorf("failed to unmarshal version %s: %w", string(k), err)
+		}
+		versions = append(versions, stored{key: append([]byte(nil), k...), blobs: version.Blobs})
+	}
+
+	for _, version := range versions {
+		for _, hash := range version.blobs {
+			if err := releaseBlob(tx, hash); err != nil {
+				return err
+			}
+		}
+		if err := bucket.Delete(version.key); err != nil {
+			return fmt.Errorf("failed to delete version %s: %w", string(version.key), err)
+		}
+	}
+	return nil
+}
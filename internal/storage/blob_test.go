@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// blobCounts returns the number of chunks in the blob store and the
+// reference count of every blob.
+func blobCounts(t *testing.T, store *BoltStorage) (chunks int, refs map[string]uint64) {
+	t.Helper()
+
+	refs = make(map[string]uint64)
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		chunks = tx.Bucket([]byte(BlobsBucket)).Stats().KeyN
+		return tx.Bucket([]byte(BlobRefsBucket)).ForEach(func(k, v []byte) error {
+			refs[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to read blob buckets: %v", err)
+	}
+	return chunks, refs
+}
+
+func TestBlobsSharedAndReleased(t *testing.T) {
+	store := openTestStorage(t)
+
+	// The image spans three chunks, the depth map fits in one
+	image := bytes.Repeat([]byte{0xff, 0xd8, 0x01, 0x02}, (2*blobChunkSize+blobChunkSize/2)/4)
+	depth := make([]float64, 64*48)
+	for i := range depth {
+		depth[i] = float64(i) / 16
+	}
+	payload := func() *AnchorVersion {
+		return &AnchorVersion{
+			Hash:       "same",
+			CameraData: &CameraData{ImageData: append([]byte(nil), image...), Width: 640, Height: 480, Format: "jpeg"},
+			DepthData:  &DepthData{Data: append([]float64(nil), depth...), Width: 64, Height: 48},
+		}
+	}
+
+	for _, anchorID := range []string{"camera_a", "camera_b"} {
+		anchor := createTestAnchor(t, store, "room", anchorID)
+		version := payload()
+		addTestVersion(t, store, anchor, version)
+		if len(version.CameraData.ImageData) != len(image) || version.Blobs != nil {
+			t.Fatalf("storing %s modified the caller's version", anchorID)
+		}
+	}
+
+	chunks, refs := blobCounts(t, store)
+	if chunks != 4 {
+		t.Fatalf("blob store has %d chunks, want 4 (image 3, depth 1)", chunks)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("blob store has %d blobs, want 2", len(refs))
+	}
+	for hash, count := range refs {
+		if count != 2 {
+			t.Fatalf("blob %s has %d references, want 2", hash, count)
+		}
+	}
+
+	// Payloads are stored out of line and restored on read
+	stored := storedVersion(t, store, "room:camera_a", 1)
+	if stored.CameraData.ImageData != nil || stored.DepthData.Data != nil || len(stored.Blobs) != 2 {
+		t.Fatalf("stored version keeps its payloads inline")
+	}
+	for _, anchorID := range []string{"camera_a", "camera_b"} {
+		anchor, err := store.GetAnchor("room", anchorID)
+		if err != nil {
+			t.Fatalf("GetAnchor %s: %v", anchorID, err)
+		}
+		latest := anchor.LatestVersion
+		if !bytes.Equal(latest.CameraData.ImageData, image) || !reflect.DeepEqual(latest.DepthData.Data, depth) || latest.Blobs != nil {
+			t.Fatalf("%s payloads were not restored from the blob store", anchorID)
+		}
+	}
+
+	if err := store.DeleteAnchor("room", "camera_a"); err != nil {
+		t.Fatalf("DeleteAnchor camera_a: %v", err)
+	}
+	chunks, refs = blobCounts(t, store)
+	if chunks != 4 || len(refs) != 2 {
+		t.Fatalf("after deleting one anchor: %d chunks, %d blobs; want 4 and 2", chunks, len(refs))
+	}
+	for hash, count := range refs {
+		if count != 1 {
+			t.Fatalf("blob %s has %d references after deleting one anchor, want 1", hash, count)
+		}
+	}
+	versions, err := store.GetAnchorVersions("room", "camera_b")
+	if err != nil || len(versions) != 1 || !bytes.Equal(versions[0].CameraData.ImageData, image) {
+		t.Fatalf("camera_b lost its payload when camera_a was deleted (err %v)", err)
+	}
+
+	if err := store.DeleteAnchor("room", "camera_b"); err != nil {
+		t.Fatalf("DeleteAnchor camera_b: %v", err)
+	}
+	if chunks, refs = blobCounts(t, store); chunks != 0 || len(refs) != 0 {
+		t.Fatalf("after deleting both anchors: %d chunks, %d blobs; want none", chunks, len(refs))
+	}
+}
+
+func TestSmallPayloadsStayInline(t *testing.T) {
+	store := openTestStorage(t)
+	anchor := createTestAnchor(t, store, "room", "camera")
+	addTestVersion(t, store, anchor, &AnchorVersion{
+		Hash:       "small",
+		CameraData: &CameraData{ImageData: make([]byte, blobMinSize-1)},
+		DepthData:  &DepthData{Data: make([]float64, blobMinSize/8-1), Width: 1, Height: blobMinSize/8 - 1},
+	})
+
+	stored := storedVersion(t, store, "room:camera", 1)
+	if len(stored.Blobs) != 0 || len(stored.CameraData.ImageData) != blobMinSize-1 {
+		t.Fatalf("payloads below blobMinSize were moved to the blob store")
+	}
+	if chunks, refs := blobCounts(t, store); chunks != 0 || len(refs) != 0 {
+		t.Fatalf("blob store has %d chunks, %d blobs; want none", chunks, len(refs))
+	}
+}
@@ -0,0 +1,704 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Anchors and versions are stored in a compact binary form: a format byte
+// followed by the record's fields in a fixed order, with float arrays as
+// raw little-endian values. Records written as JSON by older builds start
+// with '{' and are still read.
+//
+// Adding a field to a stored type means adding it here under a new format
+// byte, keeping the decoder for the old one.
+
+const (
+	// formatJSON is the first byte of a JSON-encoded record
+	formatJSON byte = '{'
+
+	// formatBinaryV1 is the first binary record layout
+	formatBinaryV1 byte = 0x01
+)
+
+// Tags of the values held in metadata maps.
+const (
+	valueNull byte = iota
+	valueFalse
+	valueTrue
+	valueNumber
+	valueString
+	valueList
+	valueMap
+	valueJSON // any other type, stored as its JSON encoding
+)
+
+// MarshalVersion encodes a version for storage.
+func MarshalVersion(version *AnchorVersion) ([]byte, error) {
+	w := &recordWriter{buf: make([]byte, 0, 256)}
+	w.buf = append(w.buf, formatBinaryV1)
+	w.version(version)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// UnmarshalVersion decodes a stored version in either the binary or the
+// JSON format.
+func UnmarshalVersion(data []byte, version *AnchorVersion) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty version record")
+	}
+	switch data[0] {
+	case formatJSON:
+		return json.Unmarshal(data, version)
+	case formatBinaryV1:
+		r := &recordReader{data: data[1:]}
+		*version = AnchorVersion{}
+		r.version(version)
+		return r.done()
+	default:
+		return fmt.Errorf("unknown version record format %#x", data[0])
+	}
+}
+
+// MarshalAnchor encodes an anchor for storage. LatestVersion is not stored.
+func MarshalAnchor(anchor *Anchor) ([]byte, error) {
+	w := &recordWriter{buf: make([]byte, 0, 128)}
+	w.buf = append(w.buf, formatBinaryV1)
+	w.anchor(anchor)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// UnmarshalAnchor decodes a stored anchor in either the binary or the JSON
+// format.
+func UnmarshalAnchor(data []byte, anchor *Anchor) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty anchor record")
+	}
+	switch data[0] {
+	case formatJSON:
+		return json.Unmarshal(data, anchor)
+	case formatBinaryV1:
+		r := &recordReader{data: data[1:]}
+		*anchor = Anchor{}
+		r.anchor(anchor)
+		return r.done()
+	default:
+		return fmt.Errorf("unknown anchor record format %#x", data[0])
+	}
+}
+
+// recordWriter appends binary fields to buf. The first error is kept in
+// err and later writes are ignored.
+type recordWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *recordWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *recordWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *recordWriter) float(v float64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *recordWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *recordWriter) boolean(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// present writes whether an optional field follows.
+func (w *recordWriter) present(ok bool) bool {
+	w.boolean(ok)
+	return ok
+}
+
+// Slice lengths are written plus one, so a nil slice (0) reads back as nil
+// and an empty one as empty, as with JSON.
+func (w *recordWriter) sliceLen(n int, isNil bool) {
+	if isNil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(n) + 1)
+	}
+}
+
+func (w *recordWriter) floats(values []float64) {
+	w.sliceLen(len(values), values == nil)
+	for _, v := range values {
+		w.float(v)
+	}
+}
+
+func (w *recordWriter) uint32s(values []uint32) {
+	w.sliceLen(len(values), values == nil)
+	for _, v := range values {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+	}
+}
+
+func (w *recordWriter) bytes(data []byte) {
+	w.sliceLen(len(data), data == nil)
+	w.buf = append(w.buf, data...)
+}
+
+func (w *recordWriter) time(t time.Time) {
+	data, err := t.MarshalBinary()
+	if err != nil && w.err == nil {
+		w.err = fmt.Errorf("failed to encode time: %w", err)
+	}
+	w.bytes(data)
+}
+
+func (w *recordWriter) transform(t *Transform) {
+	if !w.present(t != nil) {
+		return
+	}
+	for _, v := range t.Translation {
+		w.float(v)
+	}
+	for _, v := range t.Rotation {
+		w.float(v)
+	}
+	for _, v := range t.Scale {
+		w.float(v)
+	}
+}
+
+func (w *recordWriter) value(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.buf = append(w.buf, valueNull)
+	case bool:
+		if v {
+			w.buf = append(w.buf, valueTrue)
+		} else {
+			w.buf = append(w.buf, valueFalse)
+		}
+	case float64:
+		w.buf = append(w.buf, valueNumber)
+		w.float(v)
+	case string:
+		w.buf = append(w.buf, valueString)
+		w.str(v)
+	case []interface{}:
+		w.buf = append(w.buf, valueList)
+		w.uvarint(uint64(len(v)))
+		for _, item := range v {
+			w.value(item)
+		}
+	case map[string]interface{}:
+		w.buf = append(w.buf, valueMap)
+		w.metadata(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil && w.err == nil {
+			w.err = fmt.Errorf("failed to encode metadata value: %w", err)
+		}
+		w.buf = append(w.buf, valueJSON)
+		w.bytes(data)
+	}
+}
+
+func (w *recordWriter) metadata(m map[string]interface{}) {
+	w.sliceLen(len(m), m == nil)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.str(k)
+		w.value(m[k])
+	}
+}
+
+func (w *recordWriter) anchor(a *Anchor) {
+	w.str(a.ID)
+	w.str(a.StagID)
+	w.str(a.Type)
+	w.str(a.CurrentHash)
+	w.varint(int64(a.VersionCount))
+	w.str(a.LatestVersionID)
+	w.time(a.CreatedAt)
+	w.time(a.UpdatedAt)
+	w.str(a.LastSessionID)
+	w.str(a.LastClientID)
+	w.str(a.LastDeviceID)
+	w.metadata(a.Metadata)
+}
+
+func (w *recordWriter) version(v *AnchorVersion) {
+	w.str(v.VersionID)
+	w.str(v.Hash)
+	w.time(v.Timestamp)
+	w.str(v.ChangeType)
+	w.transform(v.Transform)
+
+	if m := v.MeshData; w.present(m != nil) {
+		w.str(m.AnchorID)
+		w.floats(m.Vertices)
+		w.uint32s(m.Faces)
+		w.floats(m.Normals)
+		w.floats(m.Colors)
+		w.floats(m.TextureCoords)
+		w.transform(m.Transform)
+		w.str(m.Classification)
+		w.float(m.Confidence)
+	}
+	if d := v.MeshDelta; w.present(d != nil) {
+		w.str(d.BaseVersionID)
+		w.varint(int64(d.VertexCount))
+		w.uvarint(uint64(len(d.VertexRanges)))
+		for _, r := range d.VertexRanges {
+			w.varint(int64(r.Start))
+			w.floats(r.Values)
+		}
+		w.varint(int64(d.FaceStart))
+		w.varint(int64(d.RemovedFaces))
+		w.uint32s(d.AddedFaces)
+	}
+	if p := v.PoseData; w.present(p != nil) {
+		w.transform(p.Transform)
+		for _, f := range [][3]float64{p.Velocity, p.Acceleration, p.AngularVelocity} {
+			for _, x := range f {
+				w.float(x)
+			}
+		}
+		w.float(p.Confidence)
+	}
+	if c := v.CameraData; w.present(c != nil) {
+		w.bytes(c.ImageData)
+		w.varint(int64(c.Width))
+		w.varint(int64(c.Height))
+		w.str(c.Format)
+		for _, x := range c.Intrinsics {
+			w.float(x)
+		}
+		w.floats(c.Distortion)
+		w.transform(c.Transform)
+		w.time(c.Timestamp)
+		w.float(c.Exposure)
+		w.varint(int64(c.ISO))
+		w.float(c.FocalLength)
+	}
+	if d := v.DepthData; w.present(d != nil) {
+		w.floats(d.Data)
+		w.varint(int64(d.Width))
+		w.varint(int64(d.Height))
+		w.floats(d.Confidence)
+		w.transform(d.Transform)
+		w.float(d.MinRange)
+		w.float(d.MaxRange)
+		w.time(d.Timestamp)
+	}
+	if p := v.PointCloudData; w.present(p != nil) {
+		w.floats(p.Points)
+		w.floats(p.Colors)
+		w.floats(p.Normals)
+		w.floats(p.Confidence)
+		w.transform(p.Transform)
+		w.time(p.Timestamp)
+	}
+	if l := v.LightingData; w.present(l != nil) {
+		w.float(l.AmbientIntensity)
+		for _, x := range l.DirectionalLight {
+			w.float(x)
+		}
+		w.floats(l.SphericalHarmonics)
+		w.float(l.ColorTemperature)
+		w.transform(l.Transform)
+		w.time(l.Timestamp)
+	}
+
+	blobs := make([]string, 0, len(v.Blobs))
+	for name := range v.Blobs {
+		blobs = append(blobs, name)
+	}
+	sort.Strings(blobs)
+	w.uvarint(uint64(len(blobs)))
+	for _, name := range blobs {
+		w.str(name)
+		w.str(v.Blobs[name])
+	}
+
+	w.str(v.EventID)
+	w.str(v.SessionID)
+	w.str(v.ClientID)
+	w.str(v.DeviceID)
+	w.uvarint(v.FrameNumber)
+	w.metadata(v.Metadata)
+}
+
+// recordReader reads binary fields from data. The first error is kept in
+// err and later reads return zero values.
+type recordReader struct {
+	data []byte
+	err  error
+}
+
+func (r *recordReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+	r.data = nil
+}
+
+// done reports the first decoding error, or trailing bytes.
+func (r *recordReader) done() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) > 0 {
+		return fmt.Errorf("%d unexpected bytes after record", len(r.data))
+	}
+	return nil
+}
+
+func (r *recordReader) next(n int) []byte {
+	if n < 0 || n > len(r.data) {
+		r.fail("record truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *recordReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *recordReader) int() int {
+	return int(r.varint())
+}
+
+func (r *recordReader) float() float64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *recordReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *recordReader) str() string {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail("record truncated")
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *recordReader) present() bool {
+	return r.byte() != 0
+}
+
+// sliceLen reads a length written by recordWriter.sliceLen, checking that
+// n elements of size bytes each fit in the remaining data.
+func (r *recordReader) sliceLen(size int) (n int, isNil bool) {
+	v := r.uvarint()
+	if v == 0 {
+		return 0, true
+	}
+	if v-1 > uint64(len(r.data)/size) {
+		r.fail("record truncated")
+		return 0, true
+	}
+	return int(v - 1), false
+}
+
+func (r *recordReader) floats() []float64 {
+	n, isNil := r.sliceLen(8)
+	if isNil {
+		return nil
+	}
+	b := r.next(8 * n)
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return values
+}
+
+func (r *recordReader) uint32s() []uint32 {
+	n, isNil := r.sliceLen(4)
+	if isNil {
+		return nil
+	}
+	b := r.next(4 * n)
+	values := make([]uint32, n)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return values
+}
+
+func (r *recordReader) bytes() []byte {
+	n, isNil := r.sliceLen(1)
+	if isNil {
+		return nil
+	}
+	return append([]byte{}, r.next(n)...)
+}
+
+func (r *recordReader) time() time.Time {
+	var t time.Time
+	data := r.bytes()
+	if data == nil {
+		return t
+	}
+	if err := t.UnmarshalBinary(data); err != nil {
+		r.fail("invalid time: %v", err)
+	}
+	return t
+}
+
+func (r *recordReader) transform() *Transform {
+	if !r.present() {
+		return nil
+	}
+	t := &Transform{}
+	for i := range t.Translation {
+		t.Translation[i] = r.float()
+	}
+	for i := range t.Rotation {
+		t.Rotation[i] = r.float()
+	}
+	for i := range t.Scale {
+		t.Scale[i] = r.float()
+	}
+	return t
+}
+
+func (r *recordReader) value() interface{} {
+	switch tag := r.byte(); tag {
+	case valueNull:
+		return nil
+	case valueFalse:
+		return false
+	case valueTrue:
+		return true
+	case valueNumber:
+		return r.float()
+	case valueString:
+		return r.str()
+	case valueList:
+		n := r.uvarint()
+		if n > uint64(len(r.data)) {
+			r.fail("record truncated")
+			return nil
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value()
+		}
+		return list
+	case valueMap:
+		return r.metadata()
+	case valueJSON:
+		var v interface{}
+		if err := json.Unmarshal(r.bytes(), &v); err != nil {
+			r.fail("invalid metadata value: %v", err)
+		}
+		return v
+	default:
+		r.fail("unknown metadata value tag %d", tag)
+		return nil
+	}
+}
+
+func (r *recordReader) metadata() map[string]interface{} {
+	n, isNil := r.sliceLen(2)
+	if isNil {
+		return nil
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		k := r.str()
+		m[k] = r.value()
+	}
+	return m
+}
+
+func (r *recordReader) anchor(a *Anchor) {
+	a.ID = r.str()
+	a.StagID = r.str()
+	a.Type = r.str()
+	a.CurrentHash = r.str()
+	a.VersionCount = r.int()
+	a.LatestVersionID = r.str()
+	a.CreatedAt = r.time()
+	a.UpdatedAt = r.time()
+	a.LastSessionID = r.str()
+	a.LastClientID = r.str()
+	a.LastDeviceID = r.str()
+	a.Metadata = r.metadata()
+}
+
+func (r *recordReader) version(v *AnchorVersion) {
+	v.VersionID = r.str()
+	v.Hash = r.str()
+	v.Timestamp = r.time()
+	v.ChangeType = r.str()
+	v.Transform = r.transform()
+
+	if r.present() {
+		v.MeshData = &MeshData{
+			AnchorID:      r.str(),
+			Vertices:      r.floats(),
+			Faces:         r.uint32s(),
+			Normals:       r.floats(),
+			Colors:        r.floats(),
+			TextureCoords: r.floats(),
+			Transform:     r.transform(),
+		}
+		v.MeshData.Classification = r.str()
+		v.MeshData.Confidence = r.float()
+	}
+	if r.present() {
+		d := &MeshDelta{
+			BaseVersionID: r.str(),
+			VertexCount:   r.int(),
+		}
+		n := r.uvarint()
+		if n > uint64(len(r.data)) {
+			r.fail("record truncated")
+			n = 0
+		}
+		for i := uint64(0); i < n; i++ {
+			d.VertexRanges = append(d.VertexRanges, VertexRange{Start: r.int(), Values: r.floats()})
+		}
+		d.FaceStart = r.int()
+		d.RemovedFaces = r.int()
+		d.AddedFaces = r.uint32s()
+		v.MeshDelta = d
+	}
+	if r.present() {
+		p := &PoseData{Transform: r.transform()}
+		for _, f := range []*[3]float64{&p.Velocity, &p.Acceleration, &p.AngularVelocity} {
+			for i := range f {
+				f[i] = r.float()
+			}
+		}
+		p.Confidence = r.float()
+		v.PoseData = p
+	}
+	if r.present() {
+		c := &CameraData{
+			ImageData: r.bytes(),
+			Width:     r.int(),
+			Height:    r.int(),
+			Format:    r.str(),
+		}
+		for i := range c.Intrinsics {
+			c.Intrinsics[i] = r.float()
+		}
+		c.Distortion = r.floats()
+		c.Transform = r.transform()
+		c.Timestamp = r.time()
+		c.Exposure = r.float()
+		c.ISO = r.int()
+		c.FocalLength = r.float()
+		v.CameraData = c
+	}
+	if r.present() {
+		d := &DepthData{
+			Data:       r.floats(),
+			Width:      r.int(),
+			Height:     r.int(),
+			Confidence: r.floats(),
+			Transform:  r.transform(),
+		}
+		d.MinRange = r.float()
+		d.MaxRange = r.float()
+		d.Timestamp = r.time()
+		v.DepthData = d
+	}
+	if r.present() {
+		v.PointCloudData = &PointCloudData{
+			Points:     r.floats(),
+			Colors:     r.floats(),
+			Normals:    r.floats(),
+			Confidence: r.floats(),
+			Transform:  r.transform(),
+			Timestamp:  r.time(),
+		}
+	}
+	if r.present() {
+		l := &LightingData{AmbientIntensity: r.float()}
+		for i := range l.DirectionalLight {
+			l.DirectionalLight[i] = r.float()
+		}
+		l.SphericalHarmonics = r.floats()
+		l.ColorTemperature = r.float()
+		l.Transform = r.transform()
+		l.Timestamp = r.time()
+		v.LightingData = l
+	}
+
+	if n := r.uvarint(); n > 0 {
+		if n > uint64(len(r.data)) {
+			r.fail("record truncated")
+		} else {
+			v.Blobs = make(map[string]string, n)
+			for i := uint64(0); i < n && r.err == nil; i++ {
+				name := r.str()
+				v.Blobs[name] = r.str()
+			}
+		}
+	}
+
+	v.EventID = r.str()
+	v.SessionID = r.str()
+	v.ClientID = r.str()
+	v.DeviceID = r.str()
+	v.FrameNumber = r.uvarint()
+	v.Metadata = r.metadata()
+}
@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sameRecord compares two records by their JSON form, which is how they are
+// served. Times compare by instant rather than by *time.Location pointer.
+func sameRecord(t *testing.T, got, want interface{}) {
+	t.Helper()
+
+	a, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("failed to marshal decoded record: %v", err)
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("failed to marshal expected record: %v", err)
+	}
+	if string(a) != string(b) {
+		t.Fatalf("decoded record differs\n got: %s\nwant: %s", a, b)
+	}
+}
+
+func testCodecTransform() *Transform {
+	return &Transform{
+		Translation: [3]float64{0.1, -2, 3.5},
+		Rotation:    [4]float64{0, 0.3826834, 0, 0.9238795},
+		Scale:       [3]float64{1, 1, 1},
+	}
+}
+
+// testCodecVersions returns one version per payload type, plus the edge
+// cases of the slice and metadata encodings.
+func testCodecVersions() map[string]*AnchorVersion {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 123456789, time.UTC)
+	base := func() *AnchorVersion {
+		return &AnchorVersion{
+			VersionID:   "v3",
+			Hash:        "5d41402abc4b2a76b9719d911017c592",
+			Timestamp:   at,
+			ChangeType:  "update",
+			Transform:   testCodecTransform(),
+			EventID:     "evt_1",
+			SessionID:   "session-1",
+			ClientID:    "client-1",
+			DeviceID:    "device-1",
+			FrameNumber: 1842,
+			Metadata:    map[string]interface{}{"trace_id": "1792132227383937233"},
+		}
+	}
+
+	versions := make(map[string]*AnchorVersion)
+
+	v := base()
+	v.MeshData = &MeshData{
+		AnchorID:       "mesh_1",
+		Vertices:       []float64{0, 1, 2, 3.25, -4, 5e-7},
+		Faces:          []uint32{0, 1, 0},
+		Normals:        []float64{0, 1, 0, 0, 1, 0},
+		Colors:         []float64{},
+		TextureCoords:  []float64{0.5, 0.5},
+		Transform:      testCodecTransform(),
+		Classification: "floor",
+		Confidence:     0.92,
+	}
+	versions["mesh"] = v
+
+	v = base()
+	v.MeshData = &MeshData{AnchorID: "mesh_1", Classification: "floor"}
+	v.MeshDelta = &MeshDelta{
+		BaseVersionID: "v2",
+		VertexCount:   9,
+		VertexRanges:  []VertexRange{{Start: 0, Values: []float64{1}}, {Start: 6, Values: []float64{7, 8, 9}}},
+		FaceStart:     3,
+		RemovedFaces:  3,
+		AddedFaces:    []uint32{0, 2, 1},
+	}
+	versions["mesh delta"] = v
+
+	v = base()
+	v.PoseData = &PoseData{
+		Transform:       testCodecTransform(),
+		Velocity:        [3]float64{0.1, 0, 0},
+		Acceleration:    [3]float64{0, -9.8, 0},
+		AngularVelocity: [3]float64{0, 0, 0.5},
+		Confidence:      1,
+	}
+	versions["pose"] = v
+
+	v = base()
+	v.CameraData = &CameraData{
+		ImageData:   []byte{0xff, 0xd8, 0xff, 0xe0, 0x00},
+		Width:       1920,
+		Height:      1440,
+		Format:      "jpeg",
+		Intrinsics:  [9]float64{1500, 0, 960, 0, 1500, 720, 0, 0, 1},
+		Distortion:  []float64{0.01, -0.002},
+		Transform:   testCodecTransform(),
+		Timestamp:   at.Add(time.Millisecond),
+		Exposure:    0.008,
+		ISO:         200,
+		FocalLength: 4.25,
+	}
+	versions["camera"] = v
+
+	v = base()
+	v.DepthData = &DepthData{
+		Data:       []float64{1.5, 2.25, 0},
+		Width:      3,
+		Height:     1,
+		Confidence: []float64{2, 1, 0},
+		Transform:  testCodecTransform(),
+		MinRange:   0.2,
+		MaxRange:   5,
+		Timestamp:  at,
+	}
+	versions["depth"] = v
+
+	v = base()
+	v.PointCloudData = &PointCloudData{
+		Points:     []float64{0, 0, 0, 1, 1, 1},
+		Colors:     []float64{1, 0, 0, 0, 1, 0},
+		Confidence: []float64{0.5, 0.75},
+		Timestamp:  at,
+	}
+	versions["point cloud"] = v
+
+	v = base()
+	v.LightingData = &LightingData{
+		AmbientIntensity:   1000,
+		DirectionalLight:   [3]float64{0, -1, 0},
+		SphericalHarmonics: []float64{0.1, 0.2, 0.3},
+		ColorTemperature:   6500,
+		Transform:          testCodecTransform(),
+		Timestamp:          at,
+	}
+	versions["lighting"] = v
+
+	v = base()
+	v.CameraData = &CameraData{Width: 640, Height: 480, Format: "jpeg"}
+	v.DepthData = &DepthData{Width: 256, Height: 192}
+	v.Blobs = map[string]string{
+		blobCameraImage: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		blobDepthData:   "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752",
+	}
+	versions["blobs"] = v
+
+	v = base()
+	v.Transform = nil
+	v.Timestamp = time.Time{}
+	v.Metadata = nil
+	versions["empty"] = v
+
+	v = base()
+	v.Metadata = map[string]interface{}{
+		"null":   nil,
+		"false":  false,
+		"true":   true,
+		"number": 3.25,
+		"string": "héllo",
+		"empty":  "",
+		"list":   []interface{}{1.0, "two", nil, []interface{}{true}},
+		"map":    map[string]interface{}{"nested": map[string]interface{}{"depth": 2.0}, "none": map[string]interface{}{}},
+	}
+	versions["metadata"] = v
+
+	return versions
+}
+
+func TestVersionCodecRoundTrip(t *testing.T) {
+	for name, version := range testCodecVersions() {
+		t.Run(name, func(t *testing.T) {
+			data, err := MarshalVersion(version)
+			if err != nil {
+				t.Fatalf("MarshalVersion: %v", err)
+			}
+			if data[0] != formatBinaryV1 {
+				t.Fatalf("record starts with %#x, want the binary format", data[0])
+			}
+
+			var got AnchorVersion
+			if err := UnmarshalVersion(data, &got); err != nil {
+				t.Fatalf("UnmarshalVersion: %v", err)
+			}
+			sameRecord(t, &got, version)
+			if !got.Timestamp.Equal(version.Timestamp) {
+				t.Fatalf("timestamp %v, want %v", got.Timestamp, version.Timestamp)
+			}
+
+			// The binary form is deterministic, whatever the map order
+			again, err := MarshalVersion(&got)
+			if err != nil {
+				t.Fatalf("MarshalVersion of decoded version: %v", err)
+			}
+			if string(again) != string(data) {
+				t.Fatalf("re-encoding the decoded version changed the record")
+			}
+		})
+	}
+}
+
+func TestMetadataOtherTypesStoredAsJSON(t *testing.T) {
+	version := &AnchorVersion{
+		VersionID: "v1",
+		Metadata: map[string]interface{}{
+			"int":     42,
+			"strings": []string{"a", "b"},
+			"struct":  struct{ X int }{X: 1},
+		},
+	}
+
+	data, err := MarshalVersion(version)
+	if err != nil {
+		t.Fatalf("MarshalVersion: %v", err)
+	}
+	var got AnchorVersion
+	if err := UnmarshalVersion(data, &got); err != nil {
+		t.Fatalf("UnmarshalVersion: %v", err)
+	}
+
+	// They read back as JSON would decode them
+	if n, ok := got.Metadata["int"].(float64); !ok || n != 42 {
+		t.Fatalf("int metadata = %#v, want float64 42", got.Metadata["int"])
+	}
+	sameRecord(t, got.Metadata["strings"], []interface{}{"a", "b"})
+	sameRecord(t, got.Metadata["struct"], map[string]interface{}{"X": 1.0})
+}
+
+func TestMetadataUnencodableValue(t *testing.T) {
+	version := &AnchorVersion{Metadata: map[string]interface{}{"ch": make(chan int)}}
+	if _, err := MarshalVersion(version); err == nil {
+		t.Fatalf("encoded a channel in metadata")
+	}
+}
+
+func TestAnchorCodecRoundTrip(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	anchor := &Anchor{
+		ID:              "mesh_1",
+		StagID:          "room",
+		Type:            "mesh",
+		CurrentHash:     "5d41402abc4b2a76b9719d911017c592",
+		VersionCount:    12,
+		LatestVersionID: "v12",
+		CreatedAt:       at,
+		UpdatedAt:       at.Add(time.Minute),
+		LastSessionID:   "session-1",
+		LastClientID:    "client-1",
+		LastDeviceID:    "device-1",
+		Metadata:        map[string]interface{}{"geom_signature": "12:3:0.5"},
+	}
+
+	// LatestVersion is loaded from the versions bucket and not stored
+	withVersion := *anchor
+	withVersion.LatestVersion = &AnchorVersion{VersionID: "v12"}
+	data, err := MarshalAnchor(&withVersion)
+	if err != nil {
+		t.Fatalf("MarshalAnchor: %v", err)
+	}
+
+	var got Anchor
+	if err := UnmarshalAnchor(data, &got); err != nil {
+		t.Fatalf("UnmarshalAnchor: %v", err)
+	}
+	if got.LatestVersion != nil {
+		t.Fatalf("LatestVersion was stored with the anchor")
+	}
+	sameRecord(t, &got, anchor)
+}
+
+// Rows written by builds before the binary format, as json.Marshal left them.
+const (
+	legacyVersionRow = `{"version_id":"v3","hash":"abc","timestamp":"2024-01-01T12:00:00Z","change_type":"update",` +
+		`"transform":{"translation":[1,2,3],"rotation":[0,0,0,1],"scale":[1,1,1]},` +
+		`"mesh_data":{"anchor_id":"mesh_1","vertices":[0,0,0,1,0,0,0,1,0],"faces":[0,1,2],"classification":"wall","confidence":0.5},` +
+		`"camera_data":{"image_data":"/9j/4A==","width":2,"height":1,"format":"jpeg","intrinsics":[1,0,0,0,1,0,0,0,1],"timestamp":"2024-01-01T12:00:00Z"},` +
+		`"event_id":"evt_1","session_id":"s","client_id":"c","device_id":"d","frame_number":7,` +
+		`"metadata":{"trace_id":"t","count":3,"tags":["a"]}}`
+	legacyAnchorRow = `{"id":"mesh_1","stag_id":"room","type":"mesh","current_hash":"abc","version_count":3,` +
+		`"created_at":"2024-01-01T12:00:00Z","updated_at":"2024-01-01T12:05:00Z",` +
+		`"last_session_id":"s","last_client_id":"c","last_device_id":"d","metadata":{"geom_signature":"x"}}`
+)
+
+func TestDecodeLegacyJSONRows(t *testing.T) {
+	var version AnchorVersion
+	if err := UnmarshalVersion([]byte(legacyVersionRow), &version); err != nil {
+		t.Fatalf("UnmarshalVersion of a JSON row: %v", err)
+	}
+	if version.VersionID != "v3" || version.MeshData == nil || len(version.MeshData.Faces) != 3 {
+		t.Fatalf("JSON version decoded as %+v", version)
+	}
+	if string(version.CameraData.ImageData) != "\xff\xd8\xff\xe0" || version.Metadata["count"] != 3.0 {
+		t.Fatalf("JSON version payloads decoded as %+v", version)
+	}
+
+	// Rewriting it in the binary format keeps everything
+	data, err := MarshalVersion(&version)
+	if err != nil {
+		t.Fatalf("MarshalVersion: %v", err)
+	}
+	var rewritten AnchorVersion
+	if err := UnmarshalVersion(data, &rewritten); err != nil {
+		t.Fatalf("UnmarshalVersion: %v", err)
+	}
+	sameRecord(t, &rewritten, &version)
+
+	var anchor Anchor
+	if err := UnmarshalAnchor([]byte(legacyAnchorRow), &anchor); err != nil {
+		t.Fatalf("UnmarshalAnchor of a JSON row: %v", err)
+	}
+	if anchor.ID != "mesh_1" || anchor.VersionCount != 3 || anchor.LatestVersionID != "" || anchor.Metadata["geom_signature"] != "x" {
+		t.Fatalf("JSON anchor decoded as %+v", anchor)
+	}
+
+	if err := UnmarshalVersion([]byte(`{"version_id":`), &version); err == nil {
+		t.Fatalf("decoded a truncated JSON row")
+	}
+}
+
+func TestDecodeRejectsTruncatedRecords(t *testing.T) {
+	for name, version := range testCodecVersions() {
+		data, err := MarshalVersion(version)
+		if err != nil {
+			t.Fatalf("MarshalVersion %s: %v", name, err)
+		}
+		for n := 0; n < len(data); n++ {
+			var got AnchorVersion
+			if err := UnmarshalVersion(data[:n], &got); err == nil {
+				t.Fatalf("%s version truncated to %d of %d bytes decoded without error", name, n, len(data))
+			}
+		}
+
+		var got AnchorVersion
+		if err := UnmarshalVersion(append(data, 0), &got); err == nil || !strings.Contains(err.Error(), "unexpected bytes") {
+			t.Fatalf("%s version with a trailing byte: error %v", name, err)
+		}
+	}
+
+	data, err := MarshalAnchor(&Anchor{ID: "a", StagID: "room", Metadata: map[string]interface{}{"k": "v"}})
+	if err != nil {
+		t.Fatalf("MarshalAnchor: %v", err)
+	}
+	for n := 0; n < len(data); n++ {
+		var got Anchor
+		if err := UnmarshalAnchor(data[:n], &got); err == nil {
+			t.Fatalf("anchor truncated to %d of %d bytes decoded without error", n, len(data))
+		}
+	}
+}
+
+func TestDecodeRejectsCorruptRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"unknown format", []byte{0x7f, 0, 0}, "unknown version record format"},
+		{"huge string", []byte{formatBinaryV1, 0xff, 0xff, 0xff, 0xff, 0x0f}, "truncated"},
+		{"unterminated varint", []byte{formatBinaryV1, 0x80, 0x80}, "invalid varint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got AnchorVersion
+			err := UnmarshalVersion(tt.data, &got)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// An unknown metadata value tag
+	data, err := MarshalVersion(&AnchorVersion{Metadata: map[string]interface{}{"k": nil}})
+	if err != nil {
+		t.Fatalf("MarshalVersion: %v", err)
+	}
+	data[len(data)-1] = 0xee
+	var got AnchorVersion
+	if err := UnmarshalVersion(data, &got); err == nil || !strings.Contains(err.Error(), "unknown metadata value tag") {
+		t.Fatalf("error %v, want an unknown tag", err)
+	}
+
+	// Overwriting any byte of a record must fail cleanly or decode, never
+	// panic
+	for name, version := range testCodecVersions() {
+		data, err := MarshalVersion(version)
+		if err != nil {
+			t.Fatalf("MarshalVersion %s: %v", name, err)
+		}
+		for i := 1; i < len(data); i++ {
+			for _, b := range []byte{0x00, 0x7f, 0xff} {
+				corrupt := append([]byte(nil), data...)
+				corrupt[i] = b
+				var got AnchorVersion
+				UnmarshalVersion(corrupt, &got)
+			}
+		}
+	}
+}
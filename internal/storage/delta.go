@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// Mesh versions are stored as deltas against the previous version. A full
+// keyframe is written when the delta would be larger than the snapshot
+// threshold (as a fraction of the mesh), when the previous version has no
+// mesh, or when the chain since the last keyframe reaches maxDeltaChain.
+
+// maxDeltaChain bounds how many deltas are replayed to read a version.
+const maxDeltaChain = 32
+
+// vertexRangeGap is how many unchanged components may sit between two
+// changed runs before they are stored as separate ranges.
+const vertexRangeGap = 3
+
+// meshFrame is the full geometry of one mesh version.
+type meshFrame struct {
+	versionID string
+	vertices  []float64
+	faces     []uint32
+	depth     int // deltas applied since the last keyframe
+}
+
+func keyframe(version *AnchorVersion) *meshFrame {
+	return &meshFrame{
+		versionID: version.VersionID,
+		vertices:  version.MeshData.Vertices,
+		faces:     version.MeshData.Faces,
+	}
+}
+
+// diffMesh encodes mesh against base: changed vertex components as ranges,
+// and faces as a single splice between their common prefix and suffix.
+func diffMesh(base *meshFrame, mesh *MeshData) *MeshDelta {
+	delta := &MeshDelta{
+		BaseVersionID: base.versionID,
+		VertexCount:   len(mesh.Vertices),
+	}
+
+	start, last := -1, -1
+	flush := func() {
+		if start >= 0 {
+			delta.VertexRanges = append(delta.VertexRanges, VertexRange{
+				Start:  start,
+				Values: append([]float64(nil), mesh.Vertices[start:last+1]...),
+			})
+		}
+	}
+	for i, v := range mesh.Vertices {
+		if i < len(base.vertices) && base.vertices[i] == v {
+			continue
+		}
+		if start >= 0 && i-last-1 > vertexRangeGap {
+			flush()
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+		last = i
+	}
+	flush()
+
+	old, faces := base.faces, mesh.Faces
+	prefix := 0
+	for prefix < len(old) && prefix < len(faces) && old[prefix] == faces[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(faces)-prefix && old[len(old)-1-suffix] == faces[len(faces)-1-suffix] {
+		suffix++
+	}
+	delta.FaceStart = prefix
+	delta.RemovedFaces = len(old) - prefix - suffix
+	if added := faces[prefix : len(faces)-suffix]; len(added) > 0 {
+		delta.AddedFaces = append([]uint32(nil), added...)
+	}
+
+	return delta
+}
+
+// deltaSize is the number of values a delta stores, comparable to the
+// vertex and face count of a full mesh.
+func deltaSize(delta *MeshDelta) int {
+	size := len(delta.AddedFaces)
+	for _, r := range delta.VertexRanges {
+		size += len(r.Values) + 1
+	}
+	return size
+}
+
+// apply returns the frame produced by applying delta on top of f.
+func (f *meshFrame) apply(versionID string, delta *MeshDelta) (*meshFrame, error) {
+	if delta.BaseVersionID != f.versionID {
+		return nil, fmt.Errorf("mesh delta of %s is based on %s, not %s", versionID, delta.BaseVersionID, f.versionID)
+	}
+
+	vertices := make([]float64, delta.VertexCount)
+	copy(vertices, f.vertices)
+	for _, r := range delta.VertexRanges {
+		if r.Start < 0 || r.Start+len(r.Values) > len(vertices) {
+			return nil, fmt.Errorf("mesh delta of %s has vertex range %d+%d outside %d vertices", versionID, r.Start, len(r.Values), len(vertices))
+		}
+		copy(vertices[r.Start:], r.Values)
+	}
+
+	if delta.FaceStart < 0 || delta.RemovedFaces < 0 || delta.FaceStart+delta.RemovedFaces > len(f.faces) {
+		return nil, fmt.Errorf("mesh delta of %s removes faces %d+%d outside %d faces", versionID, delta.FaceStart, delta.RemovedFaces, len(f.faces))
+	}
+	faces := make([]uint32, 0, len(f.faces)-delta.RemovedFaces+len(delta.AddedFaces))
+	faces = append(faces, f.faces[:delta.FaceStart]...)
+	faces = append(faces, delta.AddedFaces...)
+	faces = append(faces, f.faces[delta.FaceStart+delta.RemovedFaces:]...)
+
+	return &meshFrame{
+		versionID: versionID,
+		vertices:  vertices,
+		faces:     faces,
+		depth:     f.depth + 1,
+	}, nil
+}
+
+// meshFrameAt rebuilds the geometry of an anchor's version seq by replaying
+// deltas from the keyframe before it. It returns nil if that version does
+// not exist or has no mesh.
+func meshFrameAt(bucket *bbolt.Bucket, anchorKey string, seq uint64) (*meshFrame, error) {
+	var chain []AnchorVersion
+	for s := seq; ; s-- {
+		if s == 0 {
+			return nil, fmt.Errorf("no mesh keyframe before version %s of %s", versionID(seq), anchorKey)
+		}
+		data := bucket.Get(versionKeyFor(anchorKey, s))
+		if data == nil {
+			if s == seq {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("version %s of %s is missing from its mesh delta chain", versionID(s), anchorKey)
+		}
+
+		var version AnchorVersion
+		if err := UnmarshalVersion(data, &version); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal version: %w", err)
+		}
+		chain = append(chain, version)
+		if version.MeshDelta == nil {
+			break
+		}
+	}
+
+	base := &chain[len(chain)-1]
+	if base.MeshData == nil {
+		if len(chain) == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("mesh delta chain of %s starts at %s, which has no mesh", anchorKey, base.VersionID)
+	}
+
+	frame := keyframe(base)
+	for i := len(chain) - 2; i >= 0; i-- {
+		var err error
+		if frame, err = frame.apply(chain[i].VersionID, chain[i].MeshDelta); err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
+
+// encodeMeshDelta returns mesh as a delta against the anchor's version
+// seq-1, or nil if it should be stored as a keyframe.
+func (s *BoltStorage) encodeMeshDelta(bucket *bbolt.Bucket, anchorKey string, seq uint64, mesh *MeshData) *MeshDelta {
+	if seq <= 1 {
+		return nil
+	}
+
+	// A broken chain is not an error here; the keyframe starts a new one
+	base, err := meshFrameAt(bucket, anchorKey, seq-1)
+	if err != nil || base == nil || base.depth >= maxDeltaChain {
+		return nil
+	}
+
+	delta := diffMesh(base, mesh)
+	if float64(deltaSize(delta)) > s.snapshotThreshold*float64(len(mesh.Vertices)+len(mesh.Faces)) {
+		return nil
+	}
+	return delta
+}
+
+// meshReader restores the full mesh of delta-encoded versions read in
+// sequence order, reusing the previous version's geometry when it is the
+// base.
+type meshReader struct {
+	bucket    *bbolt.Bucket
+	anchorKey string
+	last      *meshFrame
+}
+
+// expand replaces a version's stored mesh delta with the full mesh. key is
+// the version's key in the versions bucket.
+func (r *meshReader) expand(key []byte, version *AnchorVersion) error {
+	if version.MeshDelta == nil {
+		if version.MeshData != nil {
+			r.last = keyframe(version)
+		}
+		return nil
+	}
+
+	base := r.last
+	if base == nil || base.versionID != version.MeshDelta.BaseVersionID {
+		seq := binary.BigEndian.Uint64(key[len(key)-8:])
+		var err error
+		if base, err = meshFrameAt(r.bucket, r.anchorKey, seq-1); err != nil {
+			return err
+		}
+		if base == nil {
+			return fmt.Errorf("base version %s of %s is missing", version.MeshDelta.BaseVersionID, version.VersionID)
+		}
+	}
+
+	frame, err := base.apply(version.VersionID, version.MeshDelta)
+	if err != nil {
+		return err
+	}
+	var mesh MeshData
+	if version.MeshData != nil {
+		mesh = *version.MeshData
+	}
+	mesh.Vertices = frame.vertices
+	mesh.Faces = frame.faces
+	version.MeshData = &mesh
+	version.MeshDelta = nil
+	r.last = frame
+	return nil
+}
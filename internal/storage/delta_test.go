@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// testGrid returns a mesh of n vertices in a row, each joined to the next
+// two by a triangle.
+func testGrid(n int) *MeshData {
+	mesh := &MeshData{AnchorID: "grid", Classification: "wall"}
+	for i := 0; i < n; i++ {
+		mesh.Vertices = append(mesh.Vertices, float64(i), 0, float64(i%2))
+	}
+	for i := 0; i+2 < n; i++ {
+		mesh.Faces = append(mesh.Faces, uint32(i), uint32(i+1), uint32(i+2))
+	}
+	return mesh
+}
+
+func cloneMesh(mesh *MeshData) *MeshData {
+	c := *mesh
+	c.Vertices = append([]float64(nil), mesh.Vertices...)
+	c.Faces = append([]uint32(nil), mesh.Faces...)
+	return &c
+}
+
+func TestDiffMeshApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		edit   func(*MeshData)
+		ranges int // -1 to skip the check
+	}{
+		{"unchanged", func(m *MeshData) {}, 0},
+		{"one component", func(m *MeshData) { m.Vertices[7] = 9 }, 1},
+		{"changes within the gap merge", func(m *MeshData) {
+			m.Vertices[10] = 9
+			m.Vertices[10+vertexRangeGap+1] = 9
+		}, 1},
+		{"changes past the gap split", func(m *MeshData) {
+			m.Vertices[10] = 9
+			m.Vertices[10+vertexRangeGap+2] = 9
+		}, 2},
+		{"first and last component", func(m *MeshData) {
+			m.Vertices[0] = -1
+			m.Vertices[len(m.Vertices)-1] = -1
+		}, 2},
+		{"vertices grow", func(m *MeshData) { m.Vertices = append(m.Vertices, 100, 101, 102) }, 1},
+		{"vertices shrink", func(m *MeshData) {
+			m.Vertices = m.Vertices[:len(m.Vertices)-6]
+			m.Faces = m.Faces[:len(m.Faces)-6]
+		}, 0},
+		{"faces grow at the end", func(m *MeshData) { m.Faces = append(m.Faces, 0, 2, 4) }, 0},
+		{"faces grow at the start", func(m *MeshData) { m.Faces = append([]uint32{0, 2, 4}, m.Faces...) }, 0},
+		{"faces shrink in the middle", func(m *MeshData) {
+			m.Faces = append(m.Faces[:9:9], m.Faces[15:]...)
+		}, 0},
+		{"faces replaced in the middle", func(m *MeshData) {
+			copy(m.Faces[12:], []uint32{1, 3, 5, 7, 9, 11})
+		}, 0},
+		{"all faces removed", func(m *MeshData) { m.Faces = nil }, 0},
+		{"everything changes", func(m *MeshData) {
+			for i := range m.Vertices {
+				m.Vertices[i] += 0.5
+			}
+			for i := range m.Faces {
+				m.Faces[i] = uint32(len(m.Vertices)/3 - 1 - int(m.Faces[i]))
+			}
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := testGrid(20)
+			target := cloneMesh(base)
+			tt.edit(target)
+
+			frame := &meshFrame{versionID: "v1", vertices: base.Vertices, faces: base.Faces}
+			delta := diffMesh(frame, target)
+			if tt.ranges >= 0 && len(delta.VertexRanges) != tt.ranges {
+				t.Errorf("delta has %d vertex ranges, want %d", len(delta.VertexRanges), tt.ranges)
+			}
+
+			got, err := frame.apply("v2", delta)
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if !reflect.DeepEqual(got.vertices, target.Vertices) {
+				t.Errorf("vertices = %v, want %v", got.vertices, target.Vertices)
+			}
+			if len(got.faces) != len(target.Faces) || (len(target.Faces) > 0 && !reflect.DeepEqual(got.faces, target.Faces)) {
+				t.Errorf("faces = %v, want %v", got.faces, target.Faces)
+			}
+			if got.versionID != "v2" || got.depth != 1 {
+				t.Errorf("frame is %s at depth %d, want v2 at depth 1", got.versionID, got.depth)
+			}
+
+			// The base must not be modified
+			if !reflect.DeepEqual(frame.vertices, testGrid(20).Vertices) || !reflect.DeepEqual(frame.faces, testGrid(20).Faces) {
+				t.Errorf("apply modified its base frame")
+			}
+		})
+	}
+}
+
+func TestApplyRejectsInvalidDelta(t *testing.T) {
+	base := testGrid(4)
+	frame := &meshFrame{versionID: "v1", vertices: base.Vertices, faces: base.Faces}
+
+	tests := []struct {
+		name  string
+		delta MeshDelta
+	}{
+		{"wrong base", MeshDelta{BaseVersionID: "v0", VertexCount: 12}},
+		{"range past the end", MeshDelta{BaseVersionID: "v1", VertexCount: 12, VertexRanges: []VertexRange{{Start: 11, Values: []float64{1, 2}}}}},
+		{"negative range", MeshDelta{BaseVersionID: "v1", VertexCount: 12, VertexRanges: []VertexRange{{Start: -1, Values: []float64{1}}}}},
+		{"removes missing faces", MeshDelta{BaseVersionID: "v1", VertexCount: 12, FaceStart: 3, RemovedFaces: 4}},
+		{"negative face start", MeshDelta{BaseVersionID: "v1", VertexCount: 12, FaceStart: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := frame.apply("v2", &tt.delta); err == nil {
+				t.Fatalf("applied an invalid delta")
+			}
+		})
+	}
+}
+
+// storedVersion reads a version as it is stored, before its mesh delta is
+// replayed.
+func storedVersion(t *testing.T, store *BoltStorage, anchorKey string, seq uint64) *AnchorVersion {
+	t.Helper()
+
+	var version *AnchorVersion
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket([]byte(VersionsBucket)).Get(versionKeyFor(anchorKey, seq))
+		if data == nil {
+			return fmt.Errorf("version %d of %s not stored", seq, anchorKey)
+		}
+		version = &AnchorVersion{}
+		return UnmarshalVersion(data, version)
+	})
+	if err != nil {
+		t.Fatalf("failed to read stored version: %v", err)
+	}
+	return version
+}
+
+// meshAt is the mesh of version seq in TestMeshVersionsRoundTrip: one vertex
+// moves per version and a face is added every tenth.
+func meshAt(seq int) *MeshData {
+	mesh := testGrid(40)
+	for i := 1; i <= seq; i++ {
+		mesh.Vertices[(3*i)%len(mesh.Vertices)] += float64(i)
+		if i%10 == 0 {
+			mesh.Faces = append(mesh.Faces, uint32(i%40), uint32((i+5)%40), uint32((i+9)%40))
+		}
+	}
+	return mesh
+}
+
+func TestMeshVersionsRoundTrip(t *testing.T) {
+	store := openTestStorage(t)
+	anchor := createTestAnchor(t, store, "room", "grid")
+
+	const versions = 3*maxDeltaChain + 5
+	for seq := 1; seq <= versions; seq++ {
+		addTestVersion(t, store, anchor, &AnchorVersion{Hash: fmt.Sprint(seq), MeshData: meshAt(seq)})
+	}
+
+	// Deltas are used, but never chained past maxDeltaChain
+	chain, deltas := 0, 0
+	for seq := uint64(1); seq <= versions; seq++ {
+		stored := storedVersion(t, store, "room:grid", seq)
+		if stored.MeshDelta == nil {
+			chain = 0
+			continue
+		}
+		deltas++
+		if chain++; chain > maxDeltaChain {
+			t.Fatalf("version %d is %d deltas from its keyframe", seq, chain)
+		}
+	}
+	if deltas < versions-4 {
+		t.Fatalf("only %d of %d versions stored as deltas", deltas, versions)
+	}
+
+	all, err := store.GetAnchorVersions("room", "grid")
+	if err != nil {
+		t.Fatalf("GetAnchorVersions: %v", err)
+	}
+	if len(all) != versions {
+		t.Fatalf("read %d versions, want %d", len(all), versions)
+	}
+	for i, version := range all {
+		want := meshAt(i + 1)
+		if version.MeshDelta != nil || !reflect.DeepEqual(version.MeshData.Vertices, want.Vertices) || !reflect.DeepEqual(version.MeshData.Faces, want.Faces) {
+			t.Fatalf("version %s does not match the mesh it was stored with", version.VersionID)
+		}
+		if version.MeshData.Classification != "wall" {
+			t.Fatalf("version %s lost its mesh classification", version.VersionID)
+		}
+	}
+
+	// A page starting mid-chain replays from the keyframe before it
+	page, total, err := store.GetAnchorVersionsWithPaging("room", "grid", maxDeltaChain+10, 5)
+	if err != nil {
+		t.Fatalf("GetAnchorVersionsWithPaging: %v", err)
+	}
+	if total != versions || len(page) != 5 {
+		t.Fatalf("page has %d of %d versions, want 5 of %d", len(page), total, versions)
+	}
+	for i, version := range page {
+		if want := meshAt(maxDeltaChain + 11 + i); !reflect.DeepEqual(version.MeshData.Vertices, want.Vertices) {
+			t.Fatalf("paged version %s does not match the mesh it was stored with", version.VersionID)
+		}
+	}
+
+	latest, err := store.GetAnchor("room", "grid")
+	if err != nil {
+		t.Fatalf("GetAnchor: %v", err)
+	}
+	if want := meshAt(versions); latest.LatestVersion == nil || !reflect.DeepEqual(latest.LatestVersion.MeshData.Vertices, want.Vertices) {
+		t.Fatalf("latest version does not match the last mesh stored")
+	}
+}
+
+func TestBrokenDeltaChainStartsKeyframe(t *testing.T) {
+	store := openTestStorage(t)
+	anchor := createTestAnchor(t, store, "room", "grid")
+	for seq := 1; seq <= 5; seq++ {
+		addTestVersion(t, store, anchor, &AnchorVersion{Hash: fmt.Sprint(seq), MeshData: meshAt(seq)})
+	}
+	if storedVersion(t, store, "room:grid", 5).MeshDelta == nil {
+		t.Fatalf("version 5 was not stored as a delta")
+	}
+
+	// Lose a version in the middle of the chain
+	err := store.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(VersionsBucket)).Delete(versionKeyFor("room:grid", 3))
+	})
+	if err != nil {
+		t.Fatalf("failed to delete version: %v", err)
+	}
+
+	addTestVersion(t, store, anchor, &AnchorVersion{Hash: "6", MeshData: meshAt(6)})
+	stored := storedVersion(t, store, "room:grid", 6)
+	if stored.MeshDelta != nil || stored.MeshData == nil || len(stored.MeshData.Vertices) == 0 {
+		t.Fatalf("version after a broken chain was not stored as a keyframe")
+	}
+
+	latest, err := store.GetAnchor("room", "grid")
+	if err != nil {
+		t.Fatalf("GetAnchor: %v", err)
+	}
+	if want := meshAt(6); !reflect.DeepEqual(latest.LatestVersion.MeshData.Vertices, want.Vertices) {
+		t.Fatalf("latest version does not match the mesh it was stored with")
+	}
+
+	// Versions after the gap that still depend on it fail to read
+	if _, err := store.GetAnchorVersions("room", "grid"); err == nil {
+		t.Fatalf("read versions across a broken delta chain without error")
+	}
+
+	// The keyframe starts a new chain
+	addTestVersion(t, store, anchor, &AnchorVersion{Hash: "7", MeshData: meshAt(7)})
+	if storedVersion(t, store, "room:grid", 7).MeshDelta == nil {
+		t.Fatalf("version after the new keyframe was not stored as a delta")
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// schemaVersion is the layout written by this build. Older databases are
+// migrated when opened.
+const schemaVersion = 3
+
+var schemaVersionKey = []byte("schema_version")
+
+// migrate brings a database written by an older build up to schemaVersion.
+func (s *BoltStorage) migrate() error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket([]byte(MetaBucket))
+
+		current := uint64(0)
+		if v := meta.Get(schemaVersionKey); v != nil {
+			current = binary.BigEndian.Uint64(v)
+		}
+		if current > schemaVersion {
+			return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, schemaVersion)
+		}
+
+		if current < 1 {
+			if err := migrateVersionKeys(tx); err != nil {
+				return fmt.Errorf("failed to migrate version keys: %w", err)
+			}
+		}
+		if current < 2 {
+			if err := migrateAnchorHeads(tx); err != nil {
+				return fmt.Errorf("failed to migrate anchor records: %w", err)
+			}
+		}
+		// Version 3 writes anchors and versions in the binary record format.
+		// JSON records are still read, so they are not rewritten.
+
+		return meta.Put(schemaVersionKey, encodeSeq(schemaVersion))
+	})
+}
+
+// legacyVersion is a version stored under stagID:anchorID:v<unix seconds>.
+type legacyVersion struct {
+	key     []byte
+	version AnchorVersion
+}
+
+// migrateVersionKeys re-keys versions stored by time-based version ID onto
+// per-anchor sequence numbers, oldest first.
+func migrateVersionKeys(tx *bbolt.Tx) error {
+	versions := tx.Bucket([]byte(VersionsBucket))
+	seqs := tx.Bucket([]byte(VersionSeqBucket))
+
+	byAnchor := make(map[string][]legacyVersion)
+	err := versions.ForEach(func(k, v []byte) error {
+		sep := bytes.LastIndexByte(k, ':')
+		if sep < 0 {
+			return nil
+		}
+		var version AnchorVersion
+		if err := UnmarshalVersion(v, &version); err != nil {
+			return fmt.Errorf("failed to unmarshal version %s: %w", string(k), err)
+		}
+		anchorKey := string(k[:sep])
+		byAnchor[anchorKey] = append(byAnchor[anchorKey], legacyVersion{
+			key:     append([]byte(nil), k...),
+			version: version,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for anchorKey, legacy := range byAnchor {
+		sort.SliceStable(legacy, func(i, j int) bool {
+			return legacy[i].version.Timestamp.Before(legacy[j].version.Timestamp)
+		})
+
+		for i, entry := range legacy {
+			seq := uint64(i + 1)
+			entry.version.VersionID = versionID(seq)
+
+			data, err := MarshalVersion(&entry.version)
+			if err != nil {
+				return fmt.Errorf("failed to marshal version: %w", err)
+			}
+			if err := versions.Delete(entry.key); err != nil {
+				return err
+			}
+			if err := versions.Put(versionKeyFor(anchorKey, seq), data); err != nil {
+				return err
+			}
+		}
+		if err := seqs.Put([]byte(anchorKey), encodeSeq(uint64(len(legacy)))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateAnchorHeads rewrites anchor records that embed their whole version
+// history as head metadata, counting versions from the versions bucket.
+// Anchors written before they recorded a type get the type of their latest
+// version's payload, so type filters see them before their next write.
+func migrateAnchorHeads(tx *bbolt.Tx) error {
+	anchors := tx.Bucket([]byte(AnchorsBucket))
+	versions := tx.Bucket([]byte(VersionsBucket))
+
+	type rewrite struct {
+		key  []byte
+		data []byte
+	}
+	var rewrites []rewrite
+
+	err := anchors.ForEach(func(k, v []byte) error {
+		var anchor Anchor
+		if err := UnmarshalAnchor(v, &anchor); err != nil {
+			return fmt.Errorf("failed to unmarshal anchor %s: %w", string(k), err)
+		}
+
+		prefix := append(append([]byte(nil), k...), ':')
+		anchor.VersionCount = 0
+		c := versions.Cursor()
+		for vk, _ := c.Seek(prefix); vk != nil && bytes.HasPrefix(vk, prefix); vk, _ = c.Next() {
+			if len(vk) == len(prefix)+8 {
+				anchor.VersionCount++
+			}
+		}
+		if _, latest := lastWithPrefix(versions.Cursor(), prefix); latest != nil {
+			var version AnchorVersion
+			if err := UnmarshalVersion(latest, &version); err != nil {
+				return fmt.Errorf("failed to unmarshal latest version of %s: %w", string(k), err)
+			}
+			anchor.LatestVersionID = version.VersionID
+			if anchor.Type == "" {
+				anchor.Type = payloadType(&version)
+			}
+		}
+
+		// The embedded "versions" list is dropped by re-encoding
+		data, err := MarshalAnchor(&anchor)
+		if err != nil {
+			return fmt.Errorf("failed to marshal anchor: %w", err)
+		}
+		rewrites = append(rewrites, rewrite{key: append([]byte(nil), k...), data: data})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rewrites {
+		if err := anchors.Put(r.key, r.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payloadType returns the event type a version's payload was ingested as,
+// or "" if it carries none.
+func payloadType(version *AnchorVersion) string {
+	switch {
+	case version.MeshData != nil, version.MeshDelta != nil:
+		return "mesh"
+	case version.PoseData != nil:
+		return "pose"
+	case version.CameraData != nil:
+		return "camera"
+	case version.DepthData != nil:
+		return "depth"
+	case version.PointCloudData != nil:
+		return "pointCloud"
+	case version.LightingData != nil:
+		return "lighting"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// legacyAnchor describes an anchor as an unversioned database stored it:
+// versions keyed by v<unix seconds> and embedded in the anchor record.
+type legacyAnchor struct {
+	stagID, anchorID string
+	versions         []AnchorVersion
+}
+
+// writeLegacyDB creates a database without a schema version, the layout
+// written before versions had sequence numbers.
+func writeLegacyDB(t *testing.T, anchors ...legacyAnchor) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "stag.db")
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		anchorBucket, err := tx.CreateBucket([]byte(AnchorsBucket))
+		if err != nil {
+			return err
+		}
+		versionBucket, err := tx.CreateBucket([]byte(VersionsBucket))
+		if err != nil {
+			return err
+		}
+
+		for _, a := range anchors {
+			anchorKey := a.stagID + ":" + a.anchorID
+			for i := range a.versions {
+				v := &a.versions[i]
+				v.VersionID = fmt.Sprintf("v%d", v.Timestamp.Unix())
+				data, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if err := versionBucket.Put([]byte(anchorKey+":"+v.VersionID), data); err != nil {
+					return err
+				}
+			}
+
+			last := a.versions[len(a.versions)-1]
+			data, err := json.Marshal(map[string]interface{}{
+				"id":             a.anchorID,
+				"stag_id":        a.stagID,
+				"current_hash":   last.Hash,
+				"version_count":  len(a.versions),
+				"versions":       a.versions,
+				"latest_version": last,
+				"created_at":     a.versions[0].Timestamp,
+				"updated_at":     last.Timestamp,
+			})
+			if err != nil {
+				return err
+			}
+			if err := anchorBucket.Put([]byte(anchorKey), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write legacy database: %v", err)
+	}
+	return path
+}
+
+// legacyFloor has versions whose v<unix> keys sort differently from their
+// timestamps: v999999999 comes after v1000000000 byte-wise.
+func legacyFloor() legacyAnchor {
+	mesh := func(x float64) *MeshData {
+		return &MeshData{AnchorID: "floor", Vertices: []float64{x, 0, 0, 1, 0, 0, 0, 0, 1}, Faces: []uint32{0, 1, 2}}
+	}
+	return legacyAnchor{"room", "floor", []AnchorVersion{
+		{Hash: "h1", Timestamp: time.Unix(999999999, 0).UTC(), ChangeType: "create", MeshData: mesh(1)},
+		{Hash: "h2", Timestamp: time.Unix(1000000000, 0).UTC(), ChangeType: "update", MeshData: mesh(2)},
+		{Hash: "h3", Timestamp: time.Unix(1000000100, 0).UTC(), ChangeType: "update", MeshData: mesh(3)},
+	}}
+}
+
+func legacyHead() legacyAnchor {
+	return legacyAnchor{"room", "head", []AnchorVersion{
+		{Hash: "p1", Timestamp: time.Unix(1000000050, 0).UTC(), ChangeType: "create", PoseData: &PoseData{Confidence: 1}},
+	}}
+}
+
+func openMigrated(t *testing.T, path string) *BoltStorage {
+	t.Helper()
+
+	store, err := NewBoltStorage(path, 0.5)
+	if err != nil {
+		t.Fatalf("failed to open legacy database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestMigrateVersionKeys(t *testing.T) {
+	store := openMigrated(t, writeLegacyDB(t, legacyFloor(), legacyHead()))
+
+	versions, err := store.GetAnchorVersions("room", "floor")
+	if err != nil {
+		t.Fatalf("GetAnchorVersions: %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("migrated %d versions, want 3", len(versions))
+	}
+	for i, version := range versions {
+		wantID, wantHash := fmt.Sprintf("v%d", i+1), fmt.Sprintf("h%d", i+1)
+		if version.VersionID != wantID || version.Hash != wantHash {
+			t.Fatalf("version %d is %s (%s), want %s (%s)", i, version.VersionID, version.Hash, wantID, wantHash)
+		}
+		if version.MeshData == nil || version.MeshData.Vertices[0] != float64(i+1) {
+			t.Fatalf("version %s lost its payload", version.VersionID)
+		}
+	}
+
+	// Only sequence keys are left, and the counters match them
+	err = store.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(VersionsBucket)).ForEach(func(k, v []byte) error {
+			for _, prefix := range []string{"room:floor:", "room:head:"} {
+				if bytes.HasPrefix(k, []byte(prefix)) && len(k) == len(prefix)+8 {
+					return nil
+				}
+			}
+			return fmt.Errorf("version key %q is not a sequence key", k)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for anchorKey, want := range map[string]uint64{"room:floor": 3, "room:head": 1} {
+		var seq uint64
+		store.db.View(func(tx *bbolt.Tx) error {
+			if v := tx.Bucket([]byte(VersionSeqBucket)).Get([]byte(anchorKey)); v != nil {
+				seq = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+		if seq != want {
+			t.Fatalf("version_seq of %s = %d, want %d", anchorKey, seq, want)
+		}
+	}
+
+	// New versions continue the sequence
+	version := &AnchorVersion{Hash: "h4", Timestamp: time.Unix(1000000200, 0).UTC(), PoseData: &PoseData{Confidence: 1}}
+	if err := store.AddAnchorVersion("room", "floor", version); err != nil {
+		t.Fatalf("AddAnchorVersion: %v", err)
+	}
+	if version.VersionID != "v4" {
+		t.Fatalf("version after migration is %s, want v4", version.VersionID)
+	}
+}
+
+// dumpBuckets returns every key and value in the given buckets.
+func dumpBuckets(t *testing.T, store *BoltStorage, buckets ...string) map[string]string {
+	t.Helper()
+
+	dump := make(map[string]string)
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				dump[name+"/"+string(k)] = string(v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to dump buckets: %v", err)
+	}
+	return dump
+}
+
+func TestMigrateAnchorHeads(t *testing.T) {
+	path := writeLegacyDB(t, legacyFloor(), legacyHead())
+	store := openMigrated(t, path)
+
+	tests := []struct {
+		anchorID string
+		typ      string
+		count    int
+		latest   string
+		hash     string
+	}{
+		{"floor", "mesh", 3, "v3", "h3"},
+		{"head", "pose", 1, "v1", "p1"},
+	}
+	for _, tt := range tests {
+		head, err := store.GetAnchorHead("room", tt.anchorID)
+		if err != nil {
+			t.Fatalf("GetAnchorHead %s: %v", tt.anchorID, err)
+		}
+		if head.Type != tt.typ || head.VersionCount != tt.count || head.LatestVersionID != tt.latest {
+			t.Fatalf("%s head = type %q, %d versions, latest %s; want %q, %d, %s",
+				tt.anchorID, head.Type, head.VersionCount, head.LatestVersionID, tt.typ, tt.count, tt.latest)
+		}
+
+		anchor, err := store.GetAnchor("room", tt.anchorID)
+		if err != nil {
+			t.Fatalf("GetAnchor %s: %v", tt.anchorID, err)
+		}
+		if anchor.LatestVersion == nil || anchor.LatestVersion.Hash != tt.hash {
+			t.Fatalf("%s latest version is not %s", tt.anchorID, tt.hash)
+		}
+	}
+
+	// The embedded history is gone from the anchor record
+	var raw []byte
+	store.db.View(func(tx *bbolt.Tx) error {
+		raw = append(raw, tx.Bucket([]byte(AnchorsBucket)).Get([]byte("room:floor"))...)
+		return nil
+	})
+	if bytes.Contains(raw, []byte(`"versions"`)) || bytes.Contains(raw, []byte("h1")) {
+		t.Fatalf("migrated anchor record still embeds its versions")
+	}
+
+	var schema uint64
+	store.db.View(func(tx *bbolt.Tx) error {
+		schema = binary.BigEndian.Uint64(tx.Bucket([]byte(MetaBucket)).Get(schemaVersionKey))
+		return nil
+	})
+	if schema != schemaVersion {
+		t.Fatalf("schema version = %d, want %d", schema, schemaVersion)
+	}
+
+	// Opening the migrated database again changes nothing
+	buckets := []string{AnchorsBucket, VersionsBucket, VersionSeqBucket, MetaBucket}
+	before := dumpBuckets(t, store, buckets...)
+	store.Close()
+	reopened := openMigrated(t, path)
+	after := dumpBuckets(t, reopened, buckets...)
+	if len(after) != len(before) {
+		t.Fatalf("reopening changed the database from %d to %d keys", len(before), len(after))
+	}
+	for k, v := range before {
+		if after[k] != v {
+			t.Fatalf("reopening rewrote %q", k)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -16,12 +18,37 @@ const (
 	VersionsBucket = "versions"
 	StatsBucket    = "stats"
 	SessionsBucket = "sessions"
+	BatchesBucket  = "batches"
+	MetaBucket     = "meta"
+
+	// VersionSeqBucket holds the last version sequence number per anchor
+	VersionSeqBucket = "version_seq"
+
+	// BatchIndexBucket orders batch results by receive time for retention
+	BatchIndexBucket = "batch_index"
+
+	// DedupeBucket maps recently seen event and batch IDs to their expiry;
+	// DedupeExpiryBucket orders them by expiry for pruning
+	DedupeBucket       = "dedupe"
+	DedupeExpiryBucket = "dedupe_expiry"
+
+	// BlobsBucket holds large payloads in chunks keyed hash:<index>;
+	// BlobRefsBucket counts the versions referencing each hash
+	BlobsBucket    = "blobs"
+	BlobRefsBucket = "blob_refs"
+)
+
+// Kinds of IDs kept in the dedupe index.
+const (
+	DedupeEvent = "event"
+	DedupeBatch = "batch"
 )
 
 type Storage interface {
 	// Stag operations
 	CreateStag(stag *Stag) error
 	GetStag(stagID string) (*Stag, error)
+	GetStagHead(stagID string) (*Stag, error)
 	UpdateStag(stag *Stag) error
 	UpdateStagStats(stagID string, stats StagStats) error
 	ListStags() ([]*Stag, error)
@@ -30,8 +57,10 @@ type Storage interface {
 	// Anchor operations
 	CreateAnchor(anchor *Anchor) error
 	GetAnchor(stagID, anchorID string) (*Anchor, error)
+	GetAnchorHead(stagID, anchorID string) (*Anchor, error)
 	UpdateAnchor(anchor *Anchor) error
 	ListAnchors(stagID string) ([]*Anchor, error)
+	ListAnchorHeads(stagID string) ([]*Anchor, error)
 	DeleteAnchor(stagID, anchorID string) error
 
 	// Version operations
@@ -47,15 +76,29 @@ type Storage interface {
 	GetSystemStats() (*SystemStats, error)
 	UpdateSystemStats(stats *SystemStats) error
 
+	// Batch operations
+	SaveBatchResult(result *BatchResult) error
+	GetBatchResult(batchID string) (*BatchResult, error)
+	PruneBatchResults(before time.Time, keep int) (int, error)
+
+	// Deduplication operations
+	SeenIDs(kind string, ids []string) (map[string]bool, error)
+	MarkSeen(kind string, ids []string, ttl time.Duration) error
+	PruneSeenIDs(now time.Time) (int, error)
+
 	// Utility operations
 	Close() error
 }
 
 type BoltStorage struct {
 	db *bbolt.DB
+
+	// snapshotThreshold is the largest mesh delta, as a fraction of the
+	// full mesh, stored instead of a keyframe
+	snapshotThreshold float64
 }
 
-func NewBoltStorage(dbPath string) (*BoltStorage, error) {
+func NewBoltStorage(dbPath string, snapshotThreshold float64) (*BoltStorage, error) {
 	// Ensure directory exists
 	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
@@ -69,7 +112,7 @@ func NewBoltStorage(dbPath string) (*BoltStorage, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	storage := &BoltStorage{db: db}
+	storage := &BoltStorage{db: db, snapshotThreshold: snapshotThreshold}
 
 	// Initialize buckets
 	if err := storage.initBuckets(); err != nil {
@@ -77,12 +120,17 @@ func NewBoltStorage(dbPath string) (*BoltStorage, error) {
 		return nil, fmt.Errorf("failed to initialize buckets: %w", err)
 	}
 
+	if err := storage.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return storage, nil
 }
 
 func (s *BoltStorage) initBuckets() error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		buckets := []string{StagsBucket, AnchorsBucket, VersionsBucket, StatsBucket, SessionsBucket}
+		buckets := []string{StagsBucket, AnchorsBucket, VersionsBucket, StatsBucket, SessionsBucket, BatchesBucket, BatchIndexBucket, DedupeBucket, DedupeExpiryBucket, MetaBucket, VersionSeqBucket, BlobsBucket, BlobRefsBucket}
 		for _, bucket := range buckets {
 			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
 				return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
@@ -131,6 +179,17 @@ func (s *BoltStorage) CreateStag(stag *Stag) error {
 }
 
 func (s *BoltStorage) GetStag(stagID string) (*Stag, error) {
+	return s.getStag(stagID, true)
+}
+
+// GetStagHead returns the stag with the anchor records only, without their
+// latest versions. It is meant for the ingest path, where replaying mesh
+// deltas and loading blobs for every anchor would dominate.
+func (s *BoltStorage) GetStagHead(stagID string) (*Stag, error) {
+	return s.getStag(stagID, false)
+}
+
+func (s *BoltStorage) getStag(stagID string, withVersions bool) (*Stag, error) {
 	var stag *Stag
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(StagsBucket))
@@ -148,7 +207,7 @@ func (s *BoltStorage) GetStag(stagID string) (*Stag, error) {
 	}
 
 	// Load anchors
-	anchors, err := s.ListAnchors(stagID)
+	anchors, err := s.listAnchors(stagID, withVersions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load anchors for stag %s: %w", stagID, err)
 	}
@@ -247,20 +306,19 @@ func (s *BoltStorage) DeleteStag(stagID string) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		// Delete all anchors first
 		anchorsBucket := tx.Bucket([]byte(AnchorsBucket))
-		versionsBucket := tx.Bucket([]byte(VersionsBucket))
 		
 		// Find and delete all anchors for this stag
 		anchorPrefix := []byte(stagID + ":")
+		var anchorKeys [][]byte
 		c := anchorsBucket.Cursor()
 		for k, _ := c.Seek(anchorPrefix); k != nil && len(k) > len(anchorPrefix) && string(k[:len(anchorPrefix)]) == string(anchorPrefix); k, _ = c.Next() {
-			// Delete anchor versions
-			anchorKey := string(k[len(anchorPrefix):])
-			versionPrefix := []byte(stagID + ":" + anchorKey + ":")
-			vc := versionsBucket.Cursor()
-			for vk, _ := vc.Seek(versionPrefix); vk != nil && len(vk) > len(versionPrefix) && string(vk[:len(versionPrefix)]) == string(versionPrefix); vk, _ = vc.Next() {
-				if err := versionsBucket.Delete(vk); err != nil {
-					return fmt.Errorf("failed to delete version %s: %w", string(vk), err)
-				}
+			anchorKeys = append(anchorKeys, append([]byte(nil), k...))
+		}
+
+		for _, k := range anchorKeys {
+			// Delete anchor versions and release their blobs
+			if err := deleteVersions(tx, append(k, ':')); err != nil {
+				return err
 			}
 			
 			// Delete anchor
@@ -277,6 +335,56 @@ func (s *BoltStorage) DeleteStag(stagID string) error {
 
 // Anchor operations
 
+// Anchor records hold only head metadata; the versions themselves live in
+// the versions bucket.
+
+// loadLatestVersion attaches the anchor's newest version, if it has one.
+func loadLatestVersion(tx *bbolt.Tx, anchor *Anchor) error {
+	if anchor.VersionCount == 0 {
+		return nil
+	}
+
+	anchorKey := anchor.StagID + ":" + anchor.ID
+	bucket := tx.Bucket([]byte(VersionsBucket))
+	key, data := lastWithPrefix(bucket.Cursor(), []byte(anchorKey+":"))
+	if data == nil {
+		return nil
+	}
+
+	var version AnchorVersion
+	if err := UnmarshalVersion(data, &version); err != nil {
+		return fmt.Errorf("failed to unmarshal latest version of anchor %s: %w", anchor.ID, err)
+	}
+	reader := meshReader{bucket: bucket, anchorKey: anchorKey}
+	if err := reader.expand(key, &version); err != nil {
+		return fmt.Errorf("failed to restore mesh of anchor %s: %w", anchor.ID, err)
+	}
+	if err := loadBlobs(tx, &version); err != nil {
+		return fmt.Errorf("failed to load payloads of anchor %s: %w", anchor.ID, err)
+	}
+	anchor.LatestVersion = &version
+	return nil
+}
+
+// lastWithPrefix returns the last key/value whose key is prefix followed by
+// an 8-byte sequence number. Longer keys (an anchor ID that extends this
+// one past a colon) are skipped.
+func lastWithPrefix(c *bbolt.Cursor, prefix []byte) ([]byte, []byte) {
+	seek := append(append([]byte(nil), prefix...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	k, v := c.Seek(seek)
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+		if len(k) == len(prefix)+8 {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
 func (s *BoltStorage) CreateAnchor(anchor *Anchor) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(AnchorsBucket))
@@ -298,7 +406,7 @@ func (s *BoltStorage) CreateAnchor(anchor *Anchor) error {
 		}
 
 		// Serialize and store
-		data, err := json.Marshal(anchor)
+		data, err := MarshalAnchor(anchor)
 		if err != nil {
 			return fmt.Errorf("failed to marshal anchor: %w", err)
 		}
@@ -308,6 +416,15 @@ func (s *BoltStorage) CreateAnchor(anchor *Anchor) error {
 }
 
 func (s *BoltStorage) GetAnchor(stagID, anchorID string) (*Anchor, error) {
+	return s.getAnchor(stagID, anchorID, true)
+}
+
+// GetAnchorHead returns the anchor record without its latest version.
+func (s *BoltStorage) GetAnchorHead(stagID, anchorID string) (*Anchor, error) {
+	return s.getAnchor(stagID, anchorID, false)
+}
+
+func (s *BoltStorage) getAnchor(stagID, anchorID string, withVersion bool) (*Anchor, error) {
 	var anchor *Anchor
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(AnchorsBucket))
@@ -318,20 +435,18 @@ func (s *BoltStorage) GetAnchor(stagID, anchorID string) (*Anchor, error) {
 		}
 
 		anchor = &Anchor{}
-		return json.Unmarshal(data, anchor)
+		if err := UnmarshalAnchor(data, anchor); err != nil {
+			return err
+		}
+		if !withVersion {
+			return nil
+		}
+		return loadLatestVersion(tx, anchor)
 	})
 	
 	if err != nil {
 		return nil, err
 	}
-
-	// Load versions
-	versions, err := s.GetAnchorVersions(stagID, anchorID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load versions for anchor %s: %w", anchorID, err)
-	}
-
-	anchor.Versions = versions
 	return anchor, nil
 }
 
@@ -349,7 +464,7 @@ func (s *BoltStorage) UpdateAnchor(anchor *Anchor) error {
 		anchor.UpdatedAt = time.Now()
 
 		// Serialize and store
-		data, err := json.Marshal(anchor)
+		data, err := MarshalAnchor(anchor)
 		if err != nil {
 			return fmt.Errorf("failed to marshal anchor: %w", err)
 		}
@@ -359,6 +474,16 @@ func (s *BoltStorage) UpdateAnchor(anchor *Anchor) error {
 }
 
 func (s *BoltStorage) ListAnchors(stagID string) ([]*Anchor, error) {
+	return s.listAnchors(stagID, true)
+}
+
+// ListAnchorHeads returns the stag's anchor records without their latest
+// versions.
+func (s *BoltStorage) ListAnchorHeads(stagID string) ([]*Anchor, error) {
+	return s.listAnchors(stagID, false)
+}
+
+func (s *BoltStorage) listAnchors(stagID string, withVersions bool) ([]*Anchor, error) {
 	var anchors []*Anchor
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(AnchorsBucket))
@@ -367,9 +492,14 @@ func (s *BoltStorage) ListAnchors(stagID string) ([]*Anchor, error) {
 		
 		for k, v := c.Seek(prefix); k != nil && len(k) > len(prefix) && string(k[:len(prefix)]) == string(prefix); k, v = c.Next() {
 			var anchor Anchor
-			if err := json.Unmarshal(v, &anchor); err != nil {
+			if err := UnmarshalAnchor(v, &anchor); err != nil {
 				return fmt.Errorf("failed to unmarshal anchor: %w", err)
 			}
+			if withVersions {
+				if err := loadLatestVersion(tx, &anchor); err != nil {
+					return err
+				}
+			}
 			anchors = append(anchors, &anchor)
 		}
 		return nil
@@ -378,30 +508,14 @@ func (s *BoltStorage) ListAnchors(stagID string) ([]*Anchor, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	// Load versions for each anchor
-	for _, anchor := range anchors {
-		versions, err := s.GetAnchorVersions(stagID, anchor.ID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load versions for anchor %s: %w", anchor.ID, err)
-		}
-		anchor.Versions = versions
-	}
-
 	return anchors, nil
 }
 
 func (s *BoltStorage) DeleteAnchor(stagID, anchorID string) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		// Delete all versions first
-		versionsBucket := tx.Bucket([]byte(VersionsBucket))
-		versionPrefix := []byte(stagID + ":" + anchorID + ":")
-		c := versionsBucket.Cursor()
-		
-		for k, _ := c.Seek(versionPrefix); k != nil && len(k) > len(versionPrefix) && string(k[:len(versionPrefix)]) == string(versionPrefix); k, _ = c.Next() {
-			if err := versionsBucket.Delete(k); err != nil {
-				return fmt.Errorf("failed to delete version %s: %w", string(k), err)
-			}
+		// Delete all versions first, releasing their blobs
+		if err := deleteVersions(tx, []byte(stagID+":"+anchorID+":")); err != nil {
+			return err
 		}
 
 		// Delete the anchor
@@ -413,23 +527,75 @@ func (s *BoltStorage) DeleteAnchor(stagID, anchorID string) error {
 
 // Version operations
 
+// Versions are keyed stagID:anchorID:<sequence as 8 bytes big-endian>, so
+// an anchor's versions sort in the order they were added.
+
+func encodeSeq(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func versionKeyFor(anchorKey string, seq uint64) []byte {
+	return append([]byte(anchorKey+":"), encodeSeq(seq)...)
+}
+
+func versionID(seq uint64) string {
+	return fmt.Sprintf("v%d", seq)
+}
+
+// AddAnchorVersion stores a new version of an anchor, assigning its
+// VersionID from the anchor's next sequence number.
 func (s *BoltStorage) AddAnchorVersion(stagID, anchorID string, version *AnchorVersion) error {
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(VersionsBucket))
-		key := []byte(stagID + ":" + anchorID + ":" + version.VersionID)
+		seqs := tx.Bucket([]byte(VersionSeqBucket))
+		anchorKey := stagID + ":" + anchorID
+
+		// The counter outlives deleted versions so IDs are never reused
+		seq := uint64(1)
+		if last := seqs.Get([]byte(anchorKey)); last != nil {
+			seq = binary.BigEndian.Uint64(last) + 1
+		}
+		if err := seqs.Put([]byte(anchorKey), encodeSeq(seq)); err != nil {
+			return fmt.Errorf("failed to advance version sequence: %w", err)
+		}
+		version.VersionID = versionID(seq)
 		
 		// Initialize metadata if nil
 		if version.Metadata == nil {
 			version.Metadata = make(map[string]interface{})
 		}
 
+		// Mesh geometry is stored as a delta when it is small enough; the
+		// caller's version keeps the full mesh
+		stored := version
+		if version.MeshData != nil {
+			if delta := s.encodeMeshDelta(bucket, anchorKey, seq, version.MeshData); delta != nil {
+				mesh := *version.MeshData
+				mesh.Vertices = nil
+				mesh.Faces = nil
+				encoded := *version
+				encoded.MeshData = &mesh
+				encoded.MeshDelta = delta
+				stored = &encoded
+			}
+		}
+
+		// Large payloads go to the blob store
+		withBlobs := *stored
+		if err := storeBlobs(tx, &withBlobs); err != nil {
+			return err
+		}
+		stored = &withBlobs
+
 		// Serialize and store
-		data, err := json.Marshal(version)
+		data, err := MarshalVersion(stored)
 		if err != nil {
 			return fmt.Errorf("failed to marshal version: %w", err)
 		}
 
-		return bucket.Put(key, data)
+		return bucket.Put(versionKeyFor(anchorKey, seq), data)
 	})
 }
 
@@ -438,13 +604,23 @@ func (s *BoltStorage) GetAnchorVersions(stagID, anchorID string) ([]AnchorVersio
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(VersionsBucket))
 		prefix := []byte(stagID + ":" + anchorID + ":")
+		reader := meshReader{bucket: bucket, anchorKey: stagID + ":" + anchorID}
 		c := bucket.Cursor()
 		
 		for k, v := c.Seek(prefix); k != nil && len(k) > len(prefix) && string(k[:len(prefix)]) == string(prefix); k, v = c.Next() {
+			if len(k) != len(prefix)+8 {
+				continue
+			}
 			var version AnchorVersion
-			if err := json.Unmarshal(v, &version); err != nil {
+			if err := UnmarshalVersion(v, &version); err != nil {
 				return fmt.Errorf("failed to unmarshal version: %w", err)
 			}
+			if err := reader.expand(k, &version); err != nil {
+				return fmt.Errorf("failed to restore mesh: %w", err)
+			}
+			if err := loadBlobs(tx, &version); err != nil {
+				return fmt.Errorf("failed to load version payloads: %w", err)
+			}
 			versions = append(versions, version)
 		}
 		return nil
@@ -460,16 +636,22 @@ func (s *BoltStorage) GetAnchorVersionsWithPaging(stagID, anchorID string, offse
 	err := s.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(VersionsBucket))
 		prefix := []byte(stagID + ":" + anchorID + ":")
+		reader := meshReader{bucket: bucket, anchorKey: stagID + ":" + anchorID}
 		c := bucket.Cursor()
 		
 		// Count total versions
 		for k, _ := c.Seek(prefix); k != nil && len(k) > len(prefix) && string(k[:len(prefix)]) == string(prefix); k, _ = c.Next() {
-			total++
+			if len(k) == len(prefix)+8 {
+				total++
+			}
 		}
 		
 		// Get paged versions
 		current := 0
 		for k, v := c.Seek(prefix); k != nil && len(k) > len(prefix) && string(k[:len(prefix)]) == string(prefix); k, v = c.Next() {
+			if len(k) != len(prefix)+8 {
+				continue
+			}
 			if current < offset {
 				current++
 				continue
@@ -479,9 +661,15 @@ func (s *BoltStorage) GetAnchorVersionsWithPaging(stagID, anchorID string, offse
 			}
 			
 			var version AnchorVersion
-			if err := json.Unmarshal(v, &version); err != nil {
+			if err := UnmarshalVersion(v, &version); err != nil {
 				return fmt.Errorf("failed to unmarshal version: %w", err)
 			}
+			if err := reader.expand(k, &version); err != nil {
+				return fmt.Errorf("failed to restore mesh: %w", err)
+			}
+			if err := loadBlobs(tx, &version); err != nil {
+				return fmt.Errorf("failed to load version payloads: %w", err)
+			}
 			versions = append(versions, version)
 			current++
 		}
@@ -574,4 +762,190 @@ func (s *BoltStorage) UpdateSystemStats(stats *SystemStats) error {
 
 		return bucket.Put([]byte("system"), data)
 	})
-}
\ No newline at end of file
+}
+
+// Batch operations
+
+// batchIndexKey sorts batch results by receive time, oldest first.
+func batchIndexKey(result *BatchResult) []byte {
+	key := make([]byte, 8, 8+len(result.BatchID))
+	binary.BigEndian.PutUint64(key, uint64(result.ReceivedAt.UnixNano()))
+	return append(key, result.BatchID...)
+}
+
+func (s *BoltStorage) SaveBatchResult(result *BatchResult) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(BatchesBucket))
+		index := tx.Bucket([]byte(BatchIndexBucket))
+
+		// A resent batch ID replaces the earlier result
+		if existing := bucket.Get([]byte(result.BatchID)); existing != nil {
+			var previous BatchResult
+			if err := json.Unmarshal(existing, &previous); err == nil {
+				if err := index.Delete(batchIndexKey(&previous)); err != nil {
+					return fmt.Errorf("failed to delete batch index entry: %w", err)
+				}
+			}
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("failed to marshal batch result: %w", err)
+		}
+
+		if err := bucket.Put([]byte(result.BatchID), data); err != nil {
+			return err
+		}
+		return index.Put(batchIndexKey(result), []byte(result.BatchID))
+	})
+}
+
+func (s *BoltStorage) GetBatchResult(batchID string) (*BatchResult, error) {
+	var result *BatchResult
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(BatchesBucket))
+		data := bucket.Get([]byte(batchID))
+		if data == nil {
+			return fmt.Errorf("batch with ID %s not found", batchID)
+		}
+
+		result = &BatchResult{}
+		return json.Unmarshal(data, result)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PruneBatchResults deletes batch results received before the cutoff, then
+// the oldest ones beyond keep. It returns how many were deleted.
+func (s *BoltStorage) PruneBatchResults(before time.Time, keep int) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(BatchesBucket))
+		index := tx.Bucket([]byte(BatchIndexBucket))
+
+		excess := index.Stats().KeyN - keep
+		cutoff := uint64(before.UnixNano())
+
+		// Collect first: deleting while iterating makes the cursor skip keys
+		var keys, batchIDs [][]byte
+		c := index.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if excess <= 0 && binary.BigEndian.Uint64(k[:8]) >= cutoff {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+			batchIDs = append(batchIDs, append([]byte(nil), v...))
+			excess--
+		}
+
+		for i, key := range keys {
+			if err := bucket.Delete(batchIDs[i]); err != nil {
+				return fmt.Errorf("failed to delete batch %s: %w", string(batchIDs[i]), err)
+			}
+			if err := index.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete batch index entry: %w", err)
+			}
+			deleted++
+		}
+		return nil
+	})
+
+	return deleted, err
+}
+
+// Deduplication operations
+
+func dedupeKey(kind, id string) []byte {
+	return []byte(kind + ":" + id)
+}
+
+// dedupeExpiryKey sorts dedupe entries by expiry, soonest first.
+func dedupeExpiryKey(expiry []byte, key []byte) []byte {
+	return append(append(make([]byte, 0, len(expiry)+len(key)), expiry...), key...)
+}
+
+// SeenIDs returns which of the IDs were marked seen and have not expired.
+func (s *BoltStorage) SeenIDs(kind string, ids []string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	now := uint64(time.Now().UnixNano())
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(DedupeBucket))
+		for _, id := range ids {
+			expiry := bucket.Get(dedupeKey(kind, id))
+			if expiry != nil && binary.BigEndian.Uint64(expiry) > now {
+				seen[id] = true
+			}
+		}
+		return nil
+	})
+
+	return seen, err
+}
+
+// MarkSeen records the IDs as seen for ttl, extending earlier entries.
+func (s *BoltStorage) MarkSeen(kind string, ids []string, ttl time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(time.Now().Add(ttl).UnixNano()))
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(DedupeBucket))
+		index := tx.Bucket([]byte(DedupeExpiryBucket))
+
+		for _, id := range ids {
+			key := dedupeKey(kind, id)
+			if previous := bucket.Get(key); previous != nil {
+				if err := index.Delete(dedupeExpiryKey(previous, key)); err != nil {
+					return fmt.Errorf("failed to delete dedupe expiry entry: %w", err)
+				}
+			}
+			if err := bucket.Put(key, expiry); err != nil {
+				return fmt.Errorf("failed to mark %s %s seen: %w", kind, id, err)
+			}
+			if err := index.Put(dedupeExpiryKey(expiry, key), key); err != nil {
+				return fmt.Errorf("failed to index %s %s: %w", kind, id, err)
+			}
+		}
+		return nil
+	})
+}
+
+// PruneSeenIDs deletes dedupe entries that expired before now. It returns
+// how many were deleted.
+func (s *BoltStorage) PruneSeenIDs(now time.Time) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(DedupeBucket))
+		index := tx.Bucket([]byte(DedupeExpiryBucket))
+		cutoff := uint64(now.UnixNano())
+
+		// Collect first: deleting while iterating makes the cursor skip keys
+		var indexKeys, keys [][]byte
+		c := index.Cursor()
+		for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k[:8]) <= cutoff; k, v = c.Next() {
+			indexKeys = append(indexKeys, append([]byte(nil), k...))
+			keys = append(keys, append([]byte(nil), v...))
+		}
+
+		for i, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete dedupe entry %s: %w", string(key), err)
+			}
+			if err := index.Delete(indexKeys[i]); err != nil {
+				return fmt.Errorf("failed to delete dedupe expiry entry: %w", err)
+			}
+			deleted++
+		}
+		return nil
+	})
+
+	return deleted, err
+}
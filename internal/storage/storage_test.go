@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStorage(t *testing.T) *BoltStorage {
+	t.Helper()
+
+	store, err := NewBoltStorage(filepath.Join(t.TempDir(), "stag.db"), 0.5)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// createTestAnchor creates a stag and an anchor in it, ready for versions.
+func createTestAnchor(t *testing.T, store *BoltStorage, stagID, anchorID string) *Anchor {
+	t.Helper()
+
+	if _, err := store.GetStagHead(stagID); err != nil {
+		if err := store.CreateStag(&Stag{ID: stagID, Name: stagID}); err != nil {
+			t.Fatalf("failed to create stag: %v", err)
+		}
+	}
+	anchor := &Anchor{ID: anchorID, StagID: stagID, Type: "mesh"}
+	if err := store.CreateAnchor(anchor); err != nil {
+		t.Fatalf("failed to create anchor: %v", err)
+	}
+	return anchor
+}
+
+// addTestVersion adds a version to an anchor and updates its head the way
+// the ingest path does.
+func addTestVersion(t *testing.T, store *BoltStorage, anchor *Anchor, version *AnchorVersion) {
+	t.Helper()
+
+	if version.Timestamp.IsZero() {
+		version.Timestamp = time.Unix(1700000000, 0).UTC()
+	}
+	if err := store.AddAnchorVersion(anchor.StagID, anchor.ID, version); err != nil {
+		t.Fatalf("failed to add version: %v", err)
+	}
+	anchor.VersionCount++
+	anchor.LatestVersionID = version.VersionID
+	if err := store.UpdateAnchor(anchor); err != nil {
+		t.Fatalf("failed to update anchor: %v", err)
+	}
+}
+
+func TestHeadLookupsSkipLatestVersion(t *testing.T) {
+	store := openTestStorage(t)
+	anchor := createTestAnchor(t, store, "room", "floor")
+	addTestVersion(t, store, anchor, &AnchorVersion{
+		Hash:     "h1",
+		MeshData: &MeshData{AnchorID: "floor", Vertices: []float64{0, 0, 0, 1, 0, 0, 0, 0, 1}, Faces: []uint32{0, 1, 2}},
+	})
+
+	full, err := store.GetAnchor("room", "floor")
+	if err != nil {
+		t.Fatalf("GetAnchor: %v", err)
+	}
+	if full.LatestVersion == nil || full.LatestVersion.VersionID != "v1" {
+		t.Fatalf("GetAnchor did not load the latest version")
+	}
+
+	head, err := store.GetAnchorHead("room", "floor")
+	if err != nil {
+		t.Fatalf("GetAnchorHead: %v", err)
+	}
+	if head.LatestVersion != nil || head.LatestVersionID != "v1" || head.VersionCount != 1 {
+		t.Fatalf("GetAnchorHead = latest %v, id %q, count %d; want the head only", head.LatestVersion, head.LatestVersionID, head.VersionCount)
+	}
+
+	heads, err := store.ListAnchorHeads("room")
+	if err != nil {
+		t.Fatalf("ListAnchorHeads: %v", err)
+	}
+	if len(heads) != 1 || heads[0].LatestVersion != nil {
+		t.Fatalf("ListAnchorHeads returned %d anchors with versions loaded", len(heads))
+	}
+
+	stag, err := store.GetStagHead("room")
+	if err != nil {
+		t.Fatalf("GetStagHead: %v", err)
+	}
+	if len(stag.Anchors) != 1 || stag.Anchors["floor"].LatestVersion != nil {
+		t.Fatalf("GetStagHead anchors = %v, want floor without its version", stag.Anchors)
+	}
+}
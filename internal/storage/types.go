@@ -24,6 +24,23 @@ type MeshData struct {
 	Confidence    float64     `json:"confidence,omitempty"`
 }
 
+// MeshDelta stores a mesh version's vertices and faces as changes against
+// the version before it. The other MeshData fields are stored in full.
+type MeshDelta struct {
+	BaseVersionID string        `json:"base_version_id"`
+	VertexCount   int           `json:"vertex_count"`
+	VertexRanges  []VertexRange `json:"vertex_ranges,omitempty"`
+	FaceStart     int           `json:"face_start"`
+	RemovedFaces  int           `json:"removed_faces"` // face indices removed at FaceStart
+	AddedFaces    []uint32      `json:"added_faces,omitempty"`
+}
+
+// VertexRange replaces vertex components starting at Start.
+type VertexRange struct {
+	Start  int       `json:"start"`
+	Values []float64 `json:"values"`
+}
+
 type PoseData struct {
 	Transform    *Transform `json:"transform"`
 	Velocity     [3]float64 `json:"velocity,omitempty"`
@@ -118,11 +135,13 @@ type AnchorVersion struct {
 	
 	Transform     *Transform             `json:"transform,omitempty"`
 	MeshData      *MeshData              `json:"mesh_data,omitempty"`
+	MeshDelta     *MeshDelta             `json:"mesh_delta,omitempty"` // stored form only; readers get the full MeshData
 	PoseData      *PoseData              `json:"pose_data,omitempty"`
 	CameraData    *CameraData            `json:"camera_data,omitempty"`
 	DepthData     *DepthData             `json:"depth_data,omitempty"`
 	PointCloudData *PointCloudData       `json:"point_cloud_data,omitempty"`
 	LightingData  *LightingData          `json:"lighting_data,omitempty"`
+	Blobs         map[string]string      `json:"blobs,omitempty"` // stored form only: payload name -> blob hash
 	
 	EventID       string                 `json:"event_id"`
 	SessionID     string                 `json:"session_id"`
@@ -136,8 +155,11 @@ type AnchorVersion struct {
 type Anchor struct {
 	ID            string                 `json:"id"`
 	StagID        string                 `json:"stag_id"`
+	Type          string                 `json:"type,omitempty"` // event type the anchor was created from
 	CurrentHash   string                 `json:"current_hash"`
-	Versions      []AnchorVersion        `json:"versions"`
+	VersionCount  int                    `json:"version_count"`
+	LatestVersionID string               `json:"latest_version_id,omitempty"`
+	LatestVersion *AnchorVersion         `json:"latest_version,omitempty"` // loaded from the versions bucket, not stored
 	CreatedAt     time.Time              `json:"created_at"`
 	UpdatedAt     time.Time              `json:"updated_at"`
 	LastSessionID string                 `json:"last_session_id"`
@@ -156,6 +178,11 @@ type StagStats struct {
 	LastActivity   time.Time `json:"last_activity"`
 	FirstActivity  time.Time `json:"first_activity"`
 	DataSize       int64     `json:"data_size"`
+
+	// Bandwidth accounting for compressed streams received from relays
+	CompressedEventCount int   `json:"compressed_event_count"`
+	CompressedBytes      int64 `json:"compressed_bytes"`
+	UncompressedBytes    int64 `json:"uncompressed_bytes"`
 }
 
 type Stag struct {
@@ -187,6 +214,36 @@ type IngestBatch struct {
 	ProcessingInfo ProcessingInfo `json:"processing_info"`
 }
 
+// BatchResult is the recorded outcome of an ingest batch.
+type BatchResult struct {
+	BatchID        string        `json:"batch_id"`
+	TraceID        string        `json:"trace_id"`
+	RelayID        string        `json:"relay_id,omitempty"`
+	Status         string        `json:"status"` // "processing", "completed"
+	Received       int           `json:"received"`
+	Processed      int           `json:"processed"` // created + updated + unchanged
+	Created        int           `json:"created"`
+	Updated        int           `json:"updated"`
+	Unchanged      int           `json:"unchanged"`
+	Failed         int           `json:"failed"`
+	Duplicates     int           `json:"duplicates"` // events already committed by an earlier batch
+	Events         []EventResult `json:"events"`
+	ReceivedAt     time.Time     `json:"received_at"`
+	CompletedAt    *time.Time    `json:"completed_at,omitempty"`
+	ProcessingTime time.Duration `json:"processing_time"`
+}
+
+// EventResult is what happened to one event of an ingest batch.
+type EventResult struct {
+	Index     int    `json:"index"`
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	AnchorID  string `json:"anchor_id,omitempty"`
+	Status    string `json:"status"` // "pending", "created", "updated", "unchanged", "duplicate", "failed"
+	VersionID string `json:"version_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
 type SpatialGraph struct {
 	StagID    string             `json:"stag_id"`
 	Anchors   map[string]*Anchor `json:"anchors"`